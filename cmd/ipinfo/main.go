@@ -3,7 +3,9 @@ package main
 import (
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	_ "github.com/jnovack/release"
@@ -17,7 +19,8 @@ import (
 )
 
 func main() {
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		return
 		// TODO Add Favicon Functionality
 		// bytes, err := base64.StdEncoding.DecodeString(favicon.Icon)
@@ -27,9 +30,63 @@ func main() {
 		// w.Header().Set("Content-Type", "image/png")
 		// w.Write(bytes)
 	})
-	http.Handle("/", http.HandlerFunc(ipinfo.Lookup))
+	mux.Handle("/metrics", ipinfo.MetricsHandler())
+	mux.Handle("/server-ip", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.ServerIP))))
+	if *ipinfo.AdminToken != "" {
+		mux.HandleFunc("/admin/", ipinfo.Admin)
+		mux.HandleFunc("/events", ipinfo.Events)
+	}
+	mux.Handle("/asn/", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.ASN))))
+	mux.Handle("/distance/", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.Distance))))
+	mux.Handle("/geofence/", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.Geofence))))
+	mux.Handle("/geo/", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.Geo))))
+	mux.Handle("/batch", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.Batch))))
+	mux.Handle("/graphql", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.GraphQL))))
+	mux.Handle("/ws", ipinfo.Tarpit(http.HandlerFunc(ipinfo.WebSocket)))
+	mux.Handle("/dns-query", ipinfo.Tarpit(http.HandlerFunc(ipinfo.DNSQuery)))
+	mux.Handle("/", ipinfo.Compress(ipinfo.Tarpit(http.HandlerFunc(ipinfo.Lookup))))
+	if *ipinfo.Pprof {
+		if *ipinfo.PprofAddr == "" {
+			log.Warn().Msg("Serving pprof profiles on the main port, do not expose it publicly")
+			mux.Handle("/debug/pprof/", ipinfo.PprofHandler())
+		} else {
+			go func() {
+				log.Info().Msg("Serving pprof profiles on " + *ipinfo.PprofAddr)
+				err := http.ListenAndServe(*ipinfo.PprofAddr, ipinfo.PprofHandler())
+				log.Fatal().Err(err).Msg("pprof listener failed")
+			}()
+		}
+	}
+	if *ipinfo.BinaryPort != 0 {
+		go func() {
+			err := ipinfo.ServeBinary(":" + strconv.FormatInt(int64(*ipinfo.BinaryPort), 10))
+			log.Fatal().Err(err).Msg("Binary protocol listener failed")
+		}()
+	}
+	if *ipinfo.GRPCPort != 0 {
+		if *ipinfo.GRPCCert == "" || *ipinfo.GRPCKey == "" {
+			log.Fatal().Msg("gRPC needs a certificate, set -grpc-cert and -grpc-key")
+		}
+		go func() {
+			err := ipinfo.ServeGRPC(":"+strconv.FormatInt(int64(*ipinfo.GRPCPort), 10), *ipinfo.GRPCCert, *ipinfo.GRPCKey)
+			log.Fatal().Err(err).Msg("gRPC listener failed")
+		}()
+	}
+	if *ipinfo.WhoisPort != 0 {
+		go func() {
+			err := ipinfo.ServeWhois(":" + strconv.FormatInt(int64(*ipinfo.WhoisPort), 10))
+			log.Fatal().Err(err).Msg("WHOIS listener failed")
+		}()
+	}
+	if *ipinfo.DNSPort != 0 {
+		go func() {
+			err := ipinfo.ServeDNS(":" + strconv.FormatInt(int64(*ipinfo.DNSPort), 10))
+			log.Fatal().Err(err).Msg("DNS listener failed")
+		}()
+	}
+	go reloadOnHangup()
 	log.Info().Msg("Listening on :" + strconv.FormatInt(int64(*ipinfo.Port), 10))
-	http.ListenAndServe(":"+strconv.FormatInt(int64(*ipinfo.Port), 10), nil)
+	http.ListenAndServe(":"+strconv.FormatInt(int64(*ipinfo.Port), 10), mux)
 }
 
 func init() {
@@ -48,6 +105,24 @@ func init() {
 
 	ipinfo.Initialize(chdir.WorkDir())
 
+	setLogLevel()
+}
+
+// reloadOnHangup reloads the settings and databases on every SIGHUP.
+func reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := ipinfo.Reload(); err != nil {
+			log.Error().Err(err).Msg("Unable to reload settings and databases")
+			continue
+		}
+		setLogLevel()
+		log.Info().Msg("Reloaded settings and databases")
+	}
+}
+
+func setLogLevel() {
 	var zerologlevel zerolog.Level
 	switch *ipinfo.Loglevel {
 	case -1:
@@ -63,5 +138,4 @@ func init() {
 	}
 
 	zerolog.SetGlobalLevel(zerologlevel)
-
 }
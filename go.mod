@@ -8,6 +8,7 @@ require (
 	github.com/mattn/go-isatty v0.0.12
 	github.com/namsral/flag v1.7.4-pre
 	github.com/oschwald/geoip2-golang v1.4.0
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/prometheus/client_golang v1.7.1
 	github.com/rs/zerolog v1.19.0
 )
@@ -0,0 +1,124 @@
+package ipinfo
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// negotiate returns the offer the Accept header weighs highest, earlier
+// offers winning ties, following RFC 7231 section 5.3.2: the most specific
+// matching media range sets an offer's quality and q=0 rules it out. When no
+// offer is acceptable, or there is no Accept header, fallback is returned.
+func negotiate(accept string, offers []string, fallback string) string {
+	if strings.TrimSpace(accept) == "" {
+		return fallback
+	}
+
+	type mediaRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		slash := strings.IndexByte(mediatype, '/')
+		if slash < 0 {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediatype[:slash], mediatype[slash+1:], q})
+	}
+
+	best, bestQ := fallback, 0.0
+	for _, offer := range offers {
+		slash := strings.IndexByte(offer, '/')
+		typ, subtype := offer[:slash], offer[slash+1:]
+
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			var s int
+			switch {
+			case mr.typ == typ && mr.subtype == subtype:
+				s = 2
+			case mr.typ == typ && mr.subtype == "*":
+				s = 1
+			case mr.typ == "*" && mr.subtype == "*":
+				s = 0
+			default:
+				continue
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// negotiateLanguage returns the offer the Accept-Language header prefers,
+// following the lookup scheme of RFC 4647 section 3.4: a language range
+// matches an offer it equals, or else one its shorter prefixes equal, so
+// en-US matches en. A range also matches a more specific offer, so pt
+// matches pt-BR. The highest quality wins, ties going to the range listed
+// first, and the wildcard states no preference. When no offer is acceptable,
+// or there is no Accept-Language header, fallback is returned.
+func negotiateLanguage(acceptLanguage string, offers []string, fallback string) string {
+	best, bestQ := fallback, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, q := strings.TrimSpace(part), 1.0
+		if semi := strings.IndexByte(tag, ';'); semi >= 0 {
+			param := strings.TrimSpace(tag[semi+1:])
+			tag = strings.TrimSpace(tag[:semi])
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(param[2:], 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		if tag == "" || tag == "*" || q <= bestQ {
+			continue
+		}
+		if offer := matchLanguage(tag, offers); offer != "" {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// matchLanguage returns the offer matching a language range, trying the
+// range itself, then the offers it is a prefix of, then its own prefixes.
+func matchLanguage(tag string, offers []string) string {
+	for _, offer := range offers {
+		if strings.EqualFold(offer, tag) {
+			return offer
+		}
+	}
+	for _, offer := range offers {
+		if len(offer) > len(tag) && offer[len(tag)] == '-' && strings.EqualFold(offer[:len(tag)], tag) {
+			return offer
+		}
+	}
+	for dash := strings.LastIndexByte(tag, '-'); dash > 0; dash = strings.LastIndexByte(tag, '-') {
+		tag = tag[:dash]
+		for _, offer := range offers {
+			if strings.EqualFold(offer, tag) {
+				return offer
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package ipinfo
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type databaseStatus struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Type       string `json:"type,omitempty"`
+	BuildEpoch uint   `json:"build_epoch,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type adminStatus struct {
+	ReloadedAt string           `json:"reloaded_at"`
+	Databases  []databaseStatus `json:"databases"`
+}
+
+// currentStatus describes the configured databases as they are loaded.
+func currentStatus() adminStatus {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	status := adminStatus{ReloadedAt: reloadedAt.UTC().Format(time.RFC3339)}
+	add := func(name, path string, db *geoip2.Reader) {
+		if path == "" {
+			return
+		}
+		entry := databaseStatus{Name: name, Path: path}
+		if db != nil {
+			metadata := db.Metadata()
+			entry.Type, entry.BuildEpoch = metadata.DatabaseType, metadata.BuildEpoch
+		}
+		if err := loadErrors[path]; err != nil {
+			entry.Error = err.Error()
+		}
+		status.Databases = append(status.Databases, entry)
+	}
+	for i, path := range config.Layers {
+		if i < len(dbLayers) {
+			add("layer", path, dbLayers[i])
+		}
+	}
+	add("city", config.CityDB, dbCity)
+	add("asn", config.ASNDB, dbASN)
+	add("enterprise", config.EnterpriseDB, dbEnterprise)
+	add("anonymous-ip", config.AnonymousDB, dbAnonymous)
+	add("isp", config.ISPDB, dbISP)
+	add("domain", config.DomainDB, dbDomain)
+	add("connection-type", config.ConnectionTypeDB, dbConnectionType)
+	return status
+}
+
+// authorizeAdmin checks the request carries the AdminToken as a bearer
+// token. Otherwise it answers not found without a token configured, or
+// unauthorized, and returns that status.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) int {
+	if *AdminToken == "" {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == r.Header.Get("Authorization") || subtle.ConstantTimeCompare([]byte(token), []byte(*AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ipinfo"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return http.StatusUnauthorized
+	}
+	return http.StatusOK
+}
+
+// Admin serves /admin/status, describing the loaded databases, and POST
+// /admin/reload, reloading them first. Both require the AdminToken as a
+// bearer token, and are not found without one configured.
+func Admin(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	if retval = authorizeAdmin(w, r); retval != http.StatusOK {
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/status":
+	case "/admin/reload":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			retval = http.StatusMethodNotAllowed
+			return
+		}
+		if err := reloadDatabases(); err != nil {
+			retval = http.StatusInternalServerError
+		}
+	default:
+		http.NotFound(w, r)
+		retval = http.StatusNotFound
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(retval)
+	json.NewEncoder(w).Encode(currentStatus())
+}
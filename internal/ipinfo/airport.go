@@ -0,0 +1,34 @@
+package ipinfo
+
+import "math"
+
+// airports is only populated when built with the "airports" tag, so that the
+// dataset does not bloat binaries that never use it.
+var airports []airport
+
+type airport struct {
+	IATA      string
+	Latitude  float64
+	Longitude float64
+}
+
+type nearestAirport struct {
+	IATA     string  `json:"iata"`
+	Distance float64 `json:"distance"`
+}
+
+// closestAirport finds the major airport nearest to the coordinates, with
+// the distance in kilometers. It returns nil without a dataset.
+func closestAirport(latitude, longitude float64) *nearestAirport {
+	var nearest *nearestAirport
+	for _, a := range airports {
+		d := greatCircle(latitude, longitude, a.Latitude, a.Longitude)
+		if nearest == nil || d < nearest.Distance {
+			nearest = &nearestAirport{IATA: a.IATA, Distance: d}
+		}
+	}
+	if nearest != nil {
+		nearest.Distance = math.Round(nearest.Distance*10) / 10
+	}
+	return nearest
+}
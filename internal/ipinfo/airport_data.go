@@ -0,0 +1,88 @@
+//go:build airports
+// +build airports
+
+package ipinfo
+
+func init() {
+	airports = []airport{
+		{"AKL", -37.0082, 174.7850},
+		{"AMS", 52.3105, 4.7683},
+		{"ANC", 61.1743, -149.9962},
+		{"ARN", 59.6498, 17.9238},
+		{"ATH", 37.9364, 23.9445},
+		{"ATL", 33.6407, -84.4277},
+		{"BCN", 41.2974, 2.0833},
+		{"BKK", 13.6900, 100.7501},
+		{"BLR", 13.1986, 77.7066},
+		{"BNE", -27.3942, 153.1218},
+		{"BOG", 4.7016, -74.1469},
+		{"BOM", 19.0896, 72.8656},
+		{"BOS", 42.3656, -71.0096},
+		{"CAI", 30.1219, 31.4056},
+		{"CAN", 23.3924, 113.2988},
+		{"CDG", 49.0097, 2.5479},
+		{"CGK", -6.1256, 106.6559},
+		{"CPH", 55.6180, 12.6508},
+		{"CPT", -33.9715, 18.6021},
+		{"DEL", 28.5562, 77.1000},
+		{"DEN", 39.8561, -104.6737},
+		{"DFW", 32.8998, -97.0403},
+		{"DOH", 25.2731, 51.6081},
+		{"DTW", 42.2162, -83.3554},
+		{"DUB", 53.4264, -6.2499},
+		{"DXB", 25.2532, 55.3657},
+		{"EWR", 40.6895, -74.1745},
+		{"EZE", -34.8222, -58.5358},
+		{"FCO", 41.8003, 12.2389},
+		{"FRA", 50.0379, 8.5622},
+		{"GRU", -23.4356, -46.4731},
+		{"HEL", 60.3172, 24.9633},
+		{"HKG", 22.3080, 113.9185},
+		{"HND", 35.5494, 139.7798},
+		{"HNL", 21.3187, -157.9224},
+		{"IAD", 38.9531, -77.4565},
+		{"IAH", 29.9902, -95.3368},
+		{"ICN", 37.4602, 126.4407},
+		{"IST", 41.2753, 28.7519},
+		{"JFK", 40.6413, -73.7781},
+		{"JNB", -26.1367, 28.2411},
+		{"KIX", 34.4320, 135.2304},
+		{"KUL", 2.7456, 101.7099},
+		{"LAS", 36.0840, -115.1537},
+		{"LAX", 33.9416, -118.4085},
+		{"LHR", 51.4700, -0.4543},
+		{"LIM", -12.0219, -77.1143},
+		{"LIS", 38.7756, -9.1354},
+		{"LOS", 6.5774, 3.3212},
+		{"MAD", 40.4983, -3.5676},
+		{"MCO", 28.4312, -81.3081},
+		{"MEL", -37.6690, 144.8410},
+		{"MEX", 19.4361, -99.0719},
+		{"MIA", 25.7959, -80.2870},
+		{"MNL", 14.5086, 121.0194},
+		{"MSP", 44.8848, -93.2223},
+		{"MUC", 48.3537, 11.7750},
+		{"NBO", -1.3192, 36.9278},
+		{"NRT", 35.7720, 140.3929},
+		{"ORD", 41.9742, -87.9073},
+		{"OSL", 60.1976, 11.1004},
+		{"PEK", 40.0799, 116.6031},
+		{"PHL", 39.8744, -75.2424},
+		{"PHX", 33.4352, -112.0101},
+		{"PVG", 31.1443, 121.8083},
+		{"SCL", -33.3930, -70.7858},
+		{"SEA", 47.4502, -122.3088},
+		{"SFO", 37.6213, -122.3790},
+		{"SIN", 1.3644, 103.9915},
+		{"SVO", 55.9726, 37.4146},
+		{"SYD", -33.9399, 151.1753},
+		{"TLV", 32.0055, 34.8854},
+		{"TPE", 25.0797, 121.2342},
+		{"VIE", 48.1103, 16.5697},
+		{"WAW", 52.1657, 20.9671},
+		{"YUL", 45.4706, -73.7408},
+		{"YVR", 49.1967, -123.1815},
+		{"YYZ", 43.6777, -79.6248},
+		{"ZRH", 47.4582, 8.5555},
+	}
+}
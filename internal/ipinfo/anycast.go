@@ -0,0 +1,38 @@
+package ipinfo
+
+import "net"
+
+// anycastNote explains the coordinates of anycast addresses
+const anycastNote = "anycast network, coordinates are representative only"
+
+// anycastNets are well-known anycast services, mostly public resolvers,
+// answered from many locations at once whatever the database says.
+var anycastNets = parseCIDRs(
+	"1.0.0.0/24",          // Cloudflare DNS
+	"1.1.1.0/24",          // Cloudflare DNS
+	"8.8.4.0/24",          // Google Public DNS
+	"8.8.8.0/24",          // Google Public DNS
+	"9.9.9.0/24",          // Quad9
+	"149.112.112.0/24",    // Quad9
+	"208.67.220.0/24",     // OpenDNS
+	"208.67.222.0/24",     // OpenDNS
+	"94.140.14.0/24",      // AdGuard DNS
+	"94.140.15.0/24",      // AdGuard DNS
+	"185.228.168.0/24",    // CleanBrowsing
+	"76.76.2.0/24",        // Control D
+	"76.76.10.0/24",       // Control D
+	"2606:4700:4700::/48", // Cloudflare DNS
+	"2001:4860:4860::/48", // Google Public DNS
+	"2620:fe::/48",        // Quad9
+	"2620:119:35::/48",    // OpenDNS
+	"2620:119:53::/48",    // OpenDNS
+)
+
+func isAnycastIP(ip net.IP) bool {
+	for _, n := range anycastNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package ipinfo
+
+import (
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+)
+
+// asnDetail is what is known about an AS number rather than an address.
+// Country and Prefixes are only known from the iptoasn.com dump.
+type asnDetail struct {
+	ASN          uint     `json:"asn"`
+	Organization string   `json:"organization"`
+	Country      string   `json:"country,omitempty"`
+	Prefixes     []string `json:"prefixes,omitempty"`
+}
+
+// asnNames maps the AS numbers in the ASN database to their organization.
+// It is built with the reader and swapped in along with it, guarded by
+// dbLock.
+var asnNames map[uint]string
+
+// indexASNs walks every network of the ASN database once, for the names of
+// its AS numbers. It returns nil when the walk fails.
+func indexASNs(reader *maxminddb.Reader) map[uint]string {
+	if reader == nil {
+		return nil
+	}
+	start := time.Now()
+	names := make(map[uint]string)
+	networks := reader.Networks()
+	for networks.Next() {
+		var rec struct {
+			ASN          uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if _, err := networks.Network(&rec); err == nil && rec.ASN != 0 {
+			names[rec.ASN] = rec.Organization
+		}
+	}
+	if err := networks.Err(); err != nil {
+		log.Warn().Err(err).Msg("Unable to walk the ASN database, AS numbers will not have names")
+		return nil
+	}
+	log.Info().Int("asns", len(names)).Dur("took", time.Since(start)).Msg("Indexed the ASN database")
+	return names
+}
+
+// organizationOf returns the organization of asn in the ASN database.
+func organizationOf(asn uint) (string, bool) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	name, ok := asnNames[asn]
+	return name, ok
+}
+
+// lookupASN describes asn from the iptoasn.com dump, with its prefixes, or
+// the ASN database.
+func lookupASN(asn uint) (asnDetail, bool) {
+	detail := asnDetail{ASN: asn}
+	for _, r := range asnRangesByASN[asn] {
+		detail.Organization, detail.Country = r.organization, r.country
+		for _, network := range rangeNetworks(r.start, r.end) {
+			detail.Prefixes = append(detail.Prefixes, network.String())
+		}
+	}
+	if detail.Prefixes != nil {
+		return detail, true
+	}
+
+	name, ok := organizationOf(asn)
+	detail.Organization = name
+	return detail, ok
+}
+
+// rangeNetworks splits the range from start to end into the fewest networks
+// covering it exactly.
+func rangeNetworks(start, end net.IP) []*net.IPNet {
+	bits := 128
+	if start.To4() != nil && end.To4() != nil {
+		start, end, bits = start.To4(), end.To4(), 32
+	}
+	first, last := big.NewInt(0).SetBytes(start), big.NewInt(0).SetBytes(end)
+	one := big.NewInt(1)
+
+	var networks []*net.IPNet
+	for first.Cmp(last) <= 0 {
+		// The largest block aligned at first that does not run past last.
+		size := int(first.TrailingZeroBits())
+		if first.Sign() == 0 || size > bits {
+			size = bits
+		}
+		for ; size > 0; size-- {
+			blockEnd := big.NewInt(0).Lsh(one, uint(size))
+			blockEnd.Add(blockEnd, first).Sub(blockEnd, one)
+			if blockEnd.Cmp(last) <= 0 {
+				break
+			}
+		}
+
+		ip := make(net.IP, bits/8)
+		first.FillBytes(ip)
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits-size, bits)})
+		first.Add(first, big.NewInt(0).Lsh(one, uint(size)))
+	}
+	return networks
+}
+
+// ASN serves /asn/AS15169 (or /asn/15169), describing the AS number.
+func ASN(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	number := strings.TrimPrefix(strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/asn/")), "AS")
+	asn, err := strconv.ParseUint(number, 10, 32)
+	if err != nil || asn == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	detail, ok := lookupASN(uint(asn))
+	if !ok {
+		http.NotFound(w, r)
+		retval = http.StatusNotFound
+		return
+	}
+	sort.Strings(detail.Prefixes)
+	writeJSON(w, r, detail)
+	retval = http.StatusOK
+}
@@ -0,0 +1,440 @@
+package ipinfo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	errInvalidIP  = errors.New("invalid IP address")
+	errBatchLimit = errors.New("too many addresses")
+)
+
+// Streamed batches are looked up this many entries at a time.
+const batchChunk = 256
+
+// Buffered batch bodies may hold this many bytes per entry allowed by
+// BatchLimit, room for IPv6 addresses with their comments and whitespace.
+const batchEntryBytes = 1024
+
+// batchSlots is shared by every batch request, so the total number of batch
+// lookups in flight never exceeds BatchWorkers no matter how many batches
+// arrive at once. Single lookups do not take a slot.
+var batchSlots chan struct{}
+
+// batchFormats are the response formats of a batch, the first is the default
+var batchFormats = []string{"application/json", "text/csv", "application/x-ndjson"}
+
+// batchResult is the outcome of looking up a single batch entry.
+type batchResult struct {
+	query string
+	info  ipInfo
+	err   error
+}
+
+// entry is the JSON form of the result, the lookup or else the error.
+func (result batchResult) entry() interface{} {
+	if result.err != nil {
+		return lookupError{Query: result.query, Error: result.err.Error()}
+	}
+	return result.info
+}
+
+// lookupBatch resolves every query using a bounded pool of workers. Results
+// are returned in the same order as the queries.
+func lookupBatch(queries []string) []batchResult {
+	results := make([]batchResult, len(queries))
+
+	workers := cap(batchSlots)
+	if workers > len(queries) {
+		workers = len(queries)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				batchSlots <- struct{}{}
+				results[j] = lookupQuery(queries[j])
+				<-batchSlots
+			}
+		}()
+	}
+
+	for i := range queries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// lookupQuery parses and looks up a single batch entry.
+func lookupQuery(query string) batchResult {
+	result := batchResult{query: query}
+
+	ip := net.ParseIP(strings.TrimSpace(query))
+	if ip == nil {
+		result.err = errInvalidIP
+		return result
+	}
+
+	result.info, result.err = LookupIP(ip)
+	return result
+}
+
+// Batch looks up every IP address posted in the request body, either raw or
+// as a multipart file upload, one address per line. Blank lines and lines
+// starting with # are skipped. A JSON body is an array of addresses instead.
+// Either holds at most BatchLimit addresses. Results are streamed back as a
+// JSON array or, when the Accept header prefers it, as a CSV download or
+// NDJSON lines. A list streamed in over HTTP/2 that turns out too long ends
+// with an NDJSON error line, as the response has already started.
+func Batch(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+	entries := 0
+
+	defer func() {
+		observeRequest(r, start, retval).Int("entries", entries).Msg("")
+	}()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		retval = http.StatusMethodNotAllowed
+		return
+	}
+
+	addVary(w, "Accept")
+	format := negotiate(r.Header.Get("Accept"), batchFormats, batchFormats[0])
+
+	// HTTP/2 request bodies can still be read while the response is
+	// streamed, so NDJSON answers each chunk of lines as it arrives.
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	streamed := format == "application/x-ndjson" && r.ProtoMajor >= 2 && contentType != "application/json"
+	r.Body = http.MaxBytesReader(w, r.Body, int64(*BatchLimit+1)*batchEntryBytes)
+
+	body, err := batchBody(r)
+	if bodyTooLarge(err) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		retval = http.StatusRequestEntityTooLarge
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	if streamed {
+		retval = http.StatusOK
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		scanner := bufio.NewScanner(body)
+		read := 0
+		entries, err = writeBatchNDJSON(w, func() ([]string, error) {
+			queries, err := scanQueries(scanner, batchChunk)
+			// The response has started, so the addresses up to the limit
+			// are answered and an error line ends the stream.
+			if read += len(queries); read > *BatchLimit {
+				return queries[:len(queries)-(read-*BatchLimit)], errBatchLimit
+			}
+			return queries, err
+		})
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			log.Warn().Err(err).Int("entries", entries).Msg("Warning: Batch response was cut short")
+		}
+		return
+	}
+
+	// HTTP/1.x request bodies cannot be read once the response is flushed,
+	// so the whole list is read before anything is written.
+	var queries []string
+	if contentType == "application/json" {
+		queries, err = readJSONQueries(body)
+	} else {
+		queries, err = readQueries(body)
+	}
+	if err == errBatchLimit || bodyTooLarge(err) {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		retval = http.StatusRequestEntityTooLarge
+		return
+	}
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	retval = http.StatusOK
+	if format == "application/x-ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		entries, err = writeBatchNDJSON(w, func() ([]string, error) {
+			n := batchChunk
+			if n > len(queries) {
+				n = len(queries)
+			}
+			chunk := queries[:n]
+			queries = queries[n:]
+			return chunk, nil
+		})
+	} else if format == "text/csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="ipinfo.csv"`)
+		entries, err = writeBatchCSV(w, queries)
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		entries, err = writeBatchJSON(w, queries)
+	}
+	if err != nil {
+		log.Warn().Err(err).Int("entries", entries).Msg("Warning: Batch response was cut short")
+	}
+}
+
+// batchBody returns the posted list of addresses, which is either the body
+// itself or the first file of a multipart upload.
+func batchBody(r *http.Request) (io.Reader, error) {
+	mediatype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/form-data" {
+		return r.Body, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// readQueries returns the addresses in body, of at most BatchLimit entries.
+func readQueries(body io.Reader) ([]string, error) {
+	queries, err := scanQueries(bufio.NewScanner(body), *BatchLimit+1)
+	if err == nil && len(queries) > *BatchLimit {
+		return nil, errBatchLimit
+	}
+	return queries, err
+}
+
+// bodyTooLarge reports whether err is the one of http.MaxBytesReader, which
+// has no type of its own before Go 1.19.
+func bodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// scanQueries returns the next addresses of a list, at most n of them unless
+// n is negative. Lines may be JSON strings, as in NDJSON.
+func scanQueries(scanner *bufio.Scanner, n int) ([]string, error) {
+	var queries []string
+	for len(queries) != n && scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, `"`) {
+			if unquoted, err := strconv.Unquote(line); err == nil {
+				line = unquoted
+			}
+		}
+		queries = append(queries, line)
+	}
+	return queries, scanner.Err()
+}
+
+// readJSONQueries returns the addresses of a JSON array, of at most
+// BatchLimit entries.
+func readJSONQueries(body io.Reader) ([]string, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errors.New("expected a JSON array")
+	}
+
+	var queries []string
+	for dec.More() {
+		if len(queries) >= *BatchLimit {
+			return nil, errBatchLimit
+		}
+		var query string
+		if err := dec.Decode(&query); err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+// writeBatchJSON streams the lookups of queries as a JSON array, a chunk at a
+// time like writeBatchCSV. It returns the number of entries written.
+func writeBatchJSON(w io.Writer, queries []string) (int, error) {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return 0, err
+	}
+
+	entries := 0
+	for len(queries) > 0 {
+		n := batchChunk
+		if n > len(queries) {
+			n = len(queries)
+		}
+		var chunk bytes.Buffer
+		for _, result := range lookupBatch(queries[:n]) {
+			if entries > 0 {
+				chunk.WriteByte(',')
+			}
+			raw, err := json.Marshal(result.entry())
+			if err != nil {
+				return entries, err
+			}
+			chunk.Write(raw)
+			entries++
+		}
+		queries = queries[n:]
+
+		if _, err := w.Write(chunk.Bytes()); err != nil {
+			return entries, err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	_, err := io.WriteString(w, "]\n")
+	return entries, err
+}
+
+// writeBatchNDJSON writes the lookups of the queries returned by next, one
+// JSON line each, flushing every chunk as it completes. next returns no
+// queries at the end, or an error after which its last queries are still
+// written. It returns the number of entries written.
+func writeBatchNDJSON(w io.Writer, next func() ([]string, error)) (int, error) {
+	entries := 0
+	for {
+		queries, nextErr := next()
+		if len(queries) == 0 {
+			return entries, nextErr
+		}
+
+		var chunk bytes.Buffer
+		enc := json.NewEncoder(&chunk)
+		for _, result := range lookupBatch(queries) {
+			if err := enc.Encode(result.entry()); err != nil {
+				return entries, err
+			}
+			entries++
+		}
+
+		if _, err := w.Write(chunk.Bytes()); err != nil {
+			return entries, err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if nextErr != nil {
+			return entries, nextErr
+		}
+	}
+}
+
+var csvHeader = []string{
+	"query", "ip", "city", "region", "country_code", "country_name",
+	"continent_code", "continent_name", "latitude", "longitude", "postal",
+	"asn", "organization", "error",
+}
+
+// writeBatchCSV looks up the queries a chunk at a time, flushing each chunk
+// of rows as it completes so the response is never held in memory. It
+// returns the number of entries written.
+func writeBatchCSV(w io.Writer, queries []string) (int, error) {
+	out := csv.NewWriter(w)
+	out.Write(csvHeader)
+
+	entries := 0
+	for len(queries) > 0 {
+		n := batchChunk
+		if n > len(queries) {
+			n = len(queries)
+		}
+		for _, result := range lookupBatch(queries[:n]) {
+			out.Write(csvRecord(result))
+		}
+		queries = queries[n:]
+		entries += n
+
+		out.Flush()
+		if err := out.Error(); err != nil {
+			return entries, err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	out.Flush()
+	return entries, out.Error()
+}
+
+// csvRecord flattens a batch result into a row matching csvHeader.
+func csvRecord(result batchResult) []string {
+	if result.err == errInvalidIP {
+		return []string{result.query, "", "", "", "", "", "", "", "", "", "", "", "", result.err.Error()}
+	}
+
+	info := result.info
+	var continent codename
+	if info.Continent != nil {
+		continent = *info.Continent
+	}
+	var postal string
+	if info.Postal != nil {
+		postal = *info.Postal
+	}
+	var lookupErr string
+	if result.err != nil {
+		lookupErr = result.err.Error()
+	}
+
+	return []string{
+		result.query,
+		info.IP,
+		info.City,
+		info.Region,
+		info.Country.Code,
+		info.Country.Name,
+		continent.Code,
+		continent.Name,
+		strconv.FormatFloat(info.Location.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(info.Location.Longitude, 'f', -1, 64),
+		postal,
+		strconv.FormatUint(uint64(info.ASN), 10),
+		info.Organization,
+		lookupErr,
+	}
+}
@@ -0,0 +1,118 @@
+package ipinfo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Layout of the fixed-size binary response, see docs/binary.md.
+const (
+	binaryVersion      = 1
+	binaryResponseSize = 42
+
+	binaryStatusOK         = 0
+	binaryStatusBadRequest = 1
+	binaryStatusError      = 2
+)
+
+// Connections idle for longer than this are closed.
+const binaryIdleTimeout = 5 * time.Minute
+
+// ServeBinary accepts connections speaking the length-prefixed binary lookup
+// protocol on addr. It only returns when the listener fails.
+func ServeBinary(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info().Msg("Binary protocol listening on " + addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go serveBinaryConn(conn)
+	}
+}
+
+// serveBinaryConn answers requests on conn until the client hangs up. Each
+// request is a big-endian uint16 length followed by a 4 or 16 byte address,
+// and each response is a uint16 length followed by the fixed-size record.
+// Responses are batched into as few writes as the client's pipelining allows.
+func serveBinaryConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	request := make([]byte, net.IPv6len)
+	response := make([]byte, 2+binaryResponseSize)
+	binary.BigEndian.PutUint16(response, binaryResponseSize)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(binaryIdleTimeout))
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return
+		}
+
+		var ip net.IP
+		if length == net.IPv4len || length == net.IPv6len {
+			if _, err := io.ReadFull(r, request[:length]); err != nil {
+				return
+			}
+			ip = net.IP(request[:length])
+		} else if _, err := r.Discard(int(length)); err != nil {
+			return
+		}
+
+		encodeBinary(response[2:], ip)
+		if _, err := w.Write(response); err != nil {
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// encodeBinary looks up ip and fills buf with the fixed-size record. A nil
+// ip is answered with a bad request status.
+func encodeBinary(buf []byte, ip net.IP) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	buf[0] = binaryVersion
+
+	if ip == nil {
+		buf[1] = binaryStatusBadRequest
+		return
+	}
+
+	ipinfo, err := LookupIP(ip)
+	if err != nil {
+		buf[1] = binaryStatusError
+	}
+
+	copy(buf[2:18], ip.To16())
+	copy(buf[18:20], ipinfo.Country.Code)
+	if ipinfo.Continent != nil {
+		copy(buf[20:22], ipinfo.Continent.Code)
+	}
+	binary.BigEndian.PutUint64(buf[22:30], math.Float64bits(ipinfo.Location.Latitude))
+	binary.BigEndian.PutUint64(buf[30:38], math.Float64bits(ipinfo.Location.Longitude))
+	binary.BigEndian.PutUint32(buf[38:42], uint32(ipinfo.ASN))
+}
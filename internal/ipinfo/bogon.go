@@ -0,0 +1,51 @@
+package ipinfo
+
+import "net"
+
+// specialRange is a block of the IANA special-purpose address registries,
+// with the kind of address it holds.
+type specialRange struct {
+	network *net.IPNet
+	kind    string
+}
+
+// specialRanges are the blocks of the IANA IPv4 and IPv6 special-purpose
+// address registries that are not globally reachable, more specific blocks
+// first. Addresses in them never resolve to a location.
+var specialRanges = []specialRange{
+	{mustParseCIDR("0.0.0.0/8"), "this-network"},
+	{mustParseCIDR("10.0.0.0/8"), "private"},
+	{mustParseCIDR("100.64.0.0/10"), "cgnat"},
+	{mustParseCIDR("127.0.0.0/8"), "loopback"},
+	{mustParseCIDR("169.254.0.0/16"), "link-local"},
+	{mustParseCIDR("172.16.0.0/12"), "private"},
+	{mustParseCIDR("192.0.0.0/24"), "reserved"},
+	{mustParseCIDR("192.0.2.0/24"), "documentation"},
+	{mustParseCIDR("192.168.0.0/16"), "private"},
+	{mustParseCIDR("198.18.0.0/15"), "benchmarking"},
+	{mustParseCIDR("198.51.100.0/24"), "documentation"},
+	{mustParseCIDR("203.0.113.0/24"), "documentation"},
+	{mustParseCIDR("224.0.0.0/4"), "multicast"},
+	{mustParseCIDR("255.255.255.255/32"), "broadcast"},
+	{mustParseCIDR("240.0.0.0/4"), "reserved"},
+	{mustParseCIDR("::/128"), "unspecified"},
+	{mustParseCIDR("::1/128"), "loopback"},
+	{mustParseCIDR("100::/64"), "reserved"},
+	{mustParseCIDR("2001:2::/48"), "benchmarking"},
+	{mustParseCIDR("2001:db8::/32"), "documentation"},
+	{mustParseCIDR("3fff::/20"), "documentation"},
+	{mustParseCIDR("fc00::/7"), "private"},
+	{mustParseCIDR("fe80::/10"), "link-local"},
+	{mustParseCIDR("ff00::/8"), "multicast"},
+}
+
+// classifyIP returns the kind of special-purpose address ip is, or an empty
+// string for a globally reachable one.
+func classifyIP(ip net.IP) string {
+	for _, r := range specialRanges {
+		if r.network.Contains(ip) {
+			return r.kind
+		}
+	}
+	return ""
+}
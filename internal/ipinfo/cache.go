@@ -0,0 +1,103 @@
+package ipinfo
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// lookupCache holds recent database lookups, nil when caching is disabled
+var lookupCache *cache
+
+// cache is a fixed-size LRU of lookups. IPv6 addresses are keyed on their
+// first ipv6Prefix bits, so all the addresses a client rotates through
+// within its prefix share an entry.
+type cache struct {
+	mu         sync.Mutex
+	size       int
+	ipv6Prefix net.IPMask
+	entries    map[string]*list.Element
+	order      *list.List
+}
+
+type cacheEntry struct {
+	key  string
+	info ipInfo
+}
+
+func newCache(size, ipv6Prefix int) *cache {
+	if ipv6Prefix < 0 || ipv6Prefix > 128 {
+		ipv6Prefix = 128
+	}
+	return &cache{
+		size:       size,
+		ipv6Prefix: net.CIDRMask(ipv6Prefix, 128),
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// initializeCache starts caching lookups when CacheSize is set.
+func initializeCache() {
+	lookupCache = nil
+	if config.CacheSize > 0 {
+		lookupCache = newCache(config.CacheSize, config.CacheIPv6Prefix)
+	}
+}
+
+func (c *cache) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.Mask(c.ipv6Prefix))
+}
+
+func (c *cache) get(ip net.IP) (ipInfo, bool) {
+	if c == nil {
+		return ipInfo{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[c.key(ip)]
+	if !ok {
+		cacheRequests.WithLabelValues("miss").Inc()
+		return ipInfo{}, false
+	}
+	cacheRequests.WithLabelValues("hit").Inc()
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).info, true
+}
+
+func (c *cache) add(ip net.IP, info ipInfo) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(ip)
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).info = info
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, info})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// purge forgets every entry, after the databases changed.
+func (c *cache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
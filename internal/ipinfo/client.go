@@ -0,0 +1,163 @@
+package ipinfo
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// clientIPLock guards the client address settings below, which Reload
+// replaces on a running server.
+var clientIPLock sync.RWMutex
+
+// clientIPHeaders are consulted in order when resolving "self" lookups
+var clientIPHeaders []string
+
+// trustedProxies are skipped when walking a forwarding chain
+var trustedProxies []*net.IPNet
+
+// maxForwardedHops is MaxForwardedHops as last applied
+var maxForwardedHops int
+
+// initializeClientIP parses the ClientIPHeaders and TrustedProxies options.
+func initializeClientIP() {
+	var headers []string
+	for _, header := range strings.Split(*ClientIPHeaders, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, http.CanonicalHeaderKey(header))
+		}
+	}
+
+	proxies, err := parseTrustedProxies(*TrustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Str("proxies", *TrustedProxies).Msg("Unable to parse trusted proxy, cannot continue")
+	}
+
+	clientIPLock.Lock()
+	clientIPHeaders, trustedProxies, maxForwardedHops = headers, proxies, *MaxForwardedHops
+	clientIPLock.Unlock()
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// clientIP resolves the address of the client behind the request. The
+// configured headers are only honored when the peer is a trusted proxy, or
+// when no trusted proxies are configured at all.
+func clientIP(r *http.Request) string {
+	clientIPLock.RLock()
+	defer clientIPLock.RUnlock()
+	return forwardedClient(r)
+}
+
+// forwardedClient is clientIP, for callers holding clientIPLock.
+func forwardedClient(r *http.Request) string {
+	remote := defangIP(r.RemoteAddr)
+	if len(trustedProxies) > 0 && !isTrustedProxy(net.ParseIP(remote)) {
+		return remote
+	}
+
+	for _, header := range clientIPHeaders {
+		if ip := forwardedFor(r.Header.Values(header)); ip != nil {
+			return ip.String()
+		}
+	}
+
+	return remote
+}
+
+// limiterKey is the address a request is rate limited by. Unlike clientIP
+// the forwarding headers only count when the peer is a trusted proxy, as
+// anyone else could send a different address with every request.
+func limiterKey(r *http.Request) string {
+	clientIPLock.RLock()
+	defer clientIPLock.RUnlock()
+
+	remote := defangIP(r.RemoteAddr)
+	if !isTrustedProxy(net.ParseIP(remote)) {
+		return remote
+	}
+	return forwardedClient(r)
+}
+
+// clientHeaders returns the headers clientIP consults.
+func clientHeaders() []string {
+	clientIPLock.RLock()
+	defer clientIPLock.RUnlock()
+	return clientIPHeaders
+}
+
+// forwardedFor walks a comma-separated forwarding chain from the nearest hop
+// outward, skipping trusted proxies, and returns the first address that is
+// not one. Repeated headers are treated as a single chain. At most
+// MaxForwardedHops entries are parsed, so an oversized header costs no more
+// than a short one. The caller holds clientIPLock.
+func forwardedFor(values []string) net.IP {
+	var ip net.IP
+	hops := 0
+	for v := len(values) - 1; v >= 0; v-- {
+		chain := values[v]
+		for more := true; more; {
+			if maxForwardedHops > 0 && hops == maxForwardedHops {
+				// Nothing beyond the cap can be trusted either.
+				return ip
+			}
+			hops++
+
+			var entry string
+			if i := strings.LastIndexByte(chain, ','); i >= 0 {
+				entry, chain = chain[i+1:], chain[:i]
+			} else {
+				entry, more = chain, false
+			}
+
+			hop := parseHop(entry)
+			if hop == nil {
+				// Nothing beyond a garbage entry can be trusted.
+				return ip
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				return ip
+			}
+		}
+	}
+	return ip
+}
+
+// parseHop parses a single forwarding entry, which may carry a port.
+func parseHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package ipinfo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cloud is the provider, and where known the region and service, of a
+// published cloud range.
+type cloud struct {
+	Provider string `json:"provider"`
+	Region   string `json:"region,omitempty"`
+	Service  string `json:"service,omitempty"`
+}
+
+// cloudFeed is a provider's published list of ranges and how to read it.
+type cloudFeed struct {
+	provider string
+	url      string
+	parse    func(r io.Reader, add func(cidr string, c cloud)) error
+}
+
+// cloudFeeds are the providers consulted with CloudRanges. Azure moves its
+// list to a new URL every week, it is only read with CloudAzureURL.
+var cloudFeeds = []cloudFeed{
+	{"aws", "https://ip-ranges.amazonaws.com/ip-ranges.json", parseAWSRanges},
+	{"gcp", "https://www.gstatic.com/ipranges/cloud.json", parseGCPRanges},
+	{"oracle", "https://docs.oracle.com/en-us/iaas/tools/public_ip_ranges.json", parseOracleRanges},
+	{"cloudflare", "https://www.cloudflare.com/ips-v4", parseCloudflareRanges},
+	{"cloudflare", "https://www.cloudflare.com/ips-v6", parseCloudflareRanges},
+}
+
+// cloudRanges maps the networks of every feed, keyed by their CIDR, to their
+// cloud. lengths4 and lengths6 are the prefix lengths present, longest
+// first. All are nil until the feeds are first downloaded.
+var cloudRanges struct {
+	sync.RWMutex
+	networks           map[string]*cloud
+	lengths4, lengths6 []int
+}
+
+var cloudClient = &http.Client{Timeout: time.Minute}
+
+// cloudRefresh downloads the cloud feeds every CloudInterval
+var cloudRefresh refresher
+
+// initializeCloudRanges periodically downloads the cloud feeds with
+// CloudRanges set. A feed that fails to download keeps its ranges from
+// before.
+func initializeCloudRanges() {
+	setCloudRanges(nil)
+	if !*CloudRanges {
+		cloudRefresh.stop()
+		return
+	}
+
+	feeds := cloudFeeds
+	if *CloudAzureURL != "" {
+		feeds = append(feeds[:len(feeds):len(feeds)], cloudFeed{"azure", *CloudAzureURL, parseAzureRanges})
+	}
+
+	previous := make(map[string]map[string]*cloud)
+	cloudRefresh.start(*CloudInterval, true, func() {
+		merged := make(map[string]*cloud)
+		for _, feed := range feeds {
+			networks, err := fetchCloudFeed(feed)
+			if err != nil {
+				log.Warn().Err(err).Str("url", feed.url).Msg("Unable to download cloud ranges")
+				networks = previous[feed.url]
+			} else {
+				previous[feed.url] = networks
+			}
+			for cidr, c := range networks {
+				merged[cidr] = c
+			}
+		}
+		setCloudRanges(merged)
+		log.Info().Int("networks", len(merged)).Msg("Downloaded cloud ranges")
+	})
+}
+
+// fetchCloudFeed downloads and parses a feed into its networks, keyed by
+// their CIDR.
+func fetchCloudFeed(feed cloudFeed) (map[string]*cloud, error) {
+	resp, err := cloudClient.Get(feed.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	networks := make(map[string]*cloud)
+	err = feed.parse(resp.Body, func(cidr string, c cloud) {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return
+		}
+		c.Provider = feed.provider
+		networks[network.String()] = &c
+	})
+	if err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+func setCloudRanges(networks map[string]*cloud) {
+	var lengths4, lengths6 []int
+	seen := make(map[[2]int]bool)
+	for cidr := range networks {
+		_, network, _ := net.ParseCIDR(cidr)
+		ones, bits := network.Mask.Size()
+		if key := [2]int{ones, bits}; !seen[key] {
+			seen[key] = true
+			if bits == 32 {
+				lengths4 = append(lengths4, ones)
+			} else {
+				lengths6 = append(lengths6, ones)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths4)))
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths6)))
+
+	cloudRanges.Lock()
+	defer cloudRanges.Unlock()
+	cloudRanges.networks = networks
+	cloudRanges.lengths4, cloudRanges.lengths6 = lengths4, lengths6
+}
+
+// lookupCloud returns the cloud of the most specific published range holding
+// ip, nil when it is in none.
+func lookupCloud(ip net.IP) *cloud {
+	cloudRanges.RLock()
+	defer cloudRanges.RUnlock()
+
+	lengths, bits := cloudRanges.lengths6, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, lengths, bits = ip4, cloudRanges.lengths4, 32
+	}
+	for _, ones := range lengths {
+		mask := net.CIDRMask(ones, bits)
+		network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if c, ok := cloudRanges.networks[network.String()]; ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// parseAWSRanges reads ip-ranges.json. Every range is listed under AMAZON
+// and again under the service using it, the service is kept.
+func parseAWSRanges(r io.Reader, add func(cidr string, c cloud)) error {
+	var feed struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return err
+	}
+	// AMAZON entries go first so those of a service replace them.
+	for _, amazon := range []bool{true, false} {
+		for _, p := range feed.Prefixes {
+			if (p.Service == "AMAZON") == amazon {
+				add(p.IPPrefix, cloud{Region: p.Region, Service: p.Service})
+			}
+		}
+		for _, p := range feed.IPv6Prefixes {
+			if (p.Service == "AMAZON") == amazon {
+				add(p.IPv6Prefix, cloud{Region: p.Region, Service: p.Service})
+			}
+		}
+	}
+	return nil
+}
+
+// parseGCPRanges reads Google Cloud's cloud.json.
+func parseGCPRanges(r io.Reader, add func(cidr string, c cloud)) error {
+	var feed struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return err
+	}
+	for _, p := range feed.Prefixes {
+		cidr := p.IPv4Prefix
+		if cidr == "" {
+			cidr = p.IPv6Prefix
+		}
+		add(cidr, cloud{Region: p.Scope, Service: p.Service})
+	}
+	return nil
+}
+
+// parseOracleRanges reads Oracle Cloud's public_ip_ranges.json.
+func parseOracleRanges(r io.Reader, add func(cidr string, c cloud)) error {
+	var feed struct {
+		Regions []struct {
+			Region string `json:"region"`
+			CIDRs  []struct {
+				CIDR string   `json:"cidr"`
+				Tags []string `json:"tags"`
+			} `json:"cidrs"`
+		} `json:"regions"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return err
+	}
+	for _, region := range feed.Regions {
+		for _, c := range region.CIDRs {
+			add(c.CIDR, cloud{Region: region.Region, Service: strings.Join(c.Tags, ",")})
+		}
+	}
+	return nil
+}
+
+// parseAzureRanges reads an Azure ServiceTags_Public JSON file. Every range
+// is listed under the overall AzureCloud tags as well as the services, the
+// service is kept.
+func parseAzureRanges(r io.Reader, add func(cidr string, c cloud)) error {
+	var feed struct {
+		Values []struct {
+			Properties struct {
+				Region          string   `json:"region"`
+				SystemService   string   `json:"systemService"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&feed); err != nil {
+		return err
+	}
+	// Tags without a service go first so those of a service replace them.
+	for _, service := range []bool{false, true} {
+		for _, v := range feed.Values {
+			if (v.Properties.SystemService != "") != service {
+				continue
+			}
+			for _, cidr := range v.Properties.AddressPrefixes {
+				add(cidr, cloud{Region: v.Properties.Region, Service: v.Properties.SystemService})
+			}
+		}
+	}
+	return nil
+}
+
+// parseCloudflareRanges reads Cloudflare's lists, one CIDR per line.
+func parseCloudflareRanges(r io.Reader, add func(cidr string, c cloud)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			add(line, cloud{})
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,96 @@
+package ipinfo
+
+import "strings"
+
+// ipAPIInfo is a lookup in the schema of ip-api.com, for tooling written
+// against it.
+type ipAPIInfo struct {
+	Status      string  `json:"status"`
+	Message     string  `json:"message,omitempty"`
+	Country     string  `json:"country,omitempty"`
+	CountryCode string  `json:"countryCode,omitempty"`
+	Region      string  `json:"region,omitempty"`
+	RegionName  string  `json:"regionName,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Zip         string  `json:"zip,omitempty"`
+	Lat         float64 `json:"lat,omitempty"`
+	Lon         float64 `json:"lon,omitempty"`
+	Timezone    string  `json:"timezone,omitempty"`
+	ISP         string  `json:"isp,omitempty"`
+	Org         string  `json:"org,omitempty"`
+	AS          string  `json:"as,omitempty"`
+	Query       string  `json:"query"`
+}
+
+// ipAPIPath strips the /json prefix ip-api.com serves its lookups under, as
+// in /json/8.8.8.8 or /json/ for the client itself. /json alone stays the
+// native self lookup.
+func ipAPIPath(path string) (string, bool) {
+	if !strings.HasPrefix(path, "/json/") {
+		return path, false
+	}
+	return strings.TrimPrefix(path, "/json"), true
+}
+
+// toIPAPI converts a lookup to the ip-api.com schema.
+func toIPAPI(info ipInfo) ipAPIInfo {
+	out := ipAPIInfo{
+		Status:      "success",
+		Country:     info.Country.Name,
+		CountryCode: info.Country.Code,
+		Region:      info.regionCode,
+		RegionName:  info.Region,
+		City:        info.City,
+		Lat:         info.Location.Latitude,
+		Lon:         info.Location.Longitude,
+		Timezone:    info.TimeZone,
+		ISP:         info.Organization,
+		Org:         info.Organization,
+		AS:          textFields["org"](info),
+		Query:       info.IP,
+	}
+	if info.Postal != nil {
+		out.Zip = *info.Postal
+	}
+	if info.ISP != "" {
+		out.ISP = info.ISP
+	}
+	return out
+}
+
+// ipAPIFailure is the ip-api.com answer for a query that can not be looked
+// up, which it sends with a 200 status.
+func ipAPIFailure(query, message string) ipAPIInfo {
+	return ipAPIInfo{Status: "fail", Message: message, Query: query}
+}
+
+// ipinfoIOInfo is a lookup in the schema of ipinfo.io, for clients written
+// against its API.
+type ipinfoIOInfo struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname,omitempty"`
+	Bogon    bool   `json:"bogon,omitempty"`
+	City     string `json:"city,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Loc      string `json:"loc,omitempty"`
+	Org      string `json:"org,omitempty"`
+	Postal   string `json:"postal,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// toIPInfoIO converts a lookup to the ipinfo.io schema.
+func toIPInfoIO(info ipInfo) ipinfoIOInfo {
+	return ipinfoIOInfo{
+		IP:       info.IP,
+		Hostname: info.Hostname,
+		Bogon:    info.Bogon,
+		City:     info.City,
+		Region:   info.Region,
+		Country:  info.Country.Code,
+		Loc:      textFields["loc"](info),
+		Org:      textFields["org"](info),
+		Postal:   textFields["postal"](info),
+		Timezone: info.TimeZone,
+	}
+}
@@ -0,0 +1,201 @@
+package ipinfo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is everything InitializeWithConfig needs to set the service up.
+// Options it does not cover, like rate limiting or the webhook, are still
+// taken from their flags, and the ones it does cover are written back into
+// them, so there is only ever one Config in effect per process.
+type Config struct {
+	// CityDB is the path of the City database, which is required. A Country
+	// database will do for lookups without city, postal code or location.
+	CityDB string
+	// Layers are databases consulted before the City database, in order.
+	// Each field is taken from the first of them that has it.
+	Layers []string
+	// ASNDB, EnterpriseDB, AnonymousDB, ISPDB, DomainDB, ConnectionTypeDB
+	// and GeoNames are optional, and an empty path skips them. The GeoNames
+	// dump provides populations and, with GeoNamesNames, the names the
+	// databases lack.
+	ASNDB            string
+	EnterpriseDB     string
+	AnonymousDB      string
+	ISPDB            string
+	DomainDB         string
+	ConnectionTypeDB string
+	GeoNames         string
+	// IPToASN is an iptoasn.com dump that provides the ASN and organization
+	// when the ASN database is missing.
+	IPToASN string
+	// PoPs is an optional list of the operator's points of presence.
+	PoPs string
+	// Geofences is an optional list of named geofences.
+	Geofences string
+	// DatacenterASNs is an optional list of hosting ASNs that replaces the
+	// built-in one.
+	DatacenterASNs string
+	// Overrides is an optional list of networks that are answered from it
+	// rather than from the databases.
+	Overrides string
+	// LoadMode opens the databases memory mapped ("mmap", the default) or
+	// reads them in whole ("memory").
+	LoadMode string
+	// Locale is the language of the names in responses, "en" by default.
+	Locale string
+	// DNSTimeout bounds each reverse and forward DNS lookup, and is one
+	// second by default.
+	DNSTimeout time.Duration
+	// DNSServer is the DNS server ("host" or "host:port") to resolve with.
+	// The system resolver is used when it is empty.
+	DNSServer string
+	// CacheSize is the number of lookups kept in memory, and 0 disables the
+	// cache. IPv6 lookups are cached per CacheIPv6Prefix bits, where 0 or 128
+	// caches each address on its own.
+	CacheSize       int
+	CacheIPv6Prefix int
+	// HostnameCacheSize is the number of reverse lookups kept in memory for
+	// HostnameCacheTTL, which is an hour by default. A size of 0 disables
+	// the cache.
+	HostnameCacheSize int
+	HostnameCacheTTL  time.Duration
+	// MaxMindAccountID and MaxMindLicenseKey download the City and ASN
+	// databases from MaxMind and refresh them every UpdateInterval, which is
+	// daily by default. Leaving them empty keeps the files as they are.
+	MaxMindAccountID  string
+	MaxMindLicenseKey string
+	UpdateInterval    time.Duration
+	// WatchInterval is how often the City and ASN databases are checked for
+	// replacements to reload, and 0 disables the check.
+	WatchInterval time.Duration
+
+	// The feature flags below behave like the flags of the same name.
+	GeoNamesNames    bool
+	EmptyNames       string
+	DisablePostal    bool
+	MarkAnycast      bool
+	InvalidContinent string
+	LogOrganization  bool
+	DevIP            string
+	ReverseDNS       bool
+}
+
+// config is the configuration the service was initialized with
+var config Config
+
+// ConfigFromFlags builds a Config from the flags, with the databases in
+// workDir (which should have a trailing slash). Optional files that are not
+// there are left out.
+func ConfigFromFlags(workDir string) Config {
+	cfg := Config{
+		CityDB:            databasePath(workDir, *CityDB),
+		ASNDB:             databasePath(workDir, *ASNDB),
+		LoadMode:          *DBLoadMode,
+		Locale:            *Locale,
+		DNSTimeout:        *DNSTimeout,
+		DNSServer:         *DNSServer,
+		PoPs:              *PoPs,
+		Overrides:         *Overrides,
+		IPToASN:           databasePath(workDir, *IPToASN),
+		DatacenterASNs:    *DatacenterASNs,
+		Geofences:         *Geofences,
+		CacheSize:         *CacheSize,
+		MaxMindAccountID:  *MaxMindAccountID,
+		MaxMindLicenseKey: *MaxMindLicenseKey,
+		UpdateInterval:    *UpdateInterval,
+		WatchInterval:     *WatchInterval,
+		CacheIPv6Prefix:   *CacheIPv6Prefix,
+		HostnameCacheSize: *HostnameCacheSize,
+		HostnameCacheTTL:  *HostnameCacheTTL,
+		GeoNamesNames:     *GeoNamesNames,
+		EmptyNames:        *EmptyNames,
+		DisablePostal:     *DisablePostal,
+		MarkAnycast:       *MarkAnycast,
+		InvalidContinent:  *InvalidContinent,
+		LogOrganization:   *LogOrganization,
+		DevIP:             *DevIP,
+		ReverseDNS:        *ReverseDNS,
+	}
+	// Lightweight deployments may only have the Country database.
+	if _, err := os.Stat(cfg.CityDB); os.IsNotExist(err) && *CityDB == "GeoLite2-City.mmdb" {
+		if _, err := os.Stat(workDir + "GeoLite2-Country.mmdb"); err == nil {
+			cfg.CityDB = workDir + "GeoLite2-Country.mmdb"
+		}
+	}
+	if _, err := os.Stat(workDir + "GeoIP2-Enterprise.mmdb"); err == nil {
+		cfg.EnterpriseDB = workDir + "GeoIP2-Enterprise.mmdb"
+	}
+	if _, err := os.Stat(workDir + "GeoIP2-Anonymous-IP.mmdb"); err == nil {
+		cfg.AnonymousDB = workDir + "GeoIP2-Anonymous-IP.mmdb"
+	}
+	if _, err := os.Stat(workDir + "GeoIP2-ISP.mmdb"); err == nil {
+		cfg.ISPDB = workDir + "GeoIP2-ISP.mmdb"
+	}
+	if _, err := os.Stat(workDir + "GeoIP2-Domain.mmdb"); err == nil {
+		cfg.DomainDB = workDir + "GeoIP2-Domain.mmdb"
+	}
+	if _, err := os.Stat(workDir + "GeoIP2-Connection-Type.mmdb"); err == nil {
+		cfg.ConnectionTypeDB = workDir + "GeoIP2-Connection-Type.mmdb"
+	}
+	for _, path := range strings.Split(*Layers, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			cfg.Layers = append(cfg.Layers, path)
+		}
+	}
+	if *Populations != "" {
+		if _, err := os.Stat(workDir + *Populations); err == nil {
+			cfg.GeoNames = workDir + *Populations
+		}
+	}
+	return cfg
+}
+
+// databasePath resolves the path of a database flag, relative to workDir
+// unless it is absolute.
+func databasePath(workDir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return workDir + path
+}
+
+// apply makes cfg the current configuration. The request handlers read the
+// options through the flag variables, so those are overwritten to match,
+// for the whole process and without any locking.
+func (cfg Config) apply() {
+	if cfg.LoadMode == "" {
+		cfg.LoadMode = loadModeMmap
+	}
+	if cfg.Locale == "" {
+		cfg.Locale = "en"
+	}
+	if cfg.DNSTimeout == 0 {
+		cfg.DNSTimeout = time.Second
+	}
+	if cfg.UpdateInterval <= 0 {
+		cfg.UpdateInterval = 24 * time.Hour
+	}
+	if cfg.CacheIPv6Prefix == 0 {
+		cfg.CacheIPv6Prefix = 128
+	}
+	if cfg.HostnameCacheTTL <= 0 {
+		cfg.HostnameCacheTTL = time.Hour
+	}
+
+	*DBLoadMode = cfg.LoadMode
+	*Locale = cfg.Locale
+	*DNSTimeout = cfg.DNSTimeout
+	*GeoNamesNames = cfg.GeoNamesNames
+	*EmptyNames = cfg.EmptyNames
+	*DisablePostal = cfg.DisablePostal
+	*MarkAnycast = cfg.MarkAnycast
+	*InvalidContinent = cfg.InvalidContinent
+	*LogOrganization = cfg.LogOrganization
+	*DevIP = cfg.DevIP
+	*ReverseDNS = cfg.ReverseDNS
+	config = cfg
+}
@@ -0,0 +1,510 @@
+package ipinfo
+
+// countryFacts holds the ISO 4217 currency and the international calling
+// code of every ISO 3166-1 country, plus Kosovo (XK) as MaxMind reports it.
+var countryFacts = map[string]countryFact{
+	"AD": {"EUR", "+376"},
+	"AE": {"AED", "+971"},
+	"AF": {"AFN", "+93"},
+	"AG": {"XCD", "+1"},
+	"AI": {"XCD", "+1"},
+	"AL": {"ALL", "+355"},
+	"AM": {"AMD", "+374"},
+	"AO": {"AOA", "+244"},
+	"AQ": {"", "+672"},
+	"AR": {"ARS", "+54"},
+	"AS": {"USD", "+1"},
+	"AT": {"EUR", "+43"},
+	"AU": {"AUD", "+61"},
+	"AW": {"AWG", "+297"},
+	"AX": {"EUR", "+358"},
+	"AZ": {"AZN", "+994"},
+	"BA": {"BAM", "+387"},
+	"BB": {"BBD", "+1"},
+	"BD": {"BDT", "+880"},
+	"BE": {"EUR", "+32"},
+	"BF": {"XOF", "+226"},
+	"BG": {"BGN", "+359"},
+	"BH": {"BHD", "+973"},
+	"BI": {"BIF", "+257"},
+	"BJ": {"XOF", "+229"},
+	"BL": {"EUR", "+590"},
+	"BM": {"BMD", "+1"},
+	"BN": {"BND", "+673"},
+	"BO": {"BOB", "+591"},
+	"BQ": {"USD", "+599"},
+	"BR": {"BRL", "+55"},
+	"BS": {"BSD", "+1"},
+	"BT": {"BTN", "+975"},
+	"BV": {"NOK", ""},
+	"BW": {"BWP", "+267"},
+	"BY": {"BYN", "+375"},
+	"BZ": {"BZD", "+501"},
+	"CA": {"CAD", "+1"},
+	"CC": {"AUD", "+61"},
+	"CD": {"CDF", "+243"},
+	"CF": {"XAF", "+236"},
+	"CG": {"XAF", "+242"},
+	"CH": {"CHF", "+41"},
+	"CI": {"XOF", "+225"},
+	"CK": {"NZD", "+682"},
+	"CL": {"CLP", "+56"},
+	"CM": {"XAF", "+237"},
+	"CN": {"CNY", "+86"},
+	"CO": {"COP", "+57"},
+	"CR": {"CRC", "+506"},
+	"CU": {"CUP", "+53"},
+	"CV": {"CVE", "+238"},
+	"CW": {"ANG", "+599"},
+	"CX": {"AUD", "+61"},
+	"CY": {"EUR", "+357"},
+	"CZ": {"CZK", "+420"},
+	"DE": {"EUR", "+49"},
+	"DJ": {"DJF", "+253"},
+	"DK": {"DKK", "+45"},
+	"DM": {"XCD", "+1"},
+	"DO": {"DOP", "+1"},
+	"DZ": {"DZD", "+213"},
+	"EC": {"USD", "+593"},
+	"EE": {"EUR", "+372"},
+	"EG": {"EGP", "+20"},
+	"EH": {"MAD", "+212"},
+	"ER": {"ERN", "+291"},
+	"ES": {"EUR", "+34"},
+	"ET": {"ETB", "+251"},
+	"FI": {"EUR", "+358"},
+	"FJ": {"FJD", "+679"},
+	"FK": {"FKP", "+500"},
+	"FM": {"USD", "+691"},
+	"FO": {"DKK", "+298"},
+	"FR": {"EUR", "+33"},
+	"GA": {"XAF", "+241"},
+	"GB": {"GBP", "+44"},
+	"GD": {"XCD", "+1"},
+	"GE": {"GEL", "+995"},
+	"GF": {"EUR", "+594"},
+	"GG": {"GBP", "+44"},
+	"GH": {"GHS", "+233"},
+	"GI": {"GIP", "+350"},
+	"GL": {"DKK", "+299"},
+	"GM": {"GMD", "+220"},
+	"GN": {"GNF", "+224"},
+	"GP": {"EUR", "+590"},
+	"GQ": {"XAF", "+240"},
+	"GR": {"EUR", "+30"},
+	"GS": {"GBP", "+500"},
+	"GT": {"GTQ", "+502"},
+	"GU": {"USD", "+1"},
+	"GW": {"XOF", "+245"},
+	"GY": {"GYD", "+592"},
+	"HK": {"HKD", "+852"},
+	"HM": {"AUD", ""},
+	"HN": {"HNL", "+504"},
+	"HR": {"EUR", "+385"},
+	"HT": {"HTG", "+509"},
+	"HU": {"HUF", "+36"},
+	"ID": {"IDR", "+62"},
+	"IE": {"EUR", "+353"},
+	"IL": {"ILS", "+972"},
+	"IM": {"GBP", "+44"},
+	"IN": {"INR", "+91"},
+	"IO": {"USD", "+246"},
+	"IQ": {"IQD", "+964"},
+	"IR": {"IRR", "+98"},
+	"IS": {"ISK", "+354"},
+	"IT": {"EUR", "+39"},
+	"JE": {"GBP", "+44"},
+	"JM": {"JMD", "+1"},
+	"JO": {"JOD", "+962"},
+	"JP": {"JPY", "+81"},
+	"KE": {"KES", "+254"},
+	"KG": {"KGS", "+996"},
+	"KH": {"KHR", "+855"},
+	"KI": {"AUD", "+686"},
+	"KM": {"KMF", "+269"},
+	"KN": {"XCD", "+1"},
+	"KP": {"KPW", "+850"},
+	"KR": {"KRW", "+82"},
+	"KW": {"KWD", "+965"},
+	"KY": {"KYD", "+1"},
+	"KZ": {"KZT", "+7"},
+	"LA": {"LAK", "+856"},
+	"LB": {"LBP", "+961"},
+	"LC": {"XCD", "+1"},
+	"LI": {"CHF", "+423"},
+	"LK": {"LKR", "+94"},
+	"LR": {"LRD", "+231"},
+	"LS": {"LSL", "+266"},
+	"LT": {"EUR", "+370"},
+	"LU": {"EUR", "+352"},
+	"LV": {"EUR", "+371"},
+	"LY": {"LYD", "+218"},
+	"MA": {"MAD", "+212"},
+	"MC": {"EUR", "+377"},
+	"MD": {"MDL", "+373"},
+	"ME": {"EUR", "+382"},
+	"MF": {"EUR", "+590"},
+	"MG": {"MGA", "+261"},
+	"MH": {"USD", "+692"},
+	"MK": {"MKD", "+389"},
+	"ML": {"XOF", "+223"},
+	"MM": {"MMK", "+95"},
+	"MN": {"MNT", "+976"},
+	"MO": {"MOP", "+853"},
+	"MP": {"USD", "+1"},
+	"MQ": {"EUR", "+596"},
+	"MR": {"MRU", "+222"},
+	"MS": {"XCD", "+1"},
+	"MT": {"EUR", "+356"},
+	"MU": {"MUR", "+230"},
+	"MV": {"MVR", "+960"},
+	"MW": {"MWK", "+265"},
+	"MX": {"MXN", "+52"},
+	"MY": {"MYR", "+60"},
+	"MZ": {"MZN", "+258"},
+	"NA": {"NAD", "+264"},
+	"NC": {"XPF", "+687"},
+	"NE": {"XOF", "+227"},
+	"NF": {"AUD", "+672"},
+	"NG": {"NGN", "+234"},
+	"NI": {"NIO", "+505"},
+	"NL": {"EUR", "+31"},
+	"NO": {"NOK", "+47"},
+	"NP": {"NPR", "+977"},
+	"NR": {"AUD", "+674"},
+	"NU": {"NZD", "+683"},
+	"NZ": {"NZD", "+64"},
+	"OM": {"OMR", "+968"},
+	"PA": {"PAB", "+507"},
+	"PE": {"PEN", "+51"},
+	"PF": {"XPF", "+689"},
+	"PG": {"PGK", "+675"},
+	"PH": {"PHP", "+63"},
+	"PK": {"PKR", "+92"},
+	"PL": {"PLN", "+48"},
+	"PM": {"EUR", "+508"},
+	"PN": {"NZD", "+64"},
+	"PR": {"USD", "+1"},
+	"PS": {"ILS", "+970"},
+	"PT": {"EUR", "+351"},
+	"PW": {"USD", "+680"},
+	"PY": {"PYG", "+595"},
+	"QA": {"QAR", "+974"},
+	"RE": {"EUR", "+262"},
+	"RO": {"RON", "+40"},
+	"RS": {"RSD", "+381"},
+	"RU": {"RUB", "+7"},
+	"RW": {"RWF", "+250"},
+	"SA": {"SAR", "+966"},
+	"SB": {"SBD", "+677"},
+	"SC": {"SCR", "+248"},
+	"SD": {"SDG", "+249"},
+	"SE": {"SEK", "+46"},
+	"SG": {"SGD", "+65"},
+	"SH": {"SHP", "+290"},
+	"SI": {"EUR", "+386"},
+	"SJ": {"NOK", "+47"},
+	"SK": {"EUR", "+421"},
+	"SL": {"SLE", "+232"},
+	"SM": {"EUR", "+378"},
+	"SN": {"XOF", "+221"},
+	"SO": {"SOS", "+252"},
+	"SR": {"SRD", "+597"},
+	"SS": {"SSP", "+211"},
+	"ST": {"STN", "+239"},
+	"SV": {"USD", "+503"},
+	"SX": {"ANG", "+1"},
+	"SY": {"SYP", "+963"},
+	"SZ": {"SZL", "+268"},
+	"TC": {"USD", "+1"},
+	"TD": {"XAF", "+235"},
+	"TF": {"EUR", "+262"},
+	"TG": {"XOF", "+228"},
+	"TH": {"THB", "+66"},
+	"TJ": {"TJS", "+992"},
+	"TK": {"NZD", "+690"},
+	"TL": {"USD", "+670"},
+	"TM": {"TMT", "+993"},
+	"TN": {"TND", "+216"},
+	"TO": {"TOP", "+676"},
+	"TR": {"TRY", "+90"},
+	"TT": {"TTD", "+1"},
+	"TV": {"AUD", "+688"},
+	"TW": {"TWD", "+886"},
+	"TZ": {"TZS", "+255"},
+	"UA": {"UAH", "+380"},
+	"UG": {"UGX", "+256"},
+	"UM": {"USD", "+1"},
+	"US": {"USD", "+1"},
+	"UY": {"UYU", "+598"},
+	"UZ": {"UZS", "+998"},
+	"VA": {"EUR", "+39"},
+	"VC": {"XCD", "+1"},
+	"VE": {"VES", "+58"},
+	"VG": {"USD", "+1"},
+	"VI": {"USD", "+1"},
+	"VN": {"VND", "+84"},
+	"VU": {"VUV", "+678"},
+	"WF": {"XPF", "+681"},
+	"WS": {"WST", "+685"},
+	"XK": {"EUR", "+383"},
+	"YE": {"YER", "+967"},
+	"YT": {"EUR", "+262"},
+	"ZA": {"ZAR", "+27"},
+	"ZM": {"ZMW", "+260"},
+	"ZW": {"ZWL", "+263"},
+}
+
+// countryNumbers holds the ISO 3166-1 numeric code of every country. Kosovo
+// has none.
+var countryNumbers = map[string]uint16{
+	"AD": 20,
+	"AE": 784,
+	"AF": 4,
+	"AG": 28,
+	"AI": 660,
+	"AL": 8,
+	"AM": 51,
+	"AO": 24,
+	"AQ": 10,
+	"AR": 32,
+	"AS": 16,
+	"AT": 40,
+	"AU": 36,
+	"AW": 533,
+	"AX": 248,
+	"AZ": 31,
+	"BA": 70,
+	"BB": 52,
+	"BD": 50,
+	"BE": 56,
+	"BF": 854,
+	"BG": 100,
+	"BH": 48,
+	"BI": 108,
+	"BJ": 204,
+	"BL": 652,
+	"BM": 60,
+	"BN": 96,
+	"BO": 68,
+	"BQ": 535,
+	"BR": 76,
+	"BS": 44,
+	"BT": 64,
+	"BV": 74,
+	"BW": 72,
+	"BY": 112,
+	"BZ": 84,
+	"CA": 124,
+	"CC": 166,
+	"CD": 180,
+	"CF": 140,
+	"CG": 178,
+	"CH": 756,
+	"CI": 384,
+	"CK": 184,
+	"CL": 152,
+	"CM": 120,
+	"CN": 156,
+	"CO": 170,
+	"CR": 188,
+	"CU": 192,
+	"CV": 132,
+	"CW": 531,
+	"CX": 162,
+	"CY": 196,
+	"CZ": 203,
+	"DE": 276,
+	"DJ": 262,
+	"DK": 208,
+	"DM": 212,
+	"DO": 214,
+	"DZ": 12,
+	"EC": 218,
+	"EE": 233,
+	"EG": 818,
+	"EH": 732,
+	"ER": 232,
+	"ES": 724,
+	"ET": 231,
+	"FI": 246,
+	"FJ": 242,
+	"FK": 238,
+	"FM": 583,
+	"FO": 234,
+	"FR": 250,
+	"GA": 266,
+	"GB": 826,
+	"GD": 308,
+	"GE": 268,
+	"GF": 254,
+	"GG": 831,
+	"GH": 288,
+	"GI": 292,
+	"GL": 304,
+	"GM": 270,
+	"GN": 324,
+	"GP": 312,
+	"GQ": 226,
+	"GR": 300,
+	"GS": 239,
+	"GT": 320,
+	"GU": 316,
+	"GW": 624,
+	"GY": 328,
+	"HK": 344,
+	"HM": 334,
+	"HN": 340,
+	"HR": 191,
+	"HT": 332,
+	"HU": 348,
+	"ID": 360,
+	"IE": 372,
+	"IL": 376,
+	"IM": 833,
+	"IN": 356,
+	"IO": 86,
+	"IQ": 368,
+	"IR": 364,
+	"IS": 352,
+	"IT": 380,
+	"JE": 832,
+	"JM": 388,
+	"JO": 400,
+	"JP": 392,
+	"KE": 404,
+	"KG": 417,
+	"KH": 116,
+	"KI": 296,
+	"KM": 174,
+	"KN": 659,
+	"KP": 408,
+	"KR": 410,
+	"KW": 414,
+	"KY": 136,
+	"KZ": 398,
+	"LA": 418,
+	"LB": 422,
+	"LC": 662,
+	"LI": 438,
+	"LK": 144,
+	"LR": 430,
+	"LS": 426,
+	"LT": 440,
+	"LU": 442,
+	"LV": 428,
+	"LY": 434,
+	"MA": 504,
+	"MC": 492,
+	"MD": 498,
+	"ME": 499,
+	"MF": 663,
+	"MG": 450,
+	"MH": 584,
+	"MK": 807,
+	"ML": 466,
+	"MM": 104,
+	"MN": 496,
+	"MO": 446,
+	"MP": 580,
+	"MQ": 474,
+	"MR": 478,
+	"MS": 500,
+	"MT": 470,
+	"MU": 480,
+	"MV": 462,
+	"MW": 454,
+	"MX": 484,
+	"MY": 458,
+	"MZ": 508,
+	"NA": 516,
+	"NC": 540,
+	"NE": 562,
+	"NF": 574,
+	"NG": 566,
+	"NI": 558,
+	"NL": 528,
+	"NO": 578,
+	"NP": 524,
+	"NR": 520,
+	"NU": 570,
+	"NZ": 554,
+	"OM": 512,
+	"PA": 591,
+	"PE": 604,
+	"PF": 258,
+	"PG": 598,
+	"PH": 608,
+	"PK": 586,
+	"PL": 616,
+	"PM": 666,
+	"PN": 612,
+	"PR": 630,
+	"PS": 275,
+	"PT": 620,
+	"PW": 585,
+	"PY": 600,
+	"QA": 634,
+	"RE": 638,
+	"RO": 642,
+	"RS": 688,
+	"RU": 643,
+	"RW": 646,
+	"SA": 682,
+	"SB": 90,
+	"SC": 690,
+	"SD": 729,
+	"SE": 752,
+	"SG": 702,
+	"SH": 654,
+	"SI": 705,
+	"SJ": 744,
+	"SK": 703,
+	"SL": 694,
+	"SM": 674,
+	"SN": 686,
+	"SO": 706,
+	"SR": 740,
+	"SS": 728,
+	"ST": 678,
+	"SV": 222,
+	"SX": 534,
+	"SY": 760,
+	"SZ": 748,
+	"TC": 796,
+	"TD": 148,
+	"TF": 260,
+	"TG": 768,
+	"TH": 764,
+	"TJ": 762,
+	"TK": 772,
+	"TL": 626,
+	"TM": 795,
+	"TN": 788,
+	"TO": 776,
+	"TR": 792,
+	"TT": 780,
+	"TV": 798,
+	"TW": 158,
+	"TZ": 834,
+	"UA": 804,
+	"UG": 800,
+	"UM": 581,
+	"US": 840,
+	"UY": 858,
+	"UZ": 860,
+	"VA": 336,
+	"VC": 670,
+	"VE": 862,
+	"VG": 92,
+	"VI": 850,
+	"VN": 704,
+	"VU": 548,
+	"WF": 876,
+	"WS": 882,
+	"YE": 887,
+	"YT": 175,
+	"ZA": 710,
+	"ZM": 894,
+	"ZW": 716,
+}
@@ -0,0 +1,219 @@
+package ipinfo
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+)
+
+// Database load modes, see DBLoadMode.
+const (
+	loadModeMmap   = "mmap"
+	loadModeMemory = "memory"
+)
+
+// dbLock guards the database readers. Lookups hold it for reading until they
+// are done with the readers, so a reload only closes a reader once no lookup
+// still uses it.
+var dbLock sync.RWMutex
+
+// loadErrors holds the error of the last attempt to open each database that
+// failed, and reloadedAt the time of the last successful reload, both guarded
+// by dbLock.
+var (
+	loadErrors = map[string]error{}
+	reloadedAt time.Time
+)
+
+// setLoadError records the outcome of opening the database at path.
+func setLoadError(path string, err error) {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if err != nil {
+		loadErrors[path] = err
+	} else {
+		delete(loadErrors, path)
+	}
+}
+
+// reloadLock keeps reloads from running at once, as each closes the readers
+// the one before swapped in.
+var reloadLock sync.Mutex
+
+// optionalDatabase is one of the optional databases of cfg, with the reader
+// it is served from and what it adds to a lookup.
+type optionalDatabase struct {
+	reader           **geoip2.Reader
+	path, name, adds string
+}
+
+func optionalDatabases(cfg Config) []optionalDatabase {
+	return []optionalDatabase{
+		{&dbEnterprise, cfg.EnterpriseDB, "Enterprise", "subdivision confidence info"},
+		{&dbAnonymous, cfg.AnonymousDB, "Anonymous IP", "privacy info"},
+		{&dbISP, cfg.ISPDB, "ISP", "ISP info"},
+		{&dbDomain, cfg.DomainDB, "Domain", "domain info"},
+		{&dbConnectionType, cfg.ConnectionTypeDB, "Connection-Type", "connection type info"},
+	}
+}
+
+// reloadDatabases reopens every configured database and swaps them in. The
+// old readers are closed once the in-flight lookups are done. When any but
+// the City database can not be opened the current one is kept.
+func reloadDatabases() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	city, cityNetworks, err := openDatabase(config.CityDB)
+	setLoadError(config.CityDB, err)
+	if err != nil {
+		return err
+	}
+	// Indexed before taking the lock, lookups go on meanwhile.
+	grid := indexCities(cityNetworks)
+	var asn *geoip2.Reader
+	var asnNetworks *maxminddb.Reader
+	var names map[uint]string
+	if config.ASNDB != "" {
+		asn, asnNetworks, err = openDatabase(config.ASNDB)
+		setLoadError(config.ASNDB, err)
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to reopen ASN database, keeping the current one")
+		}
+		names = indexASNs(asnNetworks)
+	}
+
+	// Only reloads swap these, so they can be read without dbLock here.
+	layers := make([]*geoip2.Reader, len(dbLayers))
+	for i, path := range config.Layers {
+		if i < len(dbLayers) {
+			layers[i] = reopenOptionalDatabase(path, "layer "+path, dbLayers[i])
+		}
+	}
+	optional := optionalDatabases(config)
+	reopened := make([]*geoip2.Reader, len(optional))
+	for i, o := range optional {
+		reopened[i] = reopenOptionalDatabase(o.path, o.name, *o.reader)
+	}
+
+	dbLock.Lock()
+	oldCity, oldCityNetworks := dbCity, netCity
+	dbCity, netCity, cityIndex = city, cityNetworks, grid
+	var oldASN *geoip2.Reader
+	var oldASNNetworks *maxminddb.Reader
+	if asn != nil {
+		oldASN, oldASNNetworks = dbASN, netASN
+		dbASN, netASN, asnNames = asn, asnNetworks, names
+	}
+	old := append([]*geoip2.Reader(nil), dbLayers...)
+	dbLayers = layers
+	for i, o := range optional {
+		old = append(old, *o.reader)
+		*o.reader = reopened[i]
+	}
+	reloadedAt = time.Now()
+	dbLock.Unlock()
+	lookupCache.purge()
+
+	oldCity.Close()
+	oldCityNetworks.Close()
+	if oldASN != nil {
+		oldASN.Close()
+		oldASNNetworks.Close()
+	}
+	for i, db := range append(layers, reopened...) {
+		if old[i] != nil && old[i] != db {
+			old[i].Close()
+		}
+	}
+	return nil
+}
+
+// reopenOptionalDatabase opens an optional database again, nil when path is
+// empty. When it can not be opened the current reader is kept.
+func reopenOptionalDatabase(path, name string, current *geoip2.Reader) *geoip2.Reader {
+	if path == "" {
+		return nil
+	}
+	db, networks, err := openDatabase(path)
+	setLoadError(path, err)
+	if err != nil {
+		if current != nil {
+			log.Warn().Err(err).Msgf("Unable to reopen %s database, keeping the current one", name)
+		}
+		return current
+	}
+	networks.Close()
+	return db
+}
+
+// openOptionalDatabase opens an optional database, nil when path is empty or
+// it can not be opened, logging whether lookups will have what it adds.
+func openOptionalDatabase(path, name, adds string) *geoip2.Reader {
+	if path == "" {
+		return nil
+	}
+	db, networks, err := openDatabase(path)
+	setLoadError(path, err)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Unable to open %s database, lookups will not have %s", name, adds)
+		return nil
+	}
+	networks.Close()
+	log.Info().Msgf("Loaded %s database, lookups will have %s", name, adds)
+	return db
+}
+
+// openDatabase opens the database at path as DBLoadMode asks. The mmap mode
+// falls back to reading the file into memory when a memory map cannot be
+// established on a network filesystem, where mmap is unreliable.
+//
+// geoip2 does not expose the network a record was found in, so a plain
+// maxminddb reader over the same file is returned for network lookups.
+func openDatabase(path string) (*geoip2.Reader, *maxminddb.Reader, error) {
+	if *DBLoadMode == loadModeMemory {
+		return openDatabaseInMemory(path)
+	}
+
+	network := isNetworkFilesystem(path)
+	if network {
+		log.Warn().Str("path", path).Msg("Database is on a network filesystem, consider DB_LOAD_MODE=memory to avoid mmap stalls")
+	}
+
+	db, err := geoip2.Open(path)
+	if err != nil && network {
+		log.Warn().Err(err).Str("path", path).Msg("Unable to mmap database on a network filesystem, loading it into memory instead")
+		return openDatabaseInMemory(path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	networks, err := maxminddb.Open(path)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, networks, nil
+}
+
+// openDatabaseInMemory reads path once, both readers share the bytes.
+func openDatabaseInMemory(path string) (*geoip2.Reader, *maxminddb.Reader, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := geoip2.FromBytes(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	networks, err := maxminddb.FromBytes(bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, networks, nil
+}
@@ -0,0 +1,52 @@
+package ipinfo
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// datacenterASNs are the ASNs lookups are flagged is_datacenter for, the
+// built-in list unless DatacenterASNs replaces it
+var datacenterASNs = defaultDatacenterASNs
+
+// loadDatacenterASNs reads a list of ASNs, one per line with an optional AS
+// prefix. Anything after a # is a comment.
+func loadDatacenterASNs(path string) (map[uint]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	asns := make(map[uint]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, comment := scanner.Text(), ""
+		if i := strings.Index(text, "#"); i >= 0 {
+			text, comment = text[:i], strings.TrimSpace(text[i+1:])
+		}
+		text = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(text)), "AS")
+		if text == "" {
+			continue
+		}
+		asn, err := strconv.ParseUint(text, 10, 32)
+		if err != nil || asn == 0 {
+			return nil, fmt.Errorf("line %d: invalid ASN %q", line, text)
+		}
+		asns[uint(asn)] = comment
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return asns, nil
+}
+
+// isDatacenterASN reports whether asn belongs to a hosting, cloud or VPN
+// provider.
+func isDatacenterASN(asn uint) bool {
+	_, ok := datacenterASNs[asn]
+	return ok
+}
@@ -0,0 +1,56 @@
+package ipinfo
+
+// defaultDatacenterASNs are networks of hosting, cloud and VPN providers,
+// whose addresses are servers rather than people. It is a cheap heuristic,
+// operators with better lists replace it with DatacenterASNs.
+var defaultDatacenterASNs = map[uint]string{
+	7224:   "Amazon",
+	8075:   "Microsoft",
+	8100:   "QuadraNet",
+	8560:   "IONOS",
+	8972:   "Host Europe",
+	9009:   "M247",
+	12876:  "Scaleway",
+	13335:  "Cloudflare",
+	14061:  "DigitalOcean",
+	14618:  "Amazon",
+	15169:  "Google",
+	16265:  "Leaseweb",
+	16276:  "OVH",
+	16509:  "Amazon",
+	19318:  "Interserver",
+	19994:  "Rackspace",
+	20454:  "SSD Nodes",
+	20473:  "Vultr",
+	24940:  "Hetzner",
+	25369:  "Hydra Communications",
+	26496:  "GoDaddy",
+	27357:  "Rackspace",
+	29802:  "HIVELOCITY",
+	31898:  "Oracle Cloud",
+	32097:  "WholeSale Internet",
+	33070:  "Rackspace",
+	35540:  "OVH",
+	36351:  "IBM Cloud",
+	37963:  "Alibaba Cloud",
+	39351:  "31173 Services (Mullvad)",
+	40021:  "Contabo",
+	45090:  "Tencent Cloud",
+	45102:  "Alibaba Cloud",
+	46606:  "Unified Layer",
+	47583:  "Hostinger",
+	51167:  "Contabo",
+	53667:  "FranTech (BuyVM)",
+	57169:  "EDIS",
+	60068:  "Datacamp (CDN77)",
+	60781:  "Leaseweb",
+	62240:  "Clouvider",
+	63949:  "Akamai Connected Cloud (Linode)",
+	132203: "Tencent Cloud",
+	135377: "UCloud",
+	136907: "Huawei Cloud",
+	206092: "IPXO",
+	209242: "Cloudflare WARP",
+	212238: "Datacamp (CDN77)",
+	396982: "Google Cloud",
+}
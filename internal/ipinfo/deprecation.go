@@ -0,0 +1,31 @@
+package ipinfo
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// deprecations describes features that still work but are going away. Each
+// use is answered with a Warning header so clients have time to migrate.
+var deprecations = map[string]string{
+	"jsonp": "JSONP callbacks are deprecated and will be removed in a future release",
+}
+
+// deprecated flags the use of a deprecated feature on the response, using
+// the miscellaneous persistent warning code of RFC 7234, and logs it.
+func deprecated(w http.ResponseWriter, r *http.Request, feature string) {
+	message, ok := deprecations[feature]
+	if !ok {
+		return
+	}
+
+	w.Header().Add("Warning", "299 - "+strconv.Quote(message))
+
+	log.Warn().
+		Str("feature", feature).
+		Str("remote", defangIP(r.RemoteAddr)).
+		Str("url", r.URL.EscapedPath()).
+		Msg("Deprecated feature used")
+}
@@ -0,0 +1,95 @@
+package ipinfo
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kilometers in a statute mile.
+const kilometersPerMile = 1.609344
+
+// distanceEnd is one end of a distance, an address with where it is located
+// or plain coordinates.
+type distanceEnd struct {
+	IP             string  `json:"ip,omitempty"`
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	AccuracyRadius uint16  `json:"accuracy_radius,omitempty"`
+}
+
+type distance struct {
+	From       distanceEnd `json:"from"`
+	To         distanceEnd `json:"to"`
+	Kilometers float64     `json:"km"`
+	Miles      float64     `json:"miles"`
+}
+
+// parseDistanceEnd reads an address, looking it up, or "latitude,longitude".
+// ok is false for anything else, known is false for an address without a
+// location.
+func parseDistanceEnd(s string) (end distanceEnd, ok, known bool) {
+	if ip := net.ParseIP(s); ip != nil {
+		info, _ := LookupIP(ip)
+		end = distanceEnd{
+			IP:             info.IP,
+			Latitude:       info.Location.Latitude,
+			Longitude:      info.Location.Longitude,
+			AccuracyRadius: info.Location.AccuracyRadius,
+		}
+		return end, true, info.Location.known()
+	}
+
+	coordinates := strings.Split(s, ",")
+	if len(coordinates) != 2 {
+		return end, false, false
+	}
+	latitude, longitude, err := parseCoordinates(coordinates[0], coordinates[1])
+	if err != nil {
+		return end, false, false
+	}
+	return distanceEnd{Latitude: latitude, Longitude: longitude}, true, true
+}
+
+// Distance serves /distance/{ip}/{ip} and /distance/{ip}/{latitude},{longitude},
+// the great-circle distance between the locations of the addresses or the
+// coordinates. An address without a location is unprocessable.
+func Distance(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/distance/"), "/")
+	if len(segments) != 2 || len(r.URL.Path) > 128 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	var d distance
+	var ok [2]bool
+	var known [2]bool
+	d.From, ok[0], known[0] = parseDistanceEnd(segments[0])
+	d.To, ok[1], known[1] = parseDistanceEnd(segments[1])
+	if !ok[0] || !ok[1] {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+	if !known[0] || !known[1] {
+		http.Error(w, "Unprocessable Entity", http.StatusUnprocessableEntity)
+		retval = http.StatusUnprocessableEntity
+		return
+	}
+
+	km := greatCircle(d.From.Latitude, d.From.Longitude, d.To.Latitude, d.To.Longitude)
+	d.Kilometers = math.Round(km*10) / 10
+	d.Miles = math.Round(km/kilometersPerMile*10) / 10
+	writeJSON(w, r, d)
+	retval = http.StatusOK
+}
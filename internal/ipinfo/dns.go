@@ -0,0 +1,127 @@
+package ipinfo
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dnsResolver is the subset of net.Resolver used for hostname lookups.
+type dnsResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var resolver dnsResolver = net.DefaultResolver
+
+// initializeResolver sends the DNS lookups to DNSServer when it is set, and
+// through the system resolver otherwise.
+func initializeResolver() {
+	resolver = net.DefaultResolver
+	if config.DNSServer == "" {
+		return
+	}
+	server := config.DNSServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// reverseLookup returns the first PTR name of ip without its trailing dot,
+// or an empty string when there is none within DNSTimeout. Answers, including
+// the lack of a PTR record, are kept in the hostname cache when enabled, a
+// timeout or failure is not.
+func reverseLookup(ctx context.Context, ip net.IP) string {
+	addr := ip.String()
+	if hostname, ok := hostnames.get(addr, time.Now()); ok {
+		return hostname
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *DNSTimeout)
+	defer cancel()
+
+	names, err := resolver.LookupAddr(ctx, addr)
+	if dnsErr, ok := err.(*net.DNSError); err != nil && (!ok || !dnsErr.IsNotFound) {
+		return ""
+	}
+	var hostname string
+	if len(names) > 0 {
+		hostname = normalizeHostname(names[0])
+	}
+	hostnames.add(addr, hostname, time.Now())
+	return hostname
+}
+
+// hostnames holds recent reverse lookups, nil when caching is disabled
+var hostnames *ttlCache
+
+// initializeHostnames starts caching reverse lookups when HostnameCacheSize
+// is set.
+func initializeHostnames() {
+	hostnames = nil
+	if config.HostnameCacheSize > 0 {
+		hostnames = newTTLCache(config.HostnameCacheSize, config.HostnameCacheTTL)
+	}
+}
+
+// validHostname matches DNS names of at least two labels with a top-level
+// domain that is not a number, so it can never be mistaken for an address.
+var validHostname = regexp.MustCompile(`^(?i)([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?\.?$`)
+
+func isHostname(s string) bool {
+	return len(s) <= 254 && validHostname.MatchString(s)
+}
+
+// normalizeHostname lowercases a DNS name and strips the trailing dot of the
+// fully-qualified form, so "Example.com." and "example.com" are reported the
+// same way everywhere.
+func normalizeHostname(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// resolveHost looks up the addresses of a hostname within DNSTimeout and
+// returns them with the normalized name. The name is always queried in its
+// absolute form, so the resolver's search domains can never make
+// "example.com" and "example.com." resolve differently.
+func resolveHost(ctx context.Context, host string) (string, []net.IP, error) {
+	name := normalizeHostname(host)
+
+	ctx, cancel := context.WithTimeout(ctx, *DNSTimeout)
+	defer cancel()
+
+	addrs, err := resolver.LookupIPAddr(ctx, name+".")
+	if err != nil {
+		return name, nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return name, ips, nil
+}
+
+// forwardConfirmed reports whether hostname resolves back to ip, which is
+// what makes a PTR record trustworthy (FCrDNS). The error is set when the
+// forward lookup itself failed within DNSTimeout.
+func forwardConfirmed(ctx context.Context, hostname string, ip net.IP) (bool, error) {
+	_, addrs, err := resolveHost(ctx, hostname)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if addr.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
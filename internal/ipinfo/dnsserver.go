@@ -0,0 +1,432 @@
+package ipinfo
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Record types, classes and response codes of the DNS answers.
+const (
+	dnsTypeA   = 1
+	dnsTypeSOA = 6
+	dnsTypeTXT = 16
+	dnsTypeANY = 255
+
+	dnsClassIN  = 1
+	dnsClassANY = 255
+
+	dnsNoError  = 0
+	dnsFormErr  = 1
+	dnsServFail = 2
+	dnsNXDomain = 3
+	dnsNotImp   = 4
+	dnsRefused  = 5
+)
+
+// UDP answers larger than this are truncated, clients retry over TCP.
+const dnsMaxUDP = 512
+
+// dnsLimiter limits queries per source when there is no rateLimiter, so that
+// the DNS listener is never an open amplifier. nil when DNSRateLimit is 0.
+var dnsLimiter *limiter
+
+// dnsLimiterSweep forgets idle sources of dnsLimiter
+var dnsLimiterSweep refresher
+
+// ServeDNS answers geo queries for names under DNSZone, over UDP and TCP on
+// addr. Every query counts against the rate limit of its source address,
+// DNSRateLimit without a RateLimit. It only returns when a listener fails.
+func ServeDNS(addr string) error {
+	if *DNSRateLimit > 0 {
+		l := newLimiter(*DNSRateLimit, *RateBurst)
+		dnsLimiter = l
+		dnsLimiterSweep.start(time.Minute, false, l.sweep)
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	log.Info().Msg("DNS listening on " + addr + " for " + *DNSZone)
+
+	errs := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				errs <- err
+				return
+			}
+			source, _, _ := net.SplitHostPort(from.String())
+			if reply := serveDNS(buf[:n], dnsMaxUDP, source); reply != nil {
+				pc.WriteTo(reply, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				errs <- err
+				return
+			}
+			go serveDNSConn(conn)
+		}
+	}()
+	return <-errs
+}
+
+// serveDNSConn answers the length-prefixed queries on a TCP connection until
+// the client hangs up.
+func serveDNSConn(conn net.Conn) {
+	defer conn.Close()
+	source, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(binaryIdleTimeout))
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(r, query); err != nil {
+			return
+		}
+		reply := serveDNS(query, 65535, source)
+		if reply == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(length[:], uint16(len(reply)))
+		if _, err := conn.Write(append(length[:], reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// serveDNS answers a query from source, or refuses it once source is over
+// the rate limit. Refusals carry no question, so that they are never larger
+// than the query and a spoofed source gains nothing from them.
+func serveDNS(query []byte, size int, source string) []byte {
+	limit := rateLimiter
+	if limit == nil {
+		limit = dnsLimiter
+	}
+	if limit != nil {
+		if ok, _, _ := limit.take(source); !ok {
+			if len(query) < 12 || query[2]&0x80 != 0 {
+				return nil
+			}
+			return dnsHeader(query, dnsRefused, 0, 0)
+		}
+	}
+	return answerDNS(query, size)
+}
+
+// dnsHeader is the header of the answer to query, without any records.
+func dnsHeader(query []byte, rcode byte, answers, authority int) []byte {
+	h := make([]byte, 12, 512)
+	copy(h, query[:2])
+	// A response, authoritative, opcode and recursion desired copied over.
+	h[2] = 0x80 | query[2]&0x78 | 0x04 | query[2]&0x01
+	h[3] = rcode
+	binary.BigEndian.PutUint16(h[6:], uint16(answers))
+	binary.BigEndian.PutUint16(h[8:], uint16(authority))
+	return h
+}
+
+// dnsQuestion is the single question of a query, with the name in lower
+// case and without the trailing dot.
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	class uint16
+	// The question as it was sent, echoed in the answer.
+	raw []byte
+}
+
+// answerDNS answers a DNS query message with at most size bytes. Names under
+// DNSZone are addresses, dotted for IPv4 or with dashes for the colons of
+// IPv6, like 8.8.8.8.geo.internal or 2001-db8--1.geo.internal. TXT records
+// hold the lookup as key=value strings, and A records the ISO 3166-1
+// numeric code of the country as 127.0.x.y. Messages too broken to answer
+// return nil.
+func answerDNS(query []byte, size int) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	opcode := query[2] >> 3 & 0x0f
+	header := func(rcode byte, answers, authority int) []byte {
+		return dnsHeader(query, rcode, answers, authority)
+	}
+
+	if opcode != 0 {
+		return header(dnsNotImp, 0, 0)
+	}
+	q, ok := parseDNSQuestion(query)
+	if !ok {
+		return header(dnsFormErr, 0, 0)
+	}
+	withQuestion := func(msg []byte) []byte {
+		binary.BigEndian.PutUint16(msg[4:], 1)
+		return append(msg, q.raw...)
+	}
+
+	zone := strings.ToLower(strings.TrimSuffix(*DNSZone, "."))
+	var label string
+	switch {
+	case q.name == zone:
+	case strings.HasSuffix(q.name, "."+zone):
+		label = strings.TrimSuffix(q.name, "."+zone)
+	default:
+		return withQuestion(header(dnsRefused, 0, 0))
+	}
+	if q.class != dnsClassIN && q.class != dnsClassANY {
+		return withQuestion(header(dnsRefused, 0, 0))
+	}
+
+	ttl := uint32(DNSTTL.Seconds())
+	soa := dnsSOA(zone, ttl)
+	// Negative answers carry the SOA, so that resolvers cache them.
+	negative := func(rcode byte) []byte {
+		return append(withQuestion(header(rcode, 0, 1)), soa...)
+	}
+
+	var records [][]byte
+	if label == "" {
+		if q.qtype == dnsTypeSOA || q.qtype == dnsTypeANY {
+			records = append(records, soa)
+		}
+	} else {
+		ip := dnsLabelIP(label)
+		if ip == nil {
+			return negative(dnsNXDomain)
+		}
+		info, err := LookupIP(ip)
+		if err != nil {
+			return withQuestion(header(dnsServFail, 0, 0))
+		}
+		if q.qtype == dnsTypeTXT || q.qtype == dnsTypeANY {
+			records = append(records, dnsRecord(dnsTypeTXT, ttl, dnsTXT(info)))
+		}
+		if number, ok := countryNumbers[info.Country.Code]; ok && (q.qtype == dnsTypeA || q.qtype == dnsTypeANY) {
+			records = append(records, dnsRecord(dnsTypeA, ttl, []byte{127, 0, byte(number >> 8), byte(number)}))
+		}
+	}
+	if len(records) == 0 {
+		return negative(dnsNoError)
+	}
+
+	msg := withQuestion(header(dnsNoError, len(records), 0))
+	for _, record := range records {
+		msg = append(msg, record...)
+	}
+	if len(msg) > size {
+		msg = withQuestion(header(dnsNoError, 0, 0))
+		msg[2] |= 0x02
+	}
+	return msg
+}
+
+// parseDNSQuestion reads the one question of a query.
+func parseDNSQuestion(msg []byte) (dnsQuestion, bool) {
+	var q dnsQuestion
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return q, false
+	}
+
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return q, false
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		// Compression pointers can't occur in the first name of a message.
+		if n > 63 || i+n > len(msg) {
+			return q, false
+		}
+		labels = append(labels, strings.ToLower(string(msg[i:i+n])))
+		i += n
+	}
+	if i+4 > len(msg) {
+		return q, false
+	}
+
+	q.name = strings.Join(labels, ".")
+	q.qtype = binary.BigEndian.Uint16(msg[i:])
+	q.class = binary.BigEndian.Uint16(msg[i+2:])
+	q.raw = msg[12 : i+4]
+	return q, true
+}
+
+// dnsLabelIP parses the address in front of the zone, or returns nil.
+func dnsLabelIP(label string) net.IP {
+	if strings.Count(label, ".") == 3 {
+		if ip := net.ParseIP(label).To4(); ip != nil {
+			return ip
+		}
+		return nil
+	}
+	if strings.Contains(label, ".") || !strings.Contains(label, "-") {
+		return nil
+	}
+	ip := net.ParseIP(strings.Replace(label, "-", ":", -1))
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	return ip
+}
+
+// dnsTXT lists the lookup as key=value character strings, leaving out what
+// is unknown.
+func dnsTXT(info ipInfo) []byte {
+	var txt []byte
+	add := func(key, value string) {
+		if value == "" || value == "0" {
+			return
+		}
+		s := key + "=" + value
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		txt = append(append(txt, byte(len(s))), s...)
+	}
+
+	add("ip", info.IP)
+	add("country", info.Country.Code)
+	add("region", info.regionCode)
+	add("city", info.City)
+	add("asn", strconv.FormatUint(uint64(info.ASN), 10))
+	add("organization", info.Organization)
+	add("type", info.Type)
+	return txt
+}
+
+// dnsSOA is the SOA record of the zone, named ns and hostmaster under it.
+func dnsSOA(zone string, ttl uint32) []byte {
+	var rdata []byte
+	rdata = append(rdata, dnsName("ns."+zone)...)
+	rdata = append(rdata, dnsName("hostmaster."+zone)...)
+	// Serial, refresh, retry, expire and the TTL of negative answers.
+	for _, v := range []uint32{1, 3600, 600, 86400, ttl} {
+		rdata = append(rdata, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+
+	record := append(dnsName(zone), make([]byte, 10)...)
+	fillDNSRecord(record[len(record)-10:], dnsTypeSOA, ttl, len(rdata))
+	return append(record, rdata...)
+}
+
+// dnsRecord is a resource record named after the question, which always
+// starts at offset 12.
+func dnsRecord(rtype uint16, ttl uint32, rdata []byte) []byte {
+	record := make([]byte, 12, 12+len(rdata))
+	record[0], record[1] = 0xc0, 12
+	fillDNSRecord(record[2:], rtype, ttl, len(rdata))
+	return append(record, rdata...)
+}
+
+// fillDNSRecord writes the type, class, TTL and data length of a record.
+func fillDNSRecord(b []byte, rtype uint16, ttl uint32, length int) {
+	binary.BigEndian.PutUint16(b, rtype)
+	binary.BigEndian.PutUint16(b[2:], dnsClassIN)
+	binary.BigEndian.PutUint32(b[4:], ttl)
+	binary.BigEndian.PutUint16(b[8:], uint16(length))
+}
+
+// dnsName encodes a name as labels, without compression.
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		if label != "" {
+			b = append(append(b, byte(len(label))), label...)
+		}
+	}
+	return append(b, 0)
+}
+
+// DNS-over-HTTPS messages larger than this are refused.
+const dohMaxMessage = 65535
+
+// DNSQuery answers DNS-over-HTTPS queries for DNSZone as RFC 8484 defines,
+// the message base64url encoded in the dns parameter of a GET or as an
+// application/dns-message POST body. Answers can be cached for their TTL.
+func DNSQuery(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	var query []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil || len(query) == 0 {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			retval = http.StatusBadRequest
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			retval = http.StatusUnsupportedMediaType
+			return
+		}
+		var err error
+		if query, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dohMaxMessage)); err != nil {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			retval = http.StatusRequestEntityTooLarge
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		retval = http.StatusMethodNotAllowed
+		return
+	}
+
+	reply := answerDNS(query, dohMaxMessage)
+	if reply == nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	if reply[3]&0x0f == dnsNoError || reply[3]&0x0f == dnsNXDomain {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(DNSTTL.Seconds())))
+	}
+	retval = http.StatusOK
+	w.Write(reply)
+}
@@ -0,0 +1,240 @@
+package ipinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// member is a field of an object, objects keep their fields in order.
+type member struct {
+	key   string
+	value interface{}
+}
+
+// jsonTree converts v into generic values following its JSON form, so every
+// output format names and orders fields the same way: objects become
+// []member, arrays []interface{} and numbers json.Number.
+func jsonTree(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return decodeTree(dec)
+}
+
+func decodeTree(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		object := []member{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, member{key.(string), value})
+		}
+		_, err = dec.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for dec.More() {
+			value, err := decodeTree(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = dec.Token()
+		return array, err
+	}
+	return tok, nil
+}
+
+// writeXML writes v as an XML document with a root element of that name,
+// elements named after the JSON fields. Array entries repeat the element of
+// their field, null fields are left out.
+func writeXML(w io.Writer, root string, v interface{}, indent bool) error {
+	tree, err := jsonTree(v)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if indent {
+		enc.Indent("", "  ")
+	}
+	if err := encodeXML(enc, root, tree); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func encodeXML(enc *xml.Encoder, name string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		for _, item := range v {
+			if err := encodeXML(enc, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []member:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, m := range v {
+			if err := encodeXML(enc, m.key, m.value); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+	}
+	return enc.EncodeElement(fmt.Sprint(v), start)
+}
+
+// yamlPlain matches strings that read back as the same string in YAML
+// without quotes.
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_ ./-]*$`)
+
+// yamlReserved are the plain scalars YAML would not read as strings.
+var yamlReserved = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true, "on": true, "off": true,
+	"y": true, "n": true, "null": true,
+}
+
+// writeYAML writes v as a YAML document in block style, fields named and
+// ordered like in JSON.
+func writeYAML(w io.Writer, v interface{}) error {
+	tree, err := jsonTree(v)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	encodeYAML(&b, tree, 0)
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+func encodeYAML(b *strings.Builder, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case []member:
+		if len(v) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		for _, m := range v {
+			b.WriteString(pad + yamlScalar(m.key) + ":")
+			switch value := m.value.(type) {
+			case []member:
+				if len(value) > 0 {
+					b.WriteString("\n")
+					encodeYAML(b, value, indent+2)
+					continue
+				}
+			case []interface{}:
+				if len(value) > 0 {
+					b.WriteString("\n")
+					encodeYAML(b, value, indent)
+					continue
+				}
+			}
+			b.WriteString(" " + yamlScalar(m.value) + "\n")
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			// Nested collections start on the dash line.
+			var nested strings.Builder
+			encodeYAML(&nested, item, indent+2)
+			b.WriteString(pad + "- " + strings.TrimPrefix(nested.String(), pad+"  "))
+		}
+	default:
+		b.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// yamlScalar formats a scalar of a jsonTree, or an empty collection.
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		if yamlPlain.MatchString(v) && !strings.HasSuffix(v, " ") && !yamlReserved[strings.ToLower(v)] {
+			return v
+		}
+		// JSON strings are valid double-quoted YAML scalars.
+		quoted, _ := json.Marshal(v)
+		return string(quoted)
+	case []member:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	return fmt.Sprint(v)
+}
+
+// geoJSONFeature is a lookup as a GeoJSON Feature, RFC 7946.
+type geoJSONFeature struct {
+	Type       string        `json:"type"`
+	Geometry   *geoJSONPoint `json:"geometry"`
+	Properties interface{}   `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// toGeoJSON makes a Feature of the lookup with a Point at its location, or
+// no geometry when it is unknown. The other fields of out, a selectOutput of
+// the lookup, become the properties.
+func toGeoJSON(info ipInfo, out interface{}) geoJSONFeature {
+	feature := geoJSONFeature{Type: "Feature", Properties: out}
+	if info.Location.known() {
+		feature.Geometry = &geoJSONPoint{
+			Type:        "Point",
+			Coordinates: [2]float64{info.Location.Longitude, info.Location.Latitude},
+		}
+	}
+
+	// The coordinates are in the geometry already.
+	if properties, ok := sortedFields(out).(map[string]interface{}); ok {
+		if location, ok := properties["location"].(map[string]interface{}); ok {
+			delete(location, "latitude")
+			delete(location, "longitude")
+			if len(location) == 0 {
+				delete(properties, "location")
+			}
+		}
+		feature.Properties = properties
+	}
+	return feature
+}
@@ -0,0 +1,120 @@
+package ipinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Each subscriber buffers this many events, a slower one misses the rest.
+const eventBuffer = 64
+
+// Subscribers are sent a comment this often, to keep proxies from closing
+// a quiet stream.
+const eventKeepAlive = 15 * time.Second
+
+// lookupEvent is a lookup as broadcast to the /events subscribers.
+type lookupEvent struct {
+	Time     string  `json:"time"`
+	IP       string  `json:"ip,omitempty"`
+	Country  string  `json:"country,omitempty"`
+	ASN      uint    `json:"asn,omitempty"`
+	Status   int     `json:"status"`
+	Duration float64 `json:"duration"`
+}
+
+var (
+	eventLock        sync.RWMutex
+	eventSubscribers = map[chan lookupEvent]struct{}{}
+)
+
+// publishLookup sends the event to every subscriber without blocking.
+func publishLookup(event lookupEvent) {
+	eventLock.RLock()
+	defer eventLock.RUnlock()
+	for events := range eventSubscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// subscribeLookups returns a channel receiving the lookups from now on, and
+// the function to stop them.
+func subscribeLookups() (<-chan lookupEvent, func()) {
+	events := make(chan lookupEvent, eventBuffer)
+	eventLock.Lock()
+	eventSubscribers[events] = struct{}{}
+	eventLock.Unlock()
+
+	return events, func() {
+		eventLock.Lock()
+		delete(eventSubscribers, events)
+		eventLock.Unlock()
+	}
+}
+
+// Events streams the lookups as they are answered, as Server-Sent Events
+// named "lookup" holding the address, its country and ASN, the status and
+// the duration in milliseconds. Like the admin endpoints it requires the
+// AdminToken as a bearer token, and is not found without one configured.
+func Events(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+	sent := 0
+
+	defer func() {
+		accessLog(r, milliseconds(time.Since(start)), retval).Int("events", sent).Msg("")
+	}()
+
+	observe := func() {
+		observeDuration(r, time.Since(start), retval)
+	}
+
+	if retval = authorizeAdmin(w, r); retval != http.StatusOK {
+		observe()
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		retval = http.StatusInternalServerError
+		observe()
+		return
+	}
+
+	events, unsubscribe := subscribeLookups()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(": connected\n\n"))
+	flusher.Flush()
+	// The duration metric is only the time to subscribe, streams stay open.
+	observe()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			if _, err := w.Write(append(append([]byte("event: lookup\ndata: "), data...), '\n', '\n')); err != nil {
+				return
+			}
+			sent++
+		}
+		flusher.Flush()
+	}
+}
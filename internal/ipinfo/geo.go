@@ -0,0 +1,80 @@
+package ipinfo
+
+import "math"
+
+// Mean radius of the earth, in kilometers.
+const meanEarthRadius = 6371.0088
+
+// greatCircle returns the distance in kilometers between two WGS84
+// coordinates, using the haversine formula.
+func greatCircle(lat1, lon1, lat2, lon2 float64) float64 {
+	lat1, lon1 = lat1*math.Pi/180, lon1*math.Pi/180
+	lat2, lon2 = lat2*math.Pi/180, lon2*math.Pi/180
+
+	a := math.Pow(math.Sin((lat2-lat1)/2), 2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin((lon2-lon1)/2), 2)
+	return 2 * meanEarthRadius * math.Asin(math.Sqrt(a))
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes coordinates as a geohash of precision characters, each
+// halving the cell alternately in longitude and latitude five times.
+func geohash(latitude, longitude float64, precision int) string {
+	lat := [2]float64{-90, 90}
+	lon := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	even := true
+	var bit, ch int
+	for len(hash) < precision {
+		r, v := &lat, latitude
+		if even {
+			r, v = &lon, longitude
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+const plusCodeAlphabet = "23456789CFGHJMPQRVWX"
+
+// plusCode encodes coordinates as a 10 digit Open Location Code, like
+// 8FVC9G8F+6X, a cell of about 14 by 14 meters.
+func plusCode(latitude, longitude float64) string {
+	// In units of the last pair, 1/8000 of a degree.
+	const resolution = 8000
+	lat := int64(math.Floor((latitude + 90) * resolution))
+	if top := int64(180*resolution - 1); lat > top {
+		lat = top
+	} else if lat < 0 {
+		lat = 0
+	}
+	lon := int64(math.Floor((longitude + 180) * resolution))
+	lon %= 360 * resolution
+	if lon < 0 {
+		lon += 360 * resolution
+	}
+
+	code := make([]byte, 11)
+	for i := 4; i >= 0; i-- {
+		code[2*i] = plusCodeAlphabet[lat%20]
+		code[2*i+1] = plusCodeAlphabet[lon%20]
+		lat, lon = lat/20, lon/20
+	}
+	// The separator goes after the eighth digit.
+	copy(code[9:], code[8:10])
+	code[8] = '+'
+	return string(code)
+}
@@ -0,0 +1,217 @@
+package ipinfo
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+)
+
+// indexedCity is a city of the City database, with its coordinates and an
+// address located in it.
+type indexedCity struct {
+	latitude, longitude float64
+	ip                  net.IP
+}
+
+// cityCell is the edge of the cubes the cities are bucketed in, on the unit
+// sphere, about 127km.
+const cityCell = 0.02
+
+// cityGrid buckets cities by the cube their point on the unit sphere falls
+// in, so the nearest one is found by searching the cubes around a point.
+type cityGrid struct {
+	cities []indexedCity
+	cells  map[[3]int][]int
+}
+
+// cityIndex is the grid of the cities in the City database. It is built with
+// the reader and swapped in along with it, guarded by dbLock.
+var cityIndex *cityGrid
+
+// indexCities walks every network of the City database once, for one
+// address in each of its cities. It returns nil when the walk fails.
+func indexCities(reader *maxminddb.Reader) *cityGrid {
+	if reader == nil {
+		return nil
+	}
+	start := time.Now()
+	seen := make(map[uint]bool)
+	var cities []indexedCity
+	networks := reader.Networks()
+	for networks.Next() {
+		var rec struct {
+			City struct {
+				GeoNameID uint `maxminddb:"geoname_id"`
+			} `maxminddb:"city"`
+			Location struct {
+				Latitude  float64 `maxminddb:"latitude"`
+				Longitude float64 `maxminddb:"longitude"`
+			} `maxminddb:"location"`
+		}
+		network, err := networks.Network(&rec)
+		if err != nil || rec.City.GeoNameID == 0 || seen[rec.City.GeoNameID] {
+			continue
+		}
+		seen[rec.City.GeoNameID] = true
+		cities = append(cities, indexedCity{rec.Location.Latitude, rec.Location.Longitude, network.IP})
+	}
+	if err := networks.Err(); err != nil {
+		log.Warn().Err(err).Msg("Unable to walk the City database, reverse geocoding will find nothing")
+		return nil
+	}
+	log.Info().Int("cities", len(cities)).Dur("took", time.Since(start)).Msg("Indexed the City database")
+	return newCityGrid(cities)
+}
+
+// newCityGrid buckets cities into a grid.
+func newCityGrid(cities []indexedCity) *cityGrid {
+	g := &cityGrid{cities: cities, cells: make(map[[3]int][]int)}
+	for i, c := range cities {
+		cell := cellOf(unitVector(c.latitude, c.longitude))
+		g.cells[cell] = append(g.cells[cell], i)
+	}
+	return g
+}
+
+// currentCities returns the grid of the City database in use.
+func currentCities() *cityGrid {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	return cityIndex
+}
+
+// unitVector is the point of the coordinates on the unit sphere.
+func unitVector(latitude, longitude float64) [3]float64 {
+	lat, lon := latitude*math.Pi/180, longitude*math.Pi/180
+	return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+func cellOf(v [3]float64) [3]int {
+	return [3]int{int(math.Floor(v[0] / cityCell)), int(math.Floor(v[1] / cityCell)), int(math.Floor(v[2] / cityCell))}
+}
+
+// chord is the squared straight-line distance between two points.
+func chord(a, b [3]float64) float64 {
+	x, y, z := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return x*x + y*y + z*z
+}
+
+// nearest returns the city closest to the coordinates and its distance in
+// kilometers, false when there are none. The cubes are searched in shells
+// of growing distance, until no city in the next shell can be closer. The
+// straight-line distance orders cities the same as the great-circle one.
+// Once more cubes were visited than there are cities, the rest are checked
+// one by one instead.
+func (g *cityGrid) nearest(latitude, longitude float64) (indexedCity, float64, bool) {
+	if g == nil || len(g.cities) == 0 {
+		return indexedCity{}, 0, false
+	}
+
+	v := unitVector(latitude, longitude)
+	center := cellOf(v)
+	best, closest := -1, math.Inf(1)
+	consider := func(i int) {
+		c := g.cities[i]
+		if d := chord(v, unitVector(c.latitude, c.longitude)); d < closest {
+			best, closest = i, d
+		}
+	}
+
+	visited := 0
+	for r := 0; ; r++ {
+		// Every cube of shell r is at least r-1 cubes away from the point.
+		if gap := float64(r-1) * cityCell; best >= 0 && gap > 0 && gap*gap >= closest {
+			break
+		}
+		if visited > len(g.cities) {
+			for i := range g.cities {
+				consider(i)
+			}
+			break
+		}
+		for dx := -r; dx <= r; dx++ {
+			for dy := -r; dy <= r; dy++ {
+				step := 2 * r
+				if dx == -r || dx == r || dy == -r || dy == r || r == 0 {
+					step = 1
+				}
+				for dz := -r; dz <= r; dz += step {
+					visited++
+					for _, i := range g.cells[[3]int{center[0] + dx, center[1] + dy, center[2] + dz}] {
+						consider(i)
+					}
+				}
+			}
+		}
+	}
+
+	if best < 0 {
+		return indexedCity{}, 0, false
+	}
+	c := g.cities[best]
+	return c, greatCircle(latitude, longitude, c.latitude, c.longitude), true
+}
+
+// geocode is the place nearest to some coordinates, in the vocabulary of a
+// lookup.
+type geocode struct {
+	City      string    `json:"city"`
+	Region    string    `json:"region"`
+	Country   country   `json:"country"`
+	Continent *codename `json:"continent,omitempty"`
+	Location  location  `json:"location"`
+	TimeZone  string    `json:"timezone,omitempty"`
+	Distance  float64   `json:"distance"`
+}
+
+// Geo serves /geo/{latitude},{longitude}, the nearest city of the City
+// database with its region, country and continent, and its distance in km.
+func Geo(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	coordinates := strings.Split(strings.TrimPrefix(r.URL.Path, "/geo/"), ",")
+	if len(coordinates) != 2 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+	latitude, longitude, err := parseCoordinates(coordinates[0], coordinates[1])
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	city, distance, ok := currentCities().nearest(latitude, longitude)
+	if !ok {
+		http.NotFound(w, r)
+		retval = http.StatusNotFound
+		return
+	}
+	info, _ := lookupDatabases(city.ip)
+	writeJSON(w, r, geocode{
+		City:      info.City,
+		Region:    info.Region,
+		Country:   info.Country,
+		Continent: info.Continent,
+		Location: location{
+			Latitude:  city.latitude,
+			Longitude: city.longitude,
+			Geohash:   geohash(city.latitude, city.longitude, 9),
+			PlusCode:  plusCode(city.latitude, city.longitude),
+		},
+		TimeZone: info.TimeZone,
+		Distance: math.Round(distance*10) / 10,
+	})
+	retval = http.StatusOK
+}
@@ -0,0 +1,209 @@
+package ipinfo
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// geofences are the operator's named geofences, nil without a geofence list
+var geofences map[string][]geofenceRule
+
+// geofenceRule allows or denies addresses in a set of countries or regions,
+// within a circle or inside a polygon.
+type geofenceRule struct {
+	// Index is the position of the rule in its geofence, from 1.
+	Index  int    `json:"index"`
+	Action string `json:"action"`
+	Type   string `json:"type"`
+
+	codes  map[string]bool
+	circle struct{ latitude, longitude, radius float64 }
+	// Vertices of the polygon, latitude and longitude each.
+	polygon [][2]float64
+}
+
+type geofenceResult struct {
+	Geofence string        `json:"geofence"`
+	IP       string        `json:"ip"`
+	Result   string        `json:"result"`
+	Rule     *geofenceRule `json:"rule,omitempty"`
+}
+
+// loadGeofences reads a geofence list, one "name,action,type,values..." rule
+// per line, where the action is allow or deny and the values are
+//
+//	country  ISO country codes, like DE,FR
+//	region   ISO 3166-2 codes, like US-CA,US-OR
+//	circle   latitude,longitude,radius in km
+//	polygon  three or more "latitude longitude" vertices
+//
+// The rules of a geofence are checked in order. Lines starting with # are
+// skipped.
+func loadGeofences(path string) (map[string][]geofenceRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	fences := make(map[string][]geofenceRule)
+	for i, record := range records {
+		for j := range record {
+			record[j] = strings.TrimSpace(record[j])
+		}
+		if len(record) < 4 || record[0] == "" {
+			return nil, fmt.Errorf("line %d: expected a name, action, type and values", i+1)
+		}
+		rule := geofenceRule{Index: len(fences[record[0]]) + 1, Action: record[1], Type: record[2]}
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return nil, fmt.Errorf("line %d: invalid action %q", i+1, rule.Action)
+		}
+		values := record[3:]
+
+		switch rule.Type {
+		case "country", "region":
+			rule.codes = make(map[string]bool)
+			for _, code := range values {
+				rule.codes[strings.ToUpper(code)] = true
+			}
+		case "circle":
+			if len(values) != 3 {
+				return nil, fmt.Errorf("line %d: expected latitude, longitude and radius", i+1)
+			}
+			c := &rule.circle
+			if c.latitude, c.longitude, err = parseCoordinates(values[0], values[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			if c.radius, err = strconv.ParseFloat(values[2], 64); err != nil || c.radius <= 0 {
+				return nil, fmt.Errorf("line %d: invalid radius %q", i+1, values[2])
+			}
+		case "polygon":
+			if len(values) < 3 {
+				return nil, fmt.Errorf("line %d: expected three or more vertices", i+1)
+			}
+			for _, vertex := range values {
+				point := strings.Fields(vertex)
+				if len(point) != 2 {
+					return nil, fmt.Errorf("line %d: invalid vertex %q", i+1, vertex)
+				}
+				latitude, longitude, err := parseCoordinates(point[0], point[1])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				rule.polygon = append(rule.polygon, [2]float64{latitude, longitude})
+			}
+		default:
+			return nil, fmt.Errorf("line %d: invalid type %q", i+1, rule.Type)
+		}
+		fences[record[0]] = append(fences[record[0]], rule)
+	}
+	return fences, nil
+}
+
+// parseCoordinates reads a latitude and longitude in degrees. The range
+// checks are written so that NaN, which ParseFloat accepts, fails them.
+func parseCoordinates(lat, lon string) (latitude, longitude float64, err error) {
+	latitude, err = strconv.ParseFloat(lat, 64)
+	if err != nil || !(latitude >= -90 && latitude <= 90) {
+		return 0, 0, fmt.Errorf("invalid latitude %q", lat)
+	}
+	longitude, err = strconv.ParseFloat(lon, 64)
+	if err != nil || !(longitude >= -180 && longitude <= 180) {
+		return 0, 0, fmt.Errorf("invalid longitude %q", lon)
+	}
+	return latitude, longitude, nil
+}
+
+// matches reports whether the rule covers the lookup. Circles and polygons
+// never cover an address without a location.
+func (rule *geofenceRule) matches(info ipInfo) bool {
+	switch rule.Type {
+	case "country":
+		return rule.codes[info.Country.Code]
+	case "region":
+		return rule.codes[iso31662(info.Country.Code, info.regionCode)]
+	case "circle":
+		return info.Location.known() &&
+			greatCircle(info.Location.Latitude, info.Location.Longitude, rule.circle.latitude, rule.circle.longitude) <= rule.circle.radius
+	case "polygon":
+		return info.Location.known() && insidePolygon(info.Location.Latitude, info.Location.Longitude, rule.polygon)
+	}
+	return false
+}
+
+// insidePolygon casts a ray from the point along its latitude and counts the
+// edges it crosses, treating the coordinates as a plane. That is fine for
+// fences that do not span the antimeridian or a pole.
+func insidePolygon(latitude, longitude float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a[0] > latitude) != (b[0] > latitude) &&
+			longitude < (b[1]-a[1])*(latitude-a[0])/(b[0]-a[0])+a[1] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// checkGeofence applies the first rule of the geofence covering the lookup,
+// denying when none does.
+func checkGeofence(rules []geofenceRule, info ipInfo) geofenceResult {
+	for i := range rules {
+		if rules[i].matches(info) {
+			return geofenceResult{IP: info.IP, Result: rules[i].Action, Rule: &rules[i]}
+		}
+	}
+	return geofenceResult{IP: info.IP, Result: "deny"}
+}
+
+// Geofence serves /geofence/{name}/{ip}, whether the geofence allows the
+// address and the rule that decided it.
+func Geofence(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/geofence/"), "/")
+	if len(segments) != 2 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+	rules, ok := geofences[segments[0]]
+	if !ok {
+		http.NotFound(w, r)
+		retval = http.StatusNotFound
+		return
+	}
+	ip := net.ParseIP(segments[1])
+	if ip == nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	info, _ := LookupIP(ip)
+	result := checkGeofence(rules, info)
+	result.Geofence = segments[0]
+	writeJSON(w, r, result)
+	retval = http.StatusOK
+}
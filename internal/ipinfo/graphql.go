@@ -0,0 +1,1104 @@
+package ipinfo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// GraphQL request bodies larger than this are refused.
+const graphqlMaxBody = 1 << 20
+
+// Selections, values and types nested deeper than this are refused while
+// parsing, the schema itself is only a few levels deep.
+const graphqlMaxDepth = 32
+
+// GraphQL answers queries over the lookup schema, so that clients fetch
+// exactly the fields they need for any number of addresses in one request.
+// The Query type has two fields:
+//
+//	lookup(ip: String!, locale: String): IPInfo
+//	batch(ips: [String!]!, locale: String): [IPInfo]
+//
+// IPInfo has the fields of the JSON lookup, nested objects included, plus
+// "as" with the details of the origin AS. Fields the HTTP API only fills in
+// on request, like hostname or rpki, are resolved when they are selected.
+// Queries are accepted as the query parameter of a GET or in a JSON or
+// application/graphql POST body. Fragments, mutations and introspection are
+// not supported.
+func GraphQL(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	var req struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				retval = http.StatusBadRequest
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, graphqlMaxBody))
+		if err != nil {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			retval = http.StatusRequestEntityTooLarge
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			retval = http.StatusBadRequest
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		retval = http.StatusMethodNotAllowed
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	var resp graphqlResponse
+	retval = http.StatusOK
+	op, err := parseGraphQL(req.Query, req.OperationName)
+	if err == nil {
+		err = op.validate(req.Variables)
+	}
+	if err != nil {
+		resp.Errors = []graphqlError{{Message: err.Error()}}
+		retval = http.StatusBadRequest
+	} else {
+		data := op.execute(r.Context(), start, &resp)
+		resp.Data = &data
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(retval)
+	writeJSON(w, r, resp)
+}
+
+type graphqlResponse struct {
+	Data   *graphqlObject `json:"data,omitempty"`
+	Errors []graphqlError `json:"errors,omitempty"`
+}
+
+type graphqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// graphqlObject is a result object, which keeps its fields in the order
+// they were selected as GraphQL requires.
+type graphqlObject []graphqlEntry
+
+type graphqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o graphqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, entry := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(entry.key)
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// graphqlSelection is a field of a selection set, with its arguments still
+// holding any variables.
+type graphqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	directives []graphqlDirective
+	selections []*graphqlSelection
+}
+
+type graphqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// key is the name of the field in the result.
+func (s *graphqlSelection) key() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// graphqlVariable is a $variable in an argument, replaced when executing.
+type graphqlVariable string
+
+// graphqlEnum is an enum value, which only the if of @skip and @include
+// could take and then must be true or false.
+type graphqlEnum string
+
+type graphqlVariableDefinition struct {
+	name     string
+	required bool
+	value    interface{}
+	hasValue bool
+}
+
+type graphqlOperation struct {
+	definitions []graphqlVariableDefinition
+	selections  []*graphqlSelection
+
+	// Values of the variables, with the defaults applied.
+	variables map[string]interface{}
+}
+
+// graphqlParser reads the executable subset of the GraphQL query language.
+type graphqlParser struct {
+	src  string
+	pos  int
+	kind byte // 'n'ame, 'i'nt, 'f'loat, 's'tring, 'p'unctuator or 0 at the end
+	tok  string
+	// Nesting of the selection set, value or type being read.
+	depth int
+}
+
+var (
+	errGraphQLEnd   = errors.New("syntax error: unexpected end of query")
+	errGraphQLDepth = fmt.Errorf("query is nested deeper than %d levels", graphqlMaxDepth)
+)
+
+// parseGraphQL parses query and returns the operation named name, or the
+// only one when name is empty.
+func parseGraphQL(query, name string) (*graphqlOperation, error) {
+	p := &graphqlParser{src: query}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	operations := map[string]*graphqlOperation{}
+	var only *graphqlOperation
+	for p.kind != 0 {
+		opName, op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := operations[opName]; ok {
+			return nil, fmt.Errorf("there can be only one operation named %q", opName)
+		}
+		operations[opName] = op
+		only = op
+	}
+
+	if name != "" {
+		op, ok := operations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown operation named %q", name)
+		}
+		return op, nil
+	}
+	if len(operations) != 1 {
+		return nil, errors.New("must provide operation name if query contains multiple operations")
+	}
+	return only, nil
+}
+
+func (p *graphqlParser) operation() (string, *graphqlOperation, error) {
+	op := &graphqlOperation{}
+	var name string
+	if p.kind == 'n' {
+		switch p.tok {
+		case "query":
+		case "mutation", "subscription":
+			return "", nil, fmt.Errorf("%ss are not supported", p.tok)
+		case "fragment":
+			return "", nil, errors.New("fragments are not supported")
+		default:
+			return "", nil, p.unexpected()
+		}
+		if err := p.next(); err != nil {
+			return "", nil, err
+		}
+		if p.kind == 'n' {
+			name = p.tok
+			if err := p.next(); err != nil {
+				return "", nil, err
+			}
+		}
+		if p.is("(") {
+			var err error
+			if op.definitions, err = p.variableDefinitions(); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return name, op, err
+}
+
+func (p *graphqlParser) variableDefinitions() ([]graphqlVariableDefinition, error) {
+	var definitions []graphqlVariableDefinition
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+		d := graphqlVariableDefinition{name: p.tok}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		var err error
+		if d.required, err = p.typeReference(); err != nil {
+			return nil, err
+		}
+		if p.is("=") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if d.value, err = p.value(true); err != nil {
+				return nil, err
+			}
+			d.hasValue = true
+		}
+		definitions = append(definitions, d)
+	}
+	return definitions, p.next()
+}
+
+// typeReference skips a variable type like [String!]!, returning whether
+// it is non-null. The types of values are checked when they are used.
+func (p *graphqlParser) typeReference() (bool, error) {
+	if err := p.enter(); err != nil {
+		return false, err
+	}
+	defer p.leave()
+
+	if p.is("[") {
+		if err := p.next(); err != nil {
+			return false, err
+		}
+		if _, err := p.typeReference(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if p.kind == 'n' {
+		if err := p.next(); err != nil {
+			return false, err
+		}
+	} else {
+		return false, p.unexpected()
+	}
+	if p.is("!") {
+		return true, p.next()
+	}
+	return false, nil
+}
+
+func (p *graphqlParser) selectionSet() ([]*graphqlSelection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []*graphqlSelection
+	for !p.is("}") {
+		if p.is("...") {
+			return nil, errors.New("fragments are not supported")
+		}
+		s, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	if len(selections) == 0 {
+		return nil, errors.New("syntax error: empty selection set")
+	}
+	return selections, p.next()
+}
+
+func (p *graphqlParser) field() (*graphqlSelection, error) {
+	if p.kind != 'n' {
+		return nil, p.unexpected()
+	}
+	s := &graphqlSelection{name: p.tok}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.is(":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+		s.alias, s.name = s.name, p.tok
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if s.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	for p.is("@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+		d := graphqlDirective{name: p.tok}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if d.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		s.directives = append(s.directives, d)
+	}
+	if p.is("{") {
+		if s.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *graphqlParser) arguments() (map[string]interface{}, error) {
+	if !p.is("(") {
+		return nil, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{}
+	for !p.is(")") {
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+		name := p.tok
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.value(false)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := args[name]; ok {
+			return nil, fmt.Errorf("there can be only one argument named %q", name)
+		}
+		args[name] = value
+	}
+	return args, p.next()
+}
+
+// value reads an input value. Variables are not allowed in constant ones,
+// like the defaults of variable definitions.
+func (p *graphqlParser) value(constant bool) (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	var v interface{}
+	switch {
+	case p.is("$") && !constant:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.kind != 'n' {
+			return nil, p.unexpected()
+		}
+		v = graphqlVariable(p.tok)
+	case p.is("["):
+		list := []interface{}{}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.is("]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		v = list
+	case p.is("{"):
+		object := map[string]interface{}{}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.is("}") {
+			if p.kind != 'n' {
+				return nil, p.unexpected()
+			}
+			name := p.tok
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = item
+		}
+		v = object
+	case p.kind == 's':
+		v = p.tok
+	case p.kind == 'i', p.kind == 'f':
+		v = json.Number(p.tok)
+	case p.kind == 'n':
+		switch p.tok {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = graphqlEnum(p.tok)
+		}
+	default:
+		return nil, p.unexpected()
+	}
+	return v, p.next()
+}
+
+// enter descends a level, failing past graphqlMaxDepth. Every call is paired
+// with one of leave.
+func (p *graphqlParser) enter() error {
+	p.depth++
+	if p.depth > graphqlMaxDepth {
+		return errGraphQLDepth
+	}
+	return nil
+}
+
+func (p *graphqlParser) leave() {
+	p.depth--
+}
+
+func (p *graphqlParser) is(punctuator string) bool {
+	return p.kind == 'p' && p.tok == punctuator
+}
+
+func (p *graphqlParser) expect(punctuator string) error {
+	if !p.is(punctuator) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *graphqlParser) unexpected() error {
+	if p.kind == 0 {
+		return errGraphQLEnd
+	}
+	return fmt.Errorf("syntax error: unexpected %q", p.tok)
+}
+
+// next reads the following token, skipping whitespace, commas and comments.
+func (p *graphqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' && !strings.HasPrefix(p.src[p.pos:], "\ufeff") {
+			break
+		}
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else {
+			p.pos += len("\ufeff")
+		}
+	}
+	if p.pos == len(p.src) {
+		p.kind, p.tok = 0, ""
+		return nil
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.kind = 'p'
+	case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+		p.pos++
+		p.kind = 'p'
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.src) && isGraphQLNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.kind = 'n'
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	case c == '"':
+		return p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		return fmt.Errorf("syntax error: unexpected character %q", r)
+	}
+	p.tok = p.src[start:p.pos]
+	return nil
+}
+
+func isGraphQLNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *graphqlParser) number() error {
+	start := p.pos
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+
+	p.kind = 'i'
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	if digits() == 0 {
+		return errors.New("syntax error: invalid number")
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		p.pos++
+		p.kind = 'f'
+		if digits() == 0 {
+			return errors.New("syntax error: invalid number")
+		}
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		p.kind = 'f'
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			return errors.New("syntax error: invalid number")
+		}
+	}
+	if p.pos < len(p.src) && (isGraphQLNameByte(p.src[p.pos]) || p.src[p.pos] == '.') {
+		return errors.New("syntax error: invalid number")
+	}
+	p.tok = p.src[start:p.pos]
+	return nil
+}
+
+// string reads a quoted string. Block strings are not supported.
+func (p *graphqlParser) string() error {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		return errors.New("block strings are not supported")
+	}
+	p.pos++
+
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			p.kind, p.tok = 's', b.String()
+			return nil
+		case c == '\n' || c == '\r':
+			return errors.New("syntax error: unterminated string")
+		case c == '\\':
+			if p.pos+1 >= len(p.src) {
+				return errGraphQLEnd
+			}
+			escape := p.src[p.pos+1]
+			p.pos += 2
+			switch escape {
+			case '"', '\\', '/':
+				b.WriteByte(escape)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return errGraphQLEnd
+				}
+				r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 16)
+				if err != nil {
+					return errors.New("syntax error: invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				return fmt.Errorf("syntax error: invalid escape \\%c", escape)
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return errors.New("syntax error: unterminated string")
+}
+
+// graphqlField is a field of an object type, at index in the Go struct.
+// Virtual fields have no index and are resolved from the lookup.
+type graphqlField struct {
+	index []int
+	typ   reflect.Type
+}
+
+var (
+	ipInfoType    = reflect.TypeOf(ipInfo{})
+	asnDetailType = reflect.TypeOf(asnDetail{})
+)
+
+// graphqlTypeName names the object type of a Go struct in the schema.
+func graphqlTypeName(t reflect.Type) string {
+	switch t {
+	case ipInfoType:
+		return "IPInfo"
+	case asnDetailType:
+		return "AS"
+	}
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// graphqlFields lists the fields of an object type, named like they are in
+// JSON. Fields of embedded structs are promoted like encoding/json does.
+func graphqlFields(t reflect.Type) map[string]graphqlField {
+	fields := map[string]graphqlField{}
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			idx := append(append([]int(nil), index...), i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				walk(f.Type, idx)
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.PkgPath != "" || name == "" || name == "-" {
+				continue
+			}
+			fields[name] = graphqlField{index: idx, typ: f.Type}
+		}
+	}
+	walk(t, nil)
+	if t == ipInfoType {
+		fields["as"] = graphqlField{typ: reflect.PtrTo(asnDetailType)}
+	}
+	return fields
+}
+
+// graphqlObjectType returns the struct type a field of type t resolves to,
+// through pointers and lists, or nil for a scalar.
+func graphqlObjectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		return t
+	}
+	return nil
+}
+
+// graphqlRootFields are the fields of the Query type and their arguments.
+var graphqlRootFields = map[string][]string{
+	"lookup": {"ip", "locale"},
+	"batch":  {"ips", "locale"},
+}
+
+// validate checks the operation against the schema and the variables, which
+// become the values of the operation's variables.
+func (op *graphqlOperation) validate(variables map[string]interface{}) error {
+	op.variables = map[string]interface{}{}
+	for _, d := range op.definitions {
+		value, ok := variables[d.name]
+		if !ok && d.hasValue {
+			value, ok = d.value, true
+		}
+		if (!ok || value == nil) && d.required {
+			return fmt.Errorf("variable \"$%s\" of required type was not provided", d.name)
+		}
+		if ok {
+			op.variables[d.name] = value
+		}
+	}
+
+	for _, s := range op.selections {
+		if err := op.validateDirectives(s); err != nil {
+			return err
+		}
+		if s.name == "__typename" {
+			if s.selections != nil || len(s.args) > 0 {
+				return errors.New(`field "__typename" must not have a selection or arguments`)
+			}
+			continue
+		}
+		allowed, ok := graphqlRootFields[s.name]
+		if !ok {
+			return fmt.Errorf("cannot query field %q on type \"Query\"", s.name)
+		}
+		for arg := range s.args {
+			if !containsString(allowed, arg) {
+				return fmt.Errorf("unknown argument %q on field \"Query.%s\"", arg, s.name)
+			}
+		}
+		if s.selections == nil {
+			return fmt.Errorf("field %q of type \"IPInfo\" must have a selection of subfields", s.name)
+		}
+		if err := op.validateSelections(ipInfoType, s.selections); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *graphqlOperation) validateSelections(t reflect.Type, selections []*graphqlSelection) error {
+	fields := graphqlFields(t)
+	for _, s := range selections {
+		if err := op.validateDirectives(s); err != nil {
+			return err
+		}
+		if len(s.args) > 0 {
+			return fmt.Errorf("field %q of type %q takes no arguments", s.name, graphqlTypeName(t))
+		}
+		if s.name == "__typename" {
+			if s.selections != nil {
+				return errors.New(`field "__typename" must not have a selection`)
+			}
+			continue
+		}
+		f, ok := fields[s.name]
+		if !ok {
+			return fmt.Errorf("cannot query field %q on type %q", s.name, graphqlTypeName(t))
+		}
+		object := graphqlObjectType(f.typ)
+		if object == nil && s.selections != nil {
+			return fmt.Errorf("field %q must not have a selection since it has no subfields", s.name)
+		}
+		if object != nil && s.selections == nil {
+			return fmt.Errorf("field %q of type %q must have a selection of subfields", s.name, graphqlTypeName(object))
+		}
+		if object != nil {
+			if err := op.validateSelections(object, s.selections); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (op *graphqlOperation) validateDirectives(s *graphqlSelection) error {
+	for _, d := range s.directives {
+		if d.name != "skip" && d.name != "include" {
+			return fmt.Errorf("unknown directive \"@%s\"", d.name)
+		}
+		if _, ok := op.resolve(d.args["if"]).(bool); !ok || len(d.args) != 1 {
+			return fmt.Errorf("directive \"@%s\" needs a Boolean argument \"if\"", d.name)
+		}
+	}
+	return nil
+}
+
+// included applies the @skip and @include directives of s.
+func (op *graphqlOperation) included(s *graphqlSelection) bool {
+	for _, d := range s.directives {
+		if op.resolve(d.args["if"]).(bool) != (d.name == "include") {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve replaces the variables in an argument value with their values.
+func (op *graphqlOperation) resolve(v interface{}) interface{} {
+	switch v := v.(type) {
+	case graphqlVariable:
+		return op.variables[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = op.resolve(item)
+		}
+		return list
+	}
+	return v
+}
+
+// execute resolves the root fields of the operation. Addresses that cannot
+// be looked up are null in the data, with an error at their path.
+func (op *graphqlOperation) execute(ctx context.Context, start time.Time, resp *graphqlResponse) graphqlObject {
+	fail := func(message string, path ...interface{}) {
+		resp.Errors = append(resp.Errors, graphqlError{Message: message, Path: path})
+	}
+
+	// Every address counts against the batch limit, however the query
+	// spreads them over aliases.
+	budget := *BatchLimit
+
+	data := graphqlObject{}
+	for _, s := range op.selections {
+		if !op.included(s) {
+			continue
+		}
+		key := s.key()
+		if s.name == "__typename" {
+			data = append(data, graphqlEntry{key, "Query"})
+			continue
+		}
+
+		var locales []string
+		if locale, ok := op.resolve(s.args["locale"]).(string); ok && locale != "" {
+			if locale = matchLanguage(locale, nameLocales); locale != "" {
+				locales = append(locales, locale)
+			}
+			locales = append(locales, "en")
+		}
+
+		var queries []string
+		single := s.name == "lookup"
+		if single {
+			ip, ok := op.resolve(s.args["ip"]).(string)
+			if !ok {
+				fail(`argument "ip" of type "String!" is required`, key)
+				data = append(data, graphqlEntry{key, nil})
+				continue
+			}
+			queries = []string{ip}
+		} else {
+			list, ok := op.resolve(s.args["ips"]).([]interface{})
+			if ip, isString := op.resolve(s.args["ips"]).(string); isString {
+				list, ok = []interface{}{ip}, true
+			}
+			for _, item := range list {
+				ip, isString := item.(string)
+				if !isString {
+					ok = false
+					break
+				}
+				queries = append(queries, ip)
+			}
+			if !ok {
+				fail(`argument "ips" of type "[String!]!" is required`, key)
+				data = append(data, graphqlEntry{key, nil})
+				continue
+			}
+		}
+		if len(queries) > budget {
+			fail(errBatchLimit.Error(), key)
+			data = append(data, graphqlEntry{key, nil})
+			continue
+		}
+		budget -= len(queries)
+
+		results := make([]interface{}, len(queries))
+		for i, result := range lookupBatch(queries) {
+			if result.err != nil {
+				if single {
+					fail(result.err.Error(), key)
+				} else {
+					fail(result.err.Error(), key, i)
+				}
+				continue
+			}
+			info := result.info
+			if len(locales) > 0 {
+				info.localize(locales...)
+			}
+			ip := net.ParseIP(strings.TrimSpace(result.query))
+			op.fill(ctx, start, ip, &info, s.selections, locales)
+			results[i] = op.object(reflect.ValueOf(info), s.selections)
+		}
+		if single {
+			data = append(data, graphqlEntry{key, results[0]})
+		} else {
+			data = append(data, graphqlEntry{key, results})
+		}
+	}
+	return data
+}
+
+// fill resolves the fields of a lookup that are only looked up on request,
+// when they are selected.
+func (op *graphqlOperation) fill(ctx context.Context, start time.Time, ip net.IP, info *ipInfo, selections []*graphqlSelection, locales []string) {
+	selected := map[string]bool{}
+	for _, s := range selections {
+		if op.included(s) {
+			selected[s.name] = true
+		}
+	}
+
+	if selected["hostname"] || selected["forward_confirmed"] {
+		info.Hostname = reverseLookup(ctx, ip)
+		if info.Hostname != "" && selected["forward_confirmed"] {
+			if confirmed, err := forwardConfirmed(ctx, info.Hostname, ip); err == nil {
+				info.ForwardConfirmed = &confirmed
+			}
+		}
+	}
+	if selected["subdivisions"] {
+		info.setSubdivisions(lookupSubdivisions(ip, locales...))
+	}
+	info.addNames()
+	if selected["result_network"] {
+		if n := resultNetwork(ip); n != nil {
+			info.ResultNetwork = n.String()
+		}
+	}
+	if selected["network"] {
+		if n := matchedNetwork(ip); n != nil {
+			info.Network = n.String()
+		}
+	}
+	if selected["population"] {
+		info.Population = populations[info.cityGeoNameID]
+	}
+	if selected["airport"] && info.Location.known() {
+		info.Airport = closestAirport(info.Location.Latitude, info.Location.Longitude)
+	}
+	if selected["pop"] && info.Location.known() {
+		info.PoP = closestPoP(info.Location.Latitude, info.Location.Longitude)
+	}
+	if selected["queried_at"] {
+		info.QueriedAt = start.UTC().Format(time.RFC3339)
+	}
+	if selected["local_time"] && info.TimeZone != "" {
+		info.LocalTime = localTime(info.TimeZone, start)
+	}
+	if selected["as_string"] {
+		info.ASString = asString(info.ASN)
+	}
+	if selected["rpki"] {
+		info.RPKI = rpkiState(ctx, ip, info.ASN)
+	}
+}
+
+// object projects the struct v onto the selected fields.
+func (op *graphqlOperation) object(v reflect.Value, selections []*graphqlSelection) graphqlObject {
+	fields := graphqlFields(v.Type())
+	o := graphqlObject{}
+	for _, s := range selections {
+		if !op.included(s) {
+			continue
+		}
+		if s.name == "__typename" {
+			o = append(o, graphqlEntry{s.key(), graphqlTypeName(v.Type())})
+			continue
+		}
+
+		f := fields[s.name]
+		var value reflect.Value
+		if f.index != nil {
+			value = v.FieldByIndex(f.index)
+		} else if info, ok := v.Interface().(ipInfo); ok && s.name == "as" {
+			value = reflect.ValueOf((*asnDetail)(nil))
+			if detail, found := lookupASN(info.ASN); found {
+				value = reflect.ValueOf(&detail)
+			}
+		}
+		o = append(o, graphqlEntry{s.key(), op.value(value, s.selections)})
+	}
+	return o
+}
+
+// value is the result of a field, projected onto its selections when it is
+// an object or a list of them.
+func (op *graphqlOperation) value(v reflect.Value, selections []*graphqlSelection) interface{} {
+	if selections == nil {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return op.value(v.Elem(), selections)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = op.value(v.Index(i), selections)
+		}
+		return list
+	}
+	return op.object(v, selections)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,362 @@
+package ipinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Status codes of the gRPC protocol that the lookup service answers with.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+)
+
+// Requests larger than this are refused, like grpc-go does by default.
+const grpcMaxMessage = 4 << 20
+
+// grpcError is a failed call, answered in the grpc-status trailers.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e grpcError) Error() string {
+	return e.message
+}
+
+// grpcMethods are the calls of the IPInfo service in proto/ipinfo.proto,
+// by request path.
+var grpcMethods = map[string]func(req []byte) ([]byte, error){
+	"/ipinfo.v1.IPInfo/Lookup":      grpcLookup,
+	"/ipinfo.v1.IPInfo/BatchLookup": grpcBatchLookup,
+}
+
+// ServeGRPC serves the gRPC lookup service on addr. The standard library only
+// speaks HTTP/2 over TLS, which gRPC requires, so a certificate is needed. It
+// only returns when the listener fails.
+func ServeGRPC(addr, certFile, keyFile string) error {
+	log.Info().Msg("gRPC listening on " + addr)
+	server := &http.Server{Addr: addr, Handler: GRPCHandler()}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// GRPCHandler answers unary calls of the IPInfo service. Messages are framed
+// as the gRPC protocol over HTTP/2 defines, uncompressed, and the outcome is
+// sent in the grpc-status and grpc-message trailers.
+func GRPCHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		code := grpcOK
+
+		defer func() {
+			dur := milliseconds(time.Since(start))
+
+			duration.WithLabelValues("grpc", strconv.Itoa(code)).Observe(dur)
+			log.Info().
+				Float64("duration", dur).
+				Str("method", r.URL.Path).
+				Str("remote", defangIP(r.RemoteAddr)).
+				Int("grpc_status", code).
+				Msg("")
+		}()
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			code = grpcUnimplemented
+			return
+		}
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			code = grpcInvalidArgument
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+
+		reply, err := grpcCall(r)
+		if err == nil {
+			_, err = w.Write(grpcFrame(reply))
+		}
+		if err != nil {
+			ge, ok := err.(grpcError)
+			if !ok {
+				ge = grpcError{grpcInternal, err.Error()}
+			}
+			code = ge.code
+			w.Header().Set("Grpc-Message", grpcEscape(ge.message))
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	})
+}
+
+// grpcCall reads the request message of r and runs the method it names.
+func grpcCall(r *http.Request) ([]byte, error) {
+	method, ok := grpcMethods[r.URL.Path]
+	if !ok {
+		return nil, grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(r.Body, header[:]); err != nil {
+		return nil, grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if header[0] != 0 {
+		return nil, grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcError{grpcResourceExhausted, "request message too large"}
+	}
+	req := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, req); err != nil {
+		return nil, grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	if n, _ := io.Copy(ioutil.Discard, io.LimitReader(r.Body, 1)); n != 0 {
+		return nil, grpcError{grpcUnimplemented, "streaming requests are not supported"}
+	}
+
+	return method(req)
+}
+
+// grpcFrame prefixes msg with the uncompressed flag and its length.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcEscape percent-encodes a status message as the protocol requires.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// grpcLookup answers a LookupRequest with a LookupReply.
+func grpcLookup(req []byte) ([]byte, error) {
+	var query string
+	err := protoFields(req, func(field int, value uint64, data []byte) {
+		if field == 1 {
+			query = string(data)
+		}
+	})
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(query))
+	if ip == nil {
+		return nil, grpcError{grpcInvalidArgument, errInvalidIP.Error()}
+	}
+	info, err := LookupIP(ip)
+	if err != nil {
+		return nil, grpcError{grpcInternal, err.Error()}
+	}
+	return protoLookupReply(withNetwork(info, ip)), nil
+}
+
+// grpcBatchLookup answers a BatchLookupRequest with a BatchLookupReply, with
+// a result for every address in the order they were given.
+func grpcBatchLookup(req []byte) ([]byte, error) {
+	var queries []string
+	err := protoFields(req, func(field int, value uint64, data []byte) {
+		if field == 1 {
+			queries = append(queries, string(data))
+		}
+	})
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if len(queries) > *BatchLimit {
+		return nil, grpcError{grpcResourceExhausted, errBatchLimit.Error()}
+	}
+
+	var reply protoBuffer
+	for _, result := range lookupBatch(queries) {
+		var entry protoBuffer
+		entry.string(1, result.query)
+		if result.err != nil {
+			entry.string(3, result.err.Error())
+		} else {
+			entry.bytes(2, protoLookupReply(withNetwork(result.info, net.ParseIP(result.info.IP))))
+		}
+		reply.bytes(1, entry.b)
+	}
+	return reply.b, nil
+}
+
+// withNetwork fills in the networks of ip, which a LookupReply always
+// carries while HTTP lookups only add them on request.
+func withNetwork(info ipInfo, ip net.IP) ipInfo {
+	if ip == nil {
+		return info
+	}
+	if n := resultNetwork(ip); n != nil {
+		info.ResultNetwork = n.String()
+	}
+	if n := matchedNetwork(ip); n != nil {
+		info.Network = n.String()
+	}
+	return info
+}
+
+// protoLookupReply encodes the fields of info that LookupReply carries.
+func protoLookupReply(info ipInfo) []byte {
+	var p protoBuffer
+	p.string(1, info.IP)
+	p.string(2, info.City)
+	p.string(3, info.Region)
+	p.string(4, info.Country.Code)
+	p.string(5, info.Country.Name)
+	if info.Continent != nil {
+		p.string(6, info.Continent.Code)
+		p.string(7, info.Continent.Name)
+	}
+	p.double(8, info.Location.Latitude)
+	p.double(9, info.Location.Longitude)
+	p.uint(10, uint64(info.Location.AccuracyRadius))
+	p.string(11, info.TimeZone)
+	if info.Postal != nil {
+		p.string(12, *info.Postal)
+	}
+	p.uint(13, uint64(info.ASN))
+	p.string(14, info.Organization)
+	p.bool(15, info.Bogon)
+	p.string(16, info.Type)
+	p.string(17, info.ResultNetwork)
+	p.string(18, info.Network)
+	return p.b
+}
+
+// Wire types of the protobuf encoding.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// protoBuffer writes a protobuf message. Like proto3, fields holding their
+// zero value are left out.
+type protoBuffer struct {
+	b []byte
+}
+
+func (p *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		p.b = append(p.b, byte(v)|0x80)
+		v >>= 7
+	}
+	p.b = append(p.b, byte(v))
+}
+
+func (p *protoBuffer) tag(field, wireType int) {
+	p.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (p *protoBuffer) uint(field int, v uint64) {
+	if v != 0 {
+		p.tag(field, protoVarint)
+		p.varint(v)
+	}
+}
+
+func (p *protoBuffer) bool(field int, v bool) {
+	if v {
+		p.uint(field, 1)
+	}
+}
+
+func (p *protoBuffer) double(field int, v float64) {
+	if v != 0 {
+		p.tag(field, protoFixed64)
+		p.b = append(p.b, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(p.b[len(p.b)-8:], math.Float64bits(v))
+	}
+}
+
+func (p *protoBuffer) string(field int, v string) {
+	if v != "" {
+		p.tag(field, protoBytes)
+		p.varint(uint64(len(v)))
+		p.b = append(p.b, v...)
+	}
+}
+
+// bytes writes an embedded message or bytes field, even when empty so that
+// repeated entries keep their position.
+func (p *protoBuffer) bytes(field int, v []byte) {
+	p.tag(field, protoBytes)
+	p.varint(uint64(len(v)))
+	p.b = append(p.b, v...)
+}
+
+// protoFields calls fn with every field of the protobuf message b, in order.
+// Varints are passed as value, length-delimited fields as data, and fixed
+// size fields are skipped.
+func protoFields(b []byte, fn func(field int, value uint64, data []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case protoVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+			fn(field, v, nil)
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errProtoTruncated
+			}
+			fn(field, 0, b[n:n+int(size)])
+			b = b[n+int(size):]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			b = b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			b = b[4:]
+		default:
+			return errors.New("unsupported protobuf wire type " + strconv.FormatUint(key&7, 10))
+		}
+	}
+	return nil
+}
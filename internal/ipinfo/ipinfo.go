@@ -1,7 +1,10 @@
 package ipinfo
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"io"
 	"net"
 	"net/http"
 	"regexp"
@@ -10,6 +13,7 @@ import (
 	"time"
 
 	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
 	"github.com/rs/zerolog/log"
 )
 
@@ -17,44 +21,263 @@ import (
 var dbCity *geoip2.Reader
 var dbASN *geoip2.Reader
 
+// The optional Enterprise database, only used for subdivision confidence
+var dbEnterprise *geoip2.Reader
+var dbAnonymous *geoip2.Reader
+var dbISP *geoip2.Reader
+var dbDomain *geoip2.Reader
+var dbConnectionType *geoip2.Reader
+
+// The same databases, for finding the network an address was matched in
+var netCity *maxminddb.Reader
+var netASN *maxminddb.Reader
+
+// devIP replaces private self-resolved addresses when DevIP is set
+var devIP net.IP
+
 // https://github.com/multiverse-os/ip/blob/1c436abe71f332ef3d2342c7a08a8ad25ae379b9/records.go
 
+// codename is a place by code and name, with its name in every locale when
+// asked for.
 type codename struct {
-	Code string `json:"code"`
-	Name string `json:"name"`
+	Code  string            `json:"code"`
+	Name  string            `json:"name"`
+	Names map[string]string `json:"names,omitempty"`
 }
 
+// country is the country codename, whether it is in the European Union, its
+// flag, and its currency and calling code from countryFacts.
+type country struct {
+	codename
+	IsEU        bool   `json:"is_eu,omitempty"`
+	Flag        string `json:"flag,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+	CallingCode string `json:"calling_code,omitempty"`
+}
+
+// flagEmoji spells a country code in regional indicator symbols, which
+// render as the country's flag. Anything but two letters has no flag.
+func flagEmoji(code string) string {
+	if len(code) != 2 {
+		return ""
+	}
+	flag := make([]rune, 2)
+	for i := range flag {
+		c := code[i]
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+		flag[i] = 0x1F1E6 + rune(c-'A')
+	}
+	return string(flag)
+}
+
+// countryFact is what a country code implies, rather than what a database
+// says.
+type countryFact struct {
+	currency    string
+	callingCode string
+}
+
+// location is where the address is, within AccuracyRadius kilometers.
 type location struct {
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	Latitude       float64    `json:"latitude"`
+	Longitude      float64    `json:"longitude"`
+	AccuracyRadius uint16     `json:"accuracy_radius,omitempty"`
+	MetroCode      uint       `json:"metro_code,omitempty"`
+	Geohash        string     `json:"geohash,omitempty"`
+	PlusCode       string     `json:"plus_code,omitempty"`
+	Projected      *projected `json:"projected,omitempty"`
+	Note           string     `json:"note,omitempty"`
+}
+
+// known reports whether the database had coordinates for the address.
+func (l location) known() bool {
+	return l.Latitude != 0 || l.Longitude != 0
 }
 
 type ipInfo struct {
-	IP           string   `json:"ip"`
-	City         string   `json:"city"`
-	Region       string   `json:"region"`
-	Country      codename `json:"country"`
-	Continent    codename `json:"continent"`
-	Location     location `json:"location"`
-	Postal       string   `json:"postal"`
-	ASN          uint     `json:"asn"`
-	Organization string   `json:"organization"`
+	IP               string            `json:"ip"`
+	ResolvedFrom     string            `json:"resolved_from,omitempty"`
+	Hostname         string            `json:"hostname,omitempty"`
+	ForwardConfirmed *bool             `json:"forward_confirmed,omitempty"`
+	City             string            `json:"city"`
+	CityNames        map[string]string `json:"city_names,omitempty"`
+	Region           string            `json:"region"`
+	Subdivisions     []subdivision     `json:"subdivisions,omitempty"`
+	Country          country           `json:"country"`
+	Continent        *codename         `json:"continent,omitempty"`
+	Location         location          `json:"location"`
+	TimeZone         string            `json:"timezone,omitempty"`
+	LocalTime        string            `json:"local_time,omitempty"`
+	Postal           *string           `json:"postal,omitempty"`
+	ASN              uint              `json:"asn"`
+	ASString         string            `json:"as_string,omitempty"`
+	RPKI             string            `json:"rpki,omitempty"`
+	Organization     string            `json:"organization"`
+	ISP              string            `json:"isp,omitempty"`
+	Domain           string            `json:"domain,omitempty"`
+	ConnectionType   string            `json:"connection_type,omitempty"`
+	Privacy          *privacy          `json:"privacy,omitempty"`
+	Tor              *bool             `json:"tor,omitempty"`
+	Cloud            *cloud            `json:"cloud,omitempty"`
+	IsDatacenter     bool              `json:"is_datacenter,omitempty"`
+	Airport          *nearestAirport   `json:"airport,omitempty"`
+	PoP              *nearestPoP       `json:"pop,omitempty"`
+	ResultNetwork    string            `json:"result_network,omitempty"`
+	Network          string            `json:"network,omitempty"`
+	MAC              string            `json:"mac,omitempty"`
+	NameSources      map[string]string `json:"name_sources,omitempty"`
+	QueriedAt        string            `json:"queried_at,omitempty"`
+	InRange          *bool             `json:"in_range,omitempty"`
+	Anycast          bool              `json:"anycast,omitempty"`
+	Bogon            bool              `json:"bogon,omitempty"`
+	Type             string            `json:"type,omitempty"`
+	Population       uint64            `json:"population,omitempty"`
+
+	// GeoNames ID of the city, for joining other datasets.
+	cityGeoNameID uint
+	// Names of the places in every locale, to localize the lookup per request.
+	places struct{ city, region, country, continent place }
+	// ISO code of the region, for the compatible formats.
+	regionCode string
 }
 
 // Initialize the database from a working directory (should have trailing slash)
 func Initialize(workDir string) {
+	InitializeWithConfig(ConfigFromFlags(workDir))
+}
+
+// InitializeWithConfig opens the databases and sets the service up as cfg
+// says. The handlers read their options from the package's flag variables,
+// so it writes cfg into those: the configuration is process-wide, a later
+// call replaces the settings of an earlier one, and it is not safe to call
+// concurrently with another call or with requests in flight.
+func InitializeWithConfig(cfg Config) {
 	var err error
 
-	dbCity, err = geoip2.Open(workDir + "GeoLite2-City.mmdb")
+	cfg.apply()
+	if *DBLoadMode != loadModeMmap && *DBLoadMode != loadModeMemory {
+		log.Fatal().Str("mode", *DBLoadMode).Msg("Unknown database load mode, cannot continue")
+	}
+
+	initializeUpdater()
+
+	loadErrors = map[string]error{}
+	reloadedAt = time.Now()
+
+	dbCity, netCity, err = openDatabase(cfg.CityDB)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to open City database, cannot continue")
 	}
+	cityIndex = indexCities(netCity)
 
-	dbASN, err = geoip2.Open(workDir + "GeoLite2-ASN.mmdb")
-	if err != nil {
-		log.Warn().Err(err).Msg("Unable to open ASN database, lookups will not have ASN or Organization info")
+	dbASN, netASN, asnNames = nil, nil, nil
+	if cfg.ASNDB != "" {
+		dbASN, netASN, err = openDatabase(cfg.ASNDB)
+		setLoadError(cfg.ASNDB, err)
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to open ASN database, lookups will not have ASN or Organization info")
+		}
+		asnNames = indexASNs(netASN)
+	}
+
+	asnRanges = nil
+	if cfg.IPToASN != "" {
+		asnRanges, err = loadASNRanges(cfg.IPToASN)
+		if err != nil {
+			log.Warn().Err(err).Str("path", cfg.IPToASN).Msg("Unable to load iptoasn.com dump")
+		} else {
+			log.Info().Int("ranges", len(asnRanges)).Msg("Loaded iptoasn.com dump, used without an ASN database")
+		}
+	}
+	asnRangesByASN = indexASNRanges(asnRanges)
+
+	dbLayers = openLayers(cfg.Layers)
+	for _, o := range optionalDatabases(cfg) {
+		*o.reader = openOptionalDatabase(o.path, o.name, o.adds)
+	}
+
+	populations, placeNames = nil, nil
+	if cfg.GeoNames != "" {
+		populations, err = loadPopulations(cfg.GeoNames)
+		if err != nil {
+			log.Warn().Err(err).Msg("Unable to load city populations, lookups will not have population info")
+		} else {
+			log.Info().Int("cities", len(populations)).Msg("Loaded city populations")
+		}
+		if cfg.GeoNamesNames {
+			placeNames, err = loadPlaceNames(cfg.GeoNames)
+			if err != nil {
+				log.Warn().Err(err).Msg("Unable to load place names, places without names will stay blank")
+			} else {
+				log.Info().Int("places", len(placeNames)).Msg("Loaded place names")
+			}
+		}
+	}
+
+	pops = nil
+	if cfg.PoPs != "" {
+		pops, err = loadPoPs(cfg.PoPs)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.PoPs).Msg("Unable to load PoP list, cannot continue")
+		}
+		log.Info().Int("pops", len(pops)).Msg("Loaded PoP list")
+	}
+
+	datacenterASNs = defaultDatacenterASNs
+	if cfg.DatacenterASNs != "" {
+		datacenterASNs, err = loadDatacenterASNs(cfg.DatacenterASNs)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.DatacenterASNs).Msg("Unable to load datacenter ASN list, cannot continue")
+		}
+		log.Info().Int("asns", len(datacenterASNs)).Msg("Loaded datacenter ASN list")
+	}
+
+	geofences = nil
+	if cfg.Geofences != "" {
+		geofences, err = loadGeofences(cfg.Geofences)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.Geofences).Msg("Unable to load geofence list, cannot continue")
+		}
+		log.Info().Int("geofences", len(geofences)).Msg("Loaded geofence list")
 	}
 
+	overrides = nil
+	if cfg.Overrides != "" {
+		overrides, err = loadOverrides(cfg.Overrides)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.Overrides).Msg("Unable to load override list, cannot continue")
+		}
+		log.Info().Int("overrides", len(overrides)).Msg("Loaded override list")
+	}
+
+	devIP = nil
+	if *DevIP != "" {
+		devIP = net.ParseIP(*DevIP)
+		if devIP == nil {
+			log.Fatal().Str("devip", *DevIP).Msg("Unable to parse development fallback IP, cannot continue")
+		}
+		log.Warn().Str("devip", devIP.String()).Msg("Development mode, private self lookups will use the fallback IP")
+	}
+
+	initializeResolver()
+	initializeClientIP()
+	initializeLimiter()
+	initializeWebhook()
+	initializeServerIP()
+	initializeTorExits()
+	initializeCloudRanges()
+	initializeCache()
+	initializeHostnames()
+	initializeRPKI()
+	initializeWatcher()
+
+	workers := *BatchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	batchSlots = make(chan struct{}, workers)
 }
 
 // Lookup the IP Address within the request.
@@ -62,59 +285,636 @@ func Lookup(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	retval := http.StatusTeapot
 
-	var IPAddress string
+	var IPAddress, format string
 	var ipinfo ipInfo
+	var self bool
 
 	defer func() {
-		// Get the current time, so that we can then calculate the execution time.
-		dur := float64(float64(time.Since(start).Nanoseconds()) / 1000000)
-
-		duration.WithLabelValues(strconv.Itoa(retval)).Observe(dur)
+		dur := observeDuration(r, time.Since(start), retval)
+		publishLookup(lookupEvent{
+			Time:     start.UTC().Format(time.RFC3339),
+			IP:       ipinfo.IP,
+			Country:  ipinfo.Country.Code,
+			ASN:      ipinfo.ASN,
+			Status:   retval,
+			Duration: dur,
+		})
 		// Log how much time it took to respond to the request, when we're done.
-		log.Info().
-			Float64("duration", dur).
-			Str("ipaddress", ipinfo.IP).
-			Str("method", r.Method).
-			Str("remote", defangIP(r.RemoteAddr)).
-			Str("url", r.URL.EscapedPath()).
-			Int("status", retval).
-			Msg("")
+		event := accessLog(r, dur, retval).Str("ipaddress", ipinfo.IP)
+		if *LogOrganization && ipinfo.Organization != "" {
+			event = event.Str("organization", truncate(ipinfo.Organization, maxLoggedOrganization))
+		}
+		if *LogOrganization && ipinfo.ISP != "" {
+			event = event.Str("isp", truncate(ipinfo.ISP, maxLoggedOrganization))
+		}
+		event.Msg("")
 	}()
 
+	// Comma-separated addresses are looked up together, each entry held to
+	// the same length as a single address.
+	if segment, _ := parsePath(r.URL.Path); strings.Contains(segment, ",") {
+		queries := strings.Split(segment, ",")
+		if len(queries) > *BatchLimit || len(r.URL.Path) > 46*len(queries) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			retval = http.StatusForbidden
+			return
+		}
+		retval = lookupMany(w, r, queries)
+		return
+	}
+
+	// Hostnames, in the path or as /lookup?host=, are resolved and each of
+	// their addresses looked up.
+	if segment, _ := parsePath(r.URL.Path); *HostnameLookups && (segment == "lookup" || isHostname(segment)) {
+		host := segment
+		if segment == "lookup" {
+			host = r.URL.Query().Get("host")
+		}
+		retval = lookupHost(w, r, host)
+		return
+	}
+
 	// IP addresses will never be longer than 46 characters
 	// IPv4 = 255.255.255.255 (slash + 15 characters)
 	// IPv6 = ABCD:ABCD:ABCD:ABCD:ABCD:ABCD:ABCD:ABCD (slash + 39 characters)
 	// IPv4-mapped IPv6 = ABCD:ABCD:ABCD:ABCD:ABCD:ABCD:192.168.158.190 (slash + 45 characters)
-	if len(r.URL.Path) > 46 {
+	// Networks add a prefix length of up to 128 (slash + 3 characters)
+	path, ipAPI := ipAPIPath(r.URL.Path)
+	if len(path) > 50 {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		retval = http.StatusForbidden
 		return
 	}
 
-	IPAddress = strings.Split(r.URL.Path, "/")[1]
+	IPAddress, format = parsePath(path)
+	if f := r.URL.Query().Get("format"); f != "" {
+		format = f
+	}
+	if format == "" {
+		addVary(w, "Accept")
+		format = negotiateFormat(r.Header.Get("Accept"))
+	}
+	if ipAPI {
+		format = "ip-api"
+	}
+	// Names are in the lang parameter's locale, falling back to English, or
+	// else in the one Accept-Language prefers.
+	var locales []string
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		if locale := matchLanguage(lang, nameLocales); locale != "" {
+			locales = append(locales, locale)
+		}
+		locales = append(locales, "en")
+	} else {
+		addVary(w, "Accept-Language")
+		if locale := negotiateLanguage(r.Header.Get("Accept-Language"), nameLocales, ""); locale != "" {
+			locales = append(locales, locale)
+		}
+	}
 
 	// Set the requested IP to the user's request request IP, if we got no address.
 	if IPAddress == "" || IPAddress == "self" || IPAddress == "me" {
+		self = true
 		// The request is most likely being done through a reverse proxy.
-		if realIP, ok := r.Header["X-Real-Ip"]; ok && len(r.Header["X-Real-Ip"]) > 0 {
-			IPAddress = realIP[0]
-		} else {
-			// Get the real actual request IP without the trolls
-			IPAddress = defangIP(r.RemoteAddr)
-		}
+		addVary(w, clientHeaders()...)
+		IPAddress = clientIP(r)
 	}
 
 	ip := net.ParseIP(IPAddress)
+	// A network is looked up by its first address, along with the network
+	// the databases matched, over which the record holds.
+	var network *net.IPNet
+	if _, n, err := net.ParseCIDR(IPAddress); err == nil {
+		ip, network = n.IP, n
+	}
+	if ip == nil && format == "ip-api" {
+		writeJSON(w, r, ipAPIFailure(IPAddress, "invalid query"))
+		retval = http.StatusOK
+		return
+	}
 	if ip == nil {
 		http.Error(w, "Unprocessable Entity", http.StatusUnprocessableEntity)
 		retval = http.StatusUnprocessableEntity
 		return
 	}
 
+	// Private addresses have no geo data, which makes local development painful.
+	if self && devIP != nil && isPrivateIP(ip) {
+		ip = devIP
+	}
+
+	var project func(latitude, longitude float64) projected
+	if proj := r.URL.Query().Get("proj"); proj != "" {
+		var ok bool
+		if project, ok = projection(proj); !ok {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			retval = http.StatusBadRequest
+			return
+		}
+	}
+
+	countryNames := r.URL.Query().Get("country_names")
+	if countryNames != "" && countryNames != "all" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	var inRange *net.IPNet
+	if cidr := r.URL.Query().Get("in"); cidr != "" {
+		var err error
+		if _, inRange, err = net.ParseCIDR(cidr); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			retval = http.StatusBadRequest
+			return
+		}
+	}
+
+	ipinfo, _ = LookupIP(ip)
+	if len(locales) > 0 {
+		ipinfo.localize(locales...)
+	}
+
+	if countryNames == "all" {
+		ipinfo.Country.Names = ipinfo.places.country.names
+	}
+
+	if inRange != nil {
+		contains := inRange.Contains(ip)
+		ipinfo.InRange = &contains
+	}
+
+	if project != nil && ipinfo.Location.known() {
+		p := project(ipinfo.Location.Latitude, ipinfo.Location.Longitude)
+		ipinfo.Location.Projected = &p
+	}
+
+	// ipinfo.io always includes the hostname.
+	if r.URL.Query().Get("reverse") == "1" || r.URL.Query().Get("hostname") == "1" || *ReverseDNS || format == "ipinfo" {
+		ipinfo.Hostname = reverseLookup(r.Context(), ip)
+		if ipinfo.Hostname != "" && r.URL.Query().Get("fcrdns") == "1" {
+			if confirmed, err := forwardConfirmed(r.Context(), ipinfo.Hostname, ip); err == nil {
+				ipinfo.ForwardConfirmed = &confirmed
+			}
+		}
+	}
+
+	// region only names the first level, subdivisions has them all.
+	if r.URL.Query().Get("subdivisions") != "0" {
+		ipinfo.setSubdivisions(lookupSubdivisions(ip, locales...))
+	}
+
+	if r.URL.Query().Get("all_names") == "1" {
+		ipinfo.addNames()
+	}
+
+	if network != nil {
+		ipinfo.IP = network.String()
+	}
+
+	if r.URL.Query().Get("network") == "1" || network != nil {
+		if n := resultNetwork(ip); n != nil {
+			ipinfo.ResultNetwork = n.String()
+		}
+		if n := matchedNetwork(ip); n != nil {
+			ipinfo.Network = n.String()
+		}
+	}
+
+	if r.URL.Query().Get("population") == "1" {
+		ipinfo.Population = populations[ipinfo.cityGeoNameID]
+	}
+
+	if r.URL.Query().Get("airport") == "1" && ipinfo.Location.known() {
+		ipinfo.Airport = closestAirport(ipinfo.Location.Latitude, ipinfo.Location.Longitude)
+	}
+
+	if r.URL.Query().Get("pop") == "1" && ipinfo.Location.known() {
+		ipinfo.PoP = closestPoP(ipinfo.Location.Latitude, ipinfo.Location.Longitude)
+	}
+
+	if r.URL.Query().Get("timestamp") == "1" {
+		ipinfo.QueriedAt = start.UTC().Format(time.RFC3339)
+	}
+
+	if r.URL.Query().Get("localtime") == "1" && ipinfo.TimeZone != "" {
+		ipinfo.LocalTime = localTime(ipinfo.TimeZone, start)
+	}
+
+	if r.URL.Query().Get("as_string") == "1" {
+		ipinfo.ASString = asString(ipinfo.ASN)
+	}
+
+	if r.URL.Query().Get("rpki") == "1" {
+		ipinfo.RPKI = rpkiState(r.Context(), ip, ipinfo.ASN)
+	}
+
+	if format == "ip-api" {
+		switch {
+		case isPrivateIP(ip):
+			writeJSON(w, r, ipAPIFailure(ipinfo.IP, "private range"))
+		case ipinfo.Bogon:
+			writeJSON(w, r, ipAPIFailure(ipinfo.IP, "reserved range"))
+		default:
+			writeJSON(w, r, toIPAPI(ipinfo))
+		}
+		retval = http.StatusOK
+		return
+	}
+
+	if format == "ipinfo" {
+		writeJSON(w, r, toIPInfoIO(ipinfo))
+		retval = http.StatusOK
+		return
+	}
+
+	if format == "xml" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		writeXML(w, "ipinfo", selectOutput(r, ipinfo), r.URL.Query().Get("pretty") == "1")
+		retval = http.StatusOK
+		return
+	}
+
+	if format == "geojson" {
+		w.Header().Set("Content-Type", "application/geo+json")
+		writeJSON(w, r, toGeoJSON(ipinfo, selectOutput(r, ipinfo)))
+		retval = http.StatusOK
+		return
+	}
+
+	if format == "yaml" || format == "text" {
+		if format == "yaml" {
+			w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		writeYAML(w, selectOutput(r, ipinfo))
+		retval = http.StatusOK
+		return
+	}
+
+	if format == "msgpack" || format == "cbor" {
+		w.Header().Set("Content-Type", "application/"+format)
+		w.Write(encodePacked(format, selectOutput(r, ipinfo)))
+		retval = http.StatusOK
+		return
+	}
+
+	if text, ok := textFields[format]; ok {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, text(ipinfo)+"\n")
+		retval = http.StatusOK
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		out := csv.NewWriter(w)
+		out.Write(csvHeader)
+		out.Write(csvRecord(batchResult{query: IPAddress, info: ipinfo}))
+		out.Flush()
+		retval = http.StatusOK
+		return
+	}
+
+	// Since we don't have HTML output, nor other data from geo data,
+	// everything else is the same if you do /8.8.8.8, /8.8.8.8/json or /8.8.8.8/geo.
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	callback := r.URL.Query().Get("callback")
+	enableJSONP := callback != "" && len(callback) < 2000 && callbackJSONP.MatchString(callback)
+	if enableJSONP {
+		deprecated(w, r, "jsonp")
+		_, err := w.Write([]byte("/**/ typeof " + callback + " === 'function' " +
+			"&& " + callback + "("))
+		if err != nil {
+			return
+		}
+	}
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Get("pretty") == "1" {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(selectOutput(r, ipinfo))
+	if enableJSONP {
+		w.Write([]byte(");"))
+	}
+
+	retval = http.StatusOK
+}
+
+// lookupMediaTypes are the media types a lookup without a format in its path
+// or query negotiates with the Accept header, and the format of each.
+// Browsers ask for text/html first, they get the default format.
+var lookupMediaTypes = []struct{ mediaType, format string }{
+	{"application/json", "json"},
+	{"text/html", ""},
+	{"application/xml", "xml"},
+	{"text/xml", "xml"},
+	{"application/yaml", "yaml"},
+	{"application/x-yaml", "yaml"},
+	{"application/msgpack", "msgpack"},
+	{"application/x-msgpack", "msgpack"},
+	{"application/cbor", "cbor"},
+	{"application/geo+json", "geojson"},
+	{"text/csv", "csv"},
+	{"text/plain", "text"},
+}
+
+// jsonDialects are the formats that are JSON in another schema, clients
+// asking for application/json get them when they are the DefaultFormat.
+var jsonDialects = map[string]bool{"ipinfo": true, "ip-api": true}
+
+// negotiateFormat returns the format the Accept header prefers. The
+// DefaultFormat wins wildcards and ties, and is the answer without an
+// acceptable offer.
+func negotiateFormat(accept string) string {
+	def := *DefaultFormat
+	if def == "" {
+		def = "json"
+	}
+
+	isDefault := func(format string) bool {
+		return format == def || (format == "json" && jsonDialects[def])
+	}
+
+	var offers, others []string
+	for _, t := range lookupMediaTypes {
+		if isDefault(t.format) {
+			offers = append(offers, t.mediaType)
+		} else {
+			others = append(others, t.mediaType)
+		}
+	}
+
+	chosen := negotiate(accept, append(offers, others...), "")
+	for _, t := range lookupMediaTypes {
+		if t.mediaType == chosen && t.format != "" && !isDefault(t.format) {
+			return t.format
+		}
+	}
+	return def
+}
+
+// selectOutput applies the sort and fields parameters to a lookup.
+func selectOutput(r *http.Request, info ipInfo) interface{} {
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		return selectFields(info, strings.Split(fields, ","))
+	}
+	if r.URL.Query().Get("sort") == "1" {
+		return sortedFields(info)
+	}
+	return info
+}
+
+// resultNetwork is the widest network around ip over which the lookup is the
+// same: the narrower of the networks matched in the City and ASN databases.
+// Without an ASN database only the City network counts. It is nil when the
+// City database has no record of ip. An IPv4 address gets an IPv4 network.
+func resultNetwork(ip net.IP) *net.IPNet {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	network := cityNetwork(ip)
+	if network == nil {
+		return nil
+	}
+	if netASN != nil {
+		// A range without an ASN record is just as uniform as one with.
+		var none struct{}
+		asnNetwork, _, err := netASN.LookupNetwork(ip, &none)
+		if err != nil {
+			return nil
+		}
+		if asnNetwork = ipv4Network(ip, asnNetwork); !asnNetwork.Contains(ip) {
+			return nil
+		}
+		// Both contain ip, so the longer prefix is their intersection.
+		ones, _ := network.Mask.Size()
+		asnOnes, _ := asnNetwork.Mask.Size()
+		if asnOnes > ones {
+			network = asnNetwork
+		}
+	}
+	return network
+}
+
+// matchedNetwork is the network the City database matched ip in, nil when it
+// has no record of ip. An IPv4 address gets an IPv4 network.
+func matchedNetwork(ip net.IP) *net.IPNet {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	return cityNetwork(ip)
+}
+
+// cityNetwork looks up the network of ip in the City database, with dbLock
+// held by the caller.
+func cityNetwork(ip net.IP) *net.IPNet {
+	var none struct{}
+	network, ok, err := netCity.LookupNetwork(ip, &none)
+	if err != nil || !ok {
+		return nil
+	}
+	if network = ipv4Network(ip, network); !network.Contains(ip) {
+		return nil
+	}
+	return network
+}
+
+// ipv4Network converts the network an IPv4 address was found in back to
+// IPv4 form. An IPv6 database keeps IPv4 in ::/96, and when that subtree
+// begins at a leaf the reader answers with the IPv6 network holding it.
+func ipv4Network(ip net.IP, n *net.IPNet) *net.IPNet {
+	if ip.To4() == nil || len(n.IP) != net.IPv6len || !n.IP[:12].Equal(net.IPv6zero[:12]) {
+		return n
+	}
+	ones, _ := n.Mask.Size()
+	if ones <= 96 {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)}
+	}
+	return &net.IPNet{IP: n.IP[12:], Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+}
+
+// lookupFormats are the output formats a lookup path can ask for by name
+var lookupFormats = map[string]bool{"json": true, "csv": true}
+
+// textFields are the fields a lookup path like /8.8.8.8/country can ask for,
+// answered as plain text the way ipinfo.io does.
+var textFields = map[string]func(info ipInfo) string{
+	"ip":       func(info ipInfo) string { return info.IP },
+	"city":     func(info ipInfo) string { return info.City },
+	"region":   func(info ipInfo) string { return info.Region },
+	"country":  func(info ipInfo) string { return info.Country.Code },
+	"timezone": func(info ipInfo) string { return info.TimeZone },
+	"postal": func(info ipInfo) string {
+		if info.Postal == nil {
+			return ""
+		}
+		return *info.Postal
+	},
+	"loc": func(info ipInfo) string {
+		if !info.Location.known() {
+			return ""
+		}
+		return strconv.FormatFloat(info.Location.Latitude, 'f', -1, 64) + "," +
+			strconv.FormatFloat(info.Location.Longitude, 'f', -1, 64)
+	},
+	"org": func(info ipInfo) string {
+		return strings.TrimSpace(asString(info.ASN) + " " + info.Organization)
+	},
+}
+
+// parsePath splits a lookup path like /8.8.8.8/json into the address and
+// the format. An empty address, as in //json, is a self lookup. So is a path
+// naming only a format, like /json, which is also where http.ServeMux
+// redirects //json to. The same goes for a text field, like /country.
+func parsePath(path string) (address, format string) {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	address = segments[0]
+	// A prefix length after the address makes it a network, like
+	// /203.0.113.0/24/json.
+	if len(segments) > 1 && isPrefixLength(segments[1]) {
+		address = segments[0] + "/" + segments[1]
+		segments = segments[1:]
+	}
+	if len(segments) > 1 {
+		format = segments[1]
+	} else if lookupFormats[address] || textFields[address] != nil {
+		address, format = "", address
+	}
+	return address, format
+}
+
+func isPrefixLength(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 0 && n <= 128 && s == strconv.Itoa(n)
+}
+
+// lookupError is the entry of a failed address in a multi-address lookup.
+type lookupError struct {
+	Query string `json:"query"`
+	Error string `json:"error"`
+}
+
+// lookupMany answers with a JSON array of the lookups of queries, in order.
+// Entries that fail carry the error instead of failing the whole request.
+func lookupMany(w http.ResponseWriter, r *http.Request, queries []string) int {
+	results := lookupBatch(queries)
+	out := make([]interface{}, len(results))
+	for i, result := range results {
+		out[i] = result.entry()
+	}
+
+	writeJSON(w, r, out)
+	return http.StatusOK
+}
+
+// lookupHost answers with a JSON array of the lookups of every address host
+// resolves to, 404 when it resolves to none. Each lookup names the host in
+// resolved_from, normalized like hostname.
+func lookupHost(w http.ResponseWriter, r *http.Request, host string) int {
+	if !isHostname(host) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return http.StatusBadRequest
+	}
+
+	name, ips, err := resolveHost(r.Context(), host)
+	if dnsErr, ok := err.(*net.DNSError); err != nil && (!ok || !dnsErr.IsNotFound) {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return http.StatusBadGateway
+	}
+	if len(ips) == 0 {
+		http.NotFound(w, r)
+		return http.StatusNotFound
+	}
+
+	queries := make([]string, len(ips))
+	for i, ip := range ips {
+		queries[i] = ip.String()
+	}
+	results := lookupBatch(queries)
+	out := make([]interface{}, len(results))
+	for i, result := range results {
+		result.info.ResolvedFrom = name
+		out[i] = result.entry()
+	}
+
+	writeJSON(w, r, out)
+	return http.StatusOK
+}
+
+// writeJSON answers with v as JSON, indented for pretty=1. The Content-Type
+// is application/json unless already set to a JSON based type.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Get("pretty") == "1" {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// LookupIP queries the databases for a single IP address, or the cache when
+// enabled, and assembles the result. An error from the City database is
+// logged and returned alongside whatever could still be filled in.
+func LookupIP(ip net.IP) (ipInfo, error) {
+	ipinfo, ok := lookupOverride(ip)
+	if !ok {
+		ipinfo, ok = lookupCache.get(ip)
+	}
+	var err error
+	if !ok {
+		ipinfo, err = lookupDatabases(ip)
+		if err == nil {
+			lookupCache.add(ip, ipinfo)
+		}
+	}
+
+	// A cached entry may be shared by a whole IPv6 prefix, anything that
+	// depends on the exact address is filled in here.
+	ipinfo.IP = ip.String()
+
+	ipinfo.Anycast, ipinfo.Location.Note = false, ""
+	if *MarkAnycast && isAnycastIP(ip) {
+		ipinfo.Anycast = true
+		ipinfo.Location.Note = anycastNote
+	}
+
+	ipinfo.Location.Geohash, ipinfo.Location.PlusCode = "", ""
+	if ipinfo.Location.known() {
+		ipinfo.Location.Geohash = geohash(ipinfo.Location.Latitude, ipinfo.Location.Longitude, 9)
+		ipinfo.Location.PlusCode = plusCode(ipinfo.Location.Latitude, ipinfo.Location.Longitude)
+	}
+
+	ipinfo.Type = classifyIP(ip)
+	ipinfo.Bogon = ipinfo.Type != ""
+	ipinfo.Tor = isTorExit(ip)
+	ipinfo.Cloud = lookupCloud(ip)
+	ipinfo.IsDatacenter = isDatacenterASN(ipinfo.ASN)
+
+	ipinfo.MAC = ""
+	if mac := eui64MAC(ip); mac != nil {
+		ipinfo.MAC = mac.String()
+	}
+
+	notifyWebhook(ipinfo)
+	countLookup(ipinfo)
+
+	return ipinfo, err
+}
+
+// lookupDatabases looks ip up in the databases.
+func lookupDatabases(ip net.IP) (ipInfo, error) {
+	var ipinfo ipInfo
 	ipinfo.IP = ip.String()
 
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
 	// Query the maxmind database for that IP address.
-	recCity, err := dbCity.City(ip)
+	recCity, cityLevel, err := lookupCity(ip)
 	if err != nil {
 		log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in City database")
 	}
@@ -128,60 +928,395 @@ func Lookup(w http.ResponseWriter, r *http.Request) {
 			ipinfo.ASN = recASN.AutonomousSystemNumber
 			ipinfo.Organization = recASN.AutonomousSystemOrganization
 		}
+	} else if r, ok := lookupASNRange(ip); ok {
+		ipinfo.ASN, ipinfo.Organization = r.asn, r.organization
 	}
 
 	// String containing the region/subdivision of the IP. (E.g.: Scotland, or California).
 	// If there are subdivisions for this IP, set sd as the first element in the array's name.
 	if recCity.Subdivisions != nil {
-		ipinfo.Region = recCity.Subdivisions[0].Names[*Locale]
+		ipinfo.places.region = place{recCity.Subdivisions[0].Names, recCity.Subdivisions[0].GeoNameID, iso31662(recCity.Country.IsoCode, recCity.Subdivisions[0].IsoCode)}
+		ipinfo.regionCode = recCity.Subdivisions[0].IsoCode
 	}
 
-	ipinfo.City = recCity.City.Names[*Locale]
+	ipinfo.places.city = place{recCity.City.Names, recCity.City.GeoNameID, ""}
+	ipinfo.cityGeoNameID = recCity.City.GeoNameID
 
-	ipinfo.Country = codename{
-		Code: recCity.Country.IsoCode,
-		Name: recCity.Country.Names[*Locale],
+	ipinfo.Country = country{
+		codename: codename{Code: recCity.Country.IsoCode},
+		IsEU:     recCity.Country.IsInEuropeanUnion,
+		Flag:     flagEmoji(recCity.Country.IsoCode),
 	}
+	fact := countryFacts[recCity.Country.IsoCode]
+	ipinfo.Country.Currency, ipinfo.Country.CallingCode = fact.currency, fact.callingCode
+	ipinfo.places.country = place{recCity.Country.Names, recCity.Country.GeoNameID, recCity.Country.IsoCode}
+
+	ipinfo.Continent = &codename{Code: recCity.Continent.Code}
+	ipinfo.places.continent = place{recCity.Continent.Names, recCity.Continent.GeoNameID, recCity.Continent.Code}
 
-	ipinfo.Continent = codename{
-		Code: recCity.Continent.Code,
-		Name: recCity.Continent.Names[*Locale],
+	ipinfo.localize(*Locale)
+	if ipinfo.Country.Code != "" || ipinfo.Continent.Code != "" {
+		checkContinent(&ipinfo)
+		// A replaced continent has no name.
+		if ipinfo.Continent == nil || ipinfo.Continent.Code != recCity.Continent.Code {
+			ipinfo.places.continent = place{}
+		}
 	}
 
-	ipinfo.Location = location{
-		Latitude:  recCity.Location.Latitude,
-		Longitude: recCity.Location.Longitude,
+	// The ISP database names organizations far better than the ASN one.
+	if dbISP != nil {
+		rec, err := dbISP.ISP(ip)
+		if err != nil {
+			log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in ISP database")
+		} else {
+			ipinfo.ISP = rec.ISP
+			if rec.Organization != "" {
+				ipinfo.Organization = rec.Organization
+			}
+			if rec.AutonomousSystemNumber != 0 {
+				ipinfo.ASN = rec.AutonomousSystemNumber
+			}
+		}
 	}
 
-	ipinfo.Postal = recCity.Postal.Code
+	if dbDomain != nil {
+		rec, err := dbDomain.Domain(ip)
+		if err != nil {
+			log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in Domain database")
+		} else {
+			ipinfo.Domain = rec.Domain
+		}
+	}
 
-	// Since we don't have HTML output, nor other data from geo data,
-	// everything is the same if you do /8.8.8.8, /8.8.8.8/json or /8.8.8.8/geo.
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	callback := r.URL.Query().Get("callback")
-	enableJSONP := callback != "" && len(callback) < 2000 && callbackJSONP.MatchString(callback)
-	if enableJSONP {
-		_, err = w.Write([]byte("/**/ typeof " + callback + " === 'function' " +
-			"&& " + callback + "("))
+	if dbConnectionType != nil {
+		rec, err := dbConnectionType.ConnectionType(ip)
 		if err != nil {
-			return
+			log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in Connection-Type database")
+		} else {
+			ipinfo.ConnectionType = rec.ConnectionType
 		}
 	}
-	enc := json.NewEncoder(w)
-	if r.URL.Query().Get("pretty") == "1" {
-		enc.SetIndent("", "  ")
+
+	if dbAnonymous != nil {
+		rec, err := dbAnonymous.AnonymousIP(ip)
+		if err != nil {
+			log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in Anonymous IP database")
+		} else {
+			ipinfo.Privacy = newPrivacy(rec)
+		}
 	}
-	enc.Encode(ipinfo)
-	if enableJSONP {
-		w.Write([]byte(");"))
+
+	ipinfo.Location = location{
+		Latitude:       recCity.Location.Latitude,
+		Longitude:      recCity.Location.Longitude,
+		AccuracyRadius: recCity.Location.AccuracyRadius,
+		MetroCode:      recCity.Location.MetroCode,
 	}
+	ipinfo.TimeZone = recCity.Location.TimeZone
 
-	retval = http.StatusOK
+	// Postal codes can be personal data, operators may drop them entirely.
+	if !*DisablePostal && cityLevel {
+		ipinfo.Postal = &recCity.Postal.Code
+	}
+
+	return ipinfo, err
+}
+
+// lookupCity looks ip up in the City database, which may be a Country
+// database that only fills in the country and continent, in which case
+// cityLevel is false. Layers configured before it take precedence per field.
+// The caller holds dbLock.
+func lookupCity(ip net.IP) (rec *geoip2.City, cityLevel bool, err error) {
+	if len(dbLayers) > 0 {
+		return lookupLayers(ip, dbCity)
+	}
+	rec, err = dbCity.City(ip)
+	return rec, !strings.Contains(dbCity.Metadata().DatabaseType, "Country"), err
+}
+
+// place is a name of a lookup in every locale.
+type place struct {
+	names     map[string]string
+	geoNameID uint
+	// The ISO code of a country or subdivision, or the continent code.
+	code string
+}
+
+// localize names the places of the lookup in the first of the locales they
+// have a name in. Fields whose name was filled in are listed in NameSources.
+func (info *ipInfo) localize(locales ...string) {
+	info.NameSources = nil
+	name := func(p place, field, current string) string {
+		if len(p.names) == 0 && p.geoNameID == 0 {
+			// Nothing to localize, like the names of an override.
+			return current
+		}
+		n, source := localizedName(p, field, locales...)
+		if source != "" {
+			info.markName(field, source)
+		}
+		return n
+	}
+
+	info.Region = name(info.places.region, "region", info.Region)
+	info.City = name(info.places.city, "city", info.City)
+	info.Country.Name = name(info.places.country, "country", info.Country.Name)
+	if info.Continent != nil {
+		// Cached lookups share the continent, it is copied before changing.
+		continent := *info.Continent
+		continent.Name = name(info.places.continent, "continent", continent.Name)
+		info.Continent = &continent
+	}
+}
+
+// markName records where the name of field was filled in from. Cached
+// lookups share the map, it is copied before changing.
+func (info *ipInfo) markName(field, source string) {
+	sources := make(map[string]string, len(info.NameSources)+1)
+	for f, s := range info.NameSources {
+		sources[f] = s
+	}
+	sources[field] = source
+	info.NameSources = sources
+}
+
+// setSubdivisions sets the subdivisions of the lookup, marking their names
+// when filled in.
+func (info *ipInfo) setSubdivisions(subdivisions []subdivision) {
+	info.Subdivisions = subdivisions
+	for _, sd := range subdivisions {
+		if sd.nameSource != "" {
+			info.markName("subdivisions", sd.nameSource)
+		}
+	}
+}
+
+// addNames adds the names in every locale of the city, country, continent
+// and subdivisions.
+func (info *ipInfo) addNames() {
+	info.CityNames = info.places.city.names
+	info.Country.Names = info.places.country.names
+	if info.Continent != nil {
+		continent := *info.Continent
+		continent.Names = info.places.continent.names
+		info.Continent = &continent
+	}
+	for i := range info.Subdivisions {
+		info.Subdivisions[i].Names = info.Subdivisions[i].names
+	}
+}
+
+// nameLocales are the locales the MaxMind databases name places in.
+var nameLocales = []string{"en", "de", "es", "fr", "ja", "pt-BR", "ru", "zh-CN"}
+
+// localizedName returns the name in the first of the locales it has one in.
+// A place the database has no name for in any locale is logged. With
+// GeoNamesNames it takes its English name from the fallbacks, and reports
+// which one as source. Otherwise it is named by its GeoNames ID when
+// EmptyNames is "geonameid".
+func localizedName(p place, field string, locales ...string) (name, source string) {
+	if len(p.names) > 0 || p.geoNameID == 0 {
+		for _, locale := range locales {
+			if name = p.names[locale]; name != "" {
+				break
+			}
+		}
+		return name, ""
+	}
+	log.Debug().Str("field", field).Uint("geoname_id", p.geoNameID).Msg("No names in any locale")
+	if *GeoNamesNames {
+		if name, source = fallbackName(p, field); name != "" {
+			return name, source
+		}
+	}
+	if *EmptyNames == "geonameid" {
+		return "geonames:" + strconv.FormatUint(uint64(p.geoNameID), 10), ""
+	}
+	return "", ""
 }
 
 // Very restrictive, but this way it shouldn't completely fuck up.
 var callbackJSONP = regexp.MustCompile(`^[a-zA-Z_\$][a-zA-Z0-9_\$]*$`)
 
+// The seven continent codes used by MaxMind.
+var continentCodes = map[string]bool{
+	"AF": true, "AN": true, "AS": true, "EU": true, "NA": true, "OC": true, "SA": true,
+}
+
+// checkContinent warns about a missing or unexpected continent code and
+// applies the InvalidContinent policy: pass through, omit or substitute.
+func checkContinent(ipinfo *ipInfo) {
+	if continentCodes[ipinfo.Continent.Code] {
+		return
+	}
+
+	log.Warn().
+		Str("ip", ipinfo.IP).
+		Str("continent", ipinfo.Continent.Code).
+		Msg("Warning: Database returned an invalid continent code")
+
+	switch *InvalidContinent {
+	case "":
+	case "omit":
+		ipinfo.Continent = nil
+	default:
+		ipinfo.Continent = &codename{Code: *InvalidContinent}
+	}
+}
+
+// eui64MAC recovers the MAC address embedded in a SLAAC IPv6 address, whose
+// interface identifier is the MAC split by ff:fe with the universal/local
+// bit flipped. It returns nil for any other address.
+func eui64MAC(ip net.IP) net.HardwareAddr {
+	if ip.To4() != nil {
+		return nil
+	}
+	ip = ip.To16()
+	if ip == nil || ip[11] != 0xff || ip[12] != 0xfe {
+		return nil
+	}
+	return net.HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
+}
+
+// sortedFields converts v into nested maps, which encoding/json always
+// emits in sorted key order. Numbers are kept verbatim.
+func sortedFields(v interface{}) interface{} {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return v
+	}
+	return fields
+}
+
+// selectFields keeps only the fields of v named in paths, nested fields are
+// named with dots like country.code. Fields that are not in v are skipped.
+func selectFields(v interface{}, paths []string) interface{} {
+	fields, ok := sortedFields(v).(map[string]interface{})
+	if !ok {
+		return v
+	}
+
+	selected := make(map[string]interface{})
+	for _, path := range paths {
+		keys := strings.Split(strings.TrimSpace(path), ".")
+		value, ok := interface{}(fields), true
+		for _, key := range keys {
+			var nested map[string]interface{}
+			if nested, ok = value.(map[string]interface{}); !ok {
+				break
+			}
+			if value, ok = nested[key]; !ok {
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		to := selected
+		for _, key := range keys[:len(keys)-1] {
+			into, ok := to[key].(map[string]interface{})
+			if !ok {
+				into = make(map[string]interface{})
+				to[key] = into
+			}
+			to = into
+		}
+		to[keys[len(keys)-1]] = value
+	}
+	return selected
+}
+
+// Organizations and ISPs are cut down to this many characters in the access
+// log.
+const maxLoggedOrganization = 64
+
+// truncate shortens s to at most n characters, without splitting any.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+// asString formats an ASN the way BGP tooling displays it (e.g. AS15169).
+// Unknown ASNs stay empty.
+func asString(asn uint) string {
+	if asn == 0 {
+		return ""
+	}
+	return "AS" + strconv.FormatUint(uint64(asn), 10)
+}
+
+// addVary lists request headers the response depends on, so that shared
+// caches key on them. Headers already listed are not repeated.
+func addVary(w http.ResponseWriter, headers ...string) {
+	var vary []string
+	if current := w.Header().Get("Vary"); current != "" {
+		vary = strings.Split(current, ", ")
+	}
+	for _, header := range headers {
+		header = http.CanonicalHeaderKey(header)
+		found := false
+		for _, v := range vary {
+			if v == header {
+				found = true
+				break
+			}
+		}
+		if !found {
+			vary = append(vary, header)
+		}
+	}
+	w.Header().Set("Vary", strings.Join(vary, ", "))
+}
+
+// Private, loopback and link-local ranges never resolve to a location.
+var privateNets = parseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		nets = append(nets, mustParseCIDR(cidr))
+	}
+	return nets
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// isPrivateIP reports whether ip is loopback, link-local, unspecified or in
+// one of the private ranges.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Remove from the IP eventual [ or ], and remove the port part of the IP.
 func defangIP(ip string) string {
 	ip = strings.Replace(ip, "[", "", 1)
@@ -2,12 +2,40 @@
 package ipinfo
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	_ "github.com/jnovack/ipinfo/pkg/testing"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 type request struct {
@@ -20,6 +48,7 @@ type request struct {
 	function       http.HandlerFunc
 	expectedStatus int
 	expectedBody   string
+	expectedHeader http.Header
 }
 
 func init() {
@@ -46,6 +75,13 @@ func testHTTPFunc(t *testing.T, obj request) {
 	}
 
 	req.RemoteAddr = obj.remoteIP + ":" + obj.remotePort
+	for _, header := range obj.headers {
+		for key, values := range header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
 
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
@@ -66,6 +102,13 @@ func testHTTPFunc(t *testing.T, obj request) {
 		t.Errorf("unexpected body (check for whitespace and newlines): \ngot \n'%v'\nwant \n'%v'\n",
 			rr.Body.String(), obj.expectedBody)
 	}
+
+	// Check the response headers we care about are what we expect.
+	for key := range obj.expectedHeader {
+		if got, want := rr.Header().Get(key), obj.expectedHeader.Get(key); got != want {
+			t.Errorf("wrong %v header: got '%v' want '%v'", key, got, want)
+		}
+	}
 }
 
 func Test200Lookup(t *testing.T) {
@@ -75,7 +118,7 @@ func Test200Lookup(t *testing.T) {
 	obj.expectedStatus = http.StatusOK
 	obj.expectedBody = `{"ip":"10.10.10.10","city":"","region":"","country":{"code":"","name":""},` +
 		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
-		`"postal":"","asn":0,"organization":""}` + "\n"
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
 	testHTTPFunc(t, obj)
 }
 
@@ -86,7 +129,7 @@ func Test200LookupWithQuery(t *testing.T) {
 	obj.expectedStatus = http.StatusOK
 	obj.expectedBody = `{"ip":"192.168.100.200","city":"","region":"","country":{"code":"","name":""},` +
 		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
-		`"postal":"","asn":0,"organization":""}` + "\n"
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
 	testHTTPFunc(t, obj)
 }
 
@@ -99,6 +142,26 @@ func Test422Lookup(t *testing.T) {
 	testHTTPFunc(t, obj)
 }
 
+func TestCIDRLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.20.30.40/16"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"10.20.0.0/16","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/2001:db8::/32/ip"
+	obj.expectedBody = "2001:db8::/32\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.20.30.40/33"
+	obj.expectedStatus = http.StatusUnprocessableEntity
+	obj.expectedBody = "Unprocessable Entity\n"
+	testHTTPFunc(t, obj)
+}
+
 func Test403Lookup(t *testing.T) {
 	var obj = new()
 	obj.url = "/ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
@@ -114,7 +177,7 @@ func TestSelfLookup(t *testing.T) {
 	obj.expectedStatus = http.StatusOK
 	obj.expectedBody = `{"ip":"127.0.0.1","city":"","region":"","country":{"code":"","name":""},` +
 		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
-		`"postal":"","asn":0,"organization":""}` + "\n"
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"loopback"}` + "\n"
 	testHTTPFunc(t, obj)
 }
 
@@ -141,7 +204,9 @@ func TestPrettyLookup(t *testing.T) {
   },
   "postal": "",
   "asn": 0,
-  "organization": ""
+  "organization": "",
+  "bogon": true,
+  "type": "private"
 }` + "\n"
 	testHTTPFunc(t, obj)
 }
@@ -154,7 +219,7 @@ func TestCallbackLookup(t *testing.T) {
 	obj.expectedBody = `/**/ typeof ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890 === 'function'` +
 		` && ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz1234567890({"ip":"172.16.100.200","city":"",` +
 		`"region":"","country":{"code":"","name":""},"continent":{"code":"","name":""},` +
-		`"location":{"latitude":0,"longitude":0},"postal":"","asn":0,"organization":""}` + "\n" + `);`
+		`"location":{"latitude":0,"longitude":0},"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n" + `);`
 	testHTTPFunc(t, obj)
 }
 
@@ -167,3 +232,3903 @@ func TestCallbackLookup(t *testing.T) {
 // 	readByte()
 // 	t.Log(buf.String())
 // }
+
+func TestBatchPreservesOrder(t *testing.T) {
+	queries := []string{"10.0.0.1", "a.b.c.d", "192.168.1.1", "", "172.16.0.1"}
+	results := lookupBatch(queries)
+	if len(results) != len(queries) {
+		t.Fatalf("wrong number of results: got %v want %v", len(results), len(queries))
+	}
+	for i, result := range results {
+		if result.query != queries[i] {
+			t.Errorf("result %v out of order: got %v want %v", i, result.query, queries[i])
+		}
+	}
+	if results[1].err != errInvalidIP || results[3].err != errInvalidIP {
+		t.Errorf("invalid entries should fail with %v", errInvalidIP)
+	}
+	if results[2].err != nil || results[2].info.IP != "192.168.1.1" {
+		t.Errorf("unexpected result for valid entry: %+v", results[2])
+	}
+}
+
+func batchQueries(n int) []string {
+	queries := make([]string, n)
+	for i := range queries {
+		queries[i] = "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+	}
+	return queries
+}
+
+func BenchmarkBatchSerial(b *testing.B) {
+	queries := batchQueries(1000)
+	for n := 0; n < b.N; n++ {
+		for _, query := range queries {
+			lookupQuery(query)
+		}
+	}
+}
+
+func BenchmarkBatchParallel(b *testing.B) {
+	queries := batchQueries(1000)
+	for n := 0; n < b.N; n++ {
+		lookupBatch(queries)
+	}
+}
+
+func TestDevIPSelfLookup(t *testing.T) {
+	devIP = net.ParseIP("192.0.2.1")
+	defer func() { devIP = nil }()
+
+	var obj = new()
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"192.0.2.1","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"documentation"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestDevIPExplicitLookup(t *testing.T) {
+	devIP = net.ParseIP("192.0.2.1")
+	defer func() { devIP = nil }()
+
+	var obj = new()
+	obj.url = "/10.10.10.10"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"10.10.10.10","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestSelfLookupVary(t *testing.T) {
+	var obj = new()
+	obj.url = "/me"
+	obj.function = Lookup
+	obj.headers = []http.Header{{"X-Real-Ip": {"10.1.2.3"}}}
+	obj.expectedStatus = http.StatusOK
+	obj.expectedHeader = http.Header{"Vary": {"Accept, Accept-Language, X-Real-Ip, X-Original-Forwarded-For, X-Forwarded-For"}}
+	obj.expectedBody = `{"ip":"10.1.2.3","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestExplicitLookupNoVary(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.10.10.10"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	// Only the negotiated format and names vary, not the client IP headers.
+	obj.expectedHeader = http.Header{"Vary": {"Accept, Accept-Language"}}
+	obj.expectedBody = `{"ip":"10.10.10.10","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestAddVary(t *testing.T) {
+	rr := httptest.NewRecorder()
+	addVary(rr, "accept")
+	addVary(rr, "Accept-Encoding", "Accept")
+	if got, want := rr.Header().Get("Vary"), "Accept, Accept-Encoding"; got != want {
+		t.Errorf("wrong Vary header: got '%v' want '%v'", got, want)
+	}
+}
+
+func TestASStringLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.10.10.10?as_string=1"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"10.10.10.10","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestASString(t *testing.T) {
+	if got := asString(15169); got != "AS15169" {
+		t.Errorf("wrong AS string: got '%v' want 'AS15169'", got)
+	}
+	if got := asString(0); got != "" {
+		t.Errorf("unknown ASN should be empty: got '%v'", got)
+	}
+}
+
+func TestCheckContinent(t *testing.T) {
+	defer func(policy string) { *InvalidContinent = policy }(*InvalidContinent)
+
+	tests := []struct {
+		policy   string
+		code     string
+		expected *codename
+	}{
+		{"", "EU", &codename{Code: "EU", Name: "Europe"}},
+		{"", "ZZ", &codename{Code: "ZZ", Name: "Nowhere"}},
+		{"omit", "EU", &codename{Code: "EU", Name: "Europe"}},
+		{"omit", "", nil},
+		{"XX", "ZZ", &codename{Code: "XX"}},
+	}
+	for _, test := range tests {
+		*InvalidContinent = test.policy
+		name := map[string]string{"EU": "Europe", "ZZ": "Nowhere"}[test.code]
+		ipinfo := ipInfo{IP: "192.0.2.1", Continent: &codename{Code: test.code, Name: name}}
+		checkContinent(&ipinfo)
+		if (ipinfo.Continent == nil) != (test.expected == nil) ||
+			(ipinfo.Continent != nil && !reflect.DeepEqual(*ipinfo.Continent, *test.expected)) {
+			t.Errorf("policy '%v' code '%v': got %+v want %+v", test.policy, test.code, ipinfo.Continent, test.expected)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+
+	tests := []struct {
+		proxies  []*net.IPNet
+		remote   string
+		headers  http.Header
+		expected string
+	}{
+		{nil, "127.0.0.1:65535", http.Header{}, "127.0.0.1"},
+		{nil, "127.0.0.1:65535", http.Header{"X-Real-Ip": {"10.1.2.3"}}, "10.1.2.3"},
+		{nil, "127.0.0.1:65535", http.Header{"X-Forwarded-For": {"10.1.2.3, 10.4.5.6"}}, "10.4.5.6"},
+		{parseCIDRs("10.4.0.0/16"), "10.4.0.1:80", http.Header{"X-Forwarded-For": {"10.1.2.3, 10.4.5.6"}}, "10.1.2.3"},
+		{parseCIDRs("10.4.0.0/16"), "10.4.0.1:80", http.Header{"X-Forwarded-For": {"10.1.2.3", "10.4.5.6:443"}}, "10.1.2.3"},
+		{parseCIDRs("10.4.0.0/16"), "10.4.0.1:80", http.Header{"X-Forwarded-For": {"junk, 10.4.5.6"}}, "10.4.5.6"},
+		{parseCIDRs("10.4.0.0/16"), "192.0.2.1:80", http.Header{"X-Forwarded-For": {"10.1.2.3"}}, "192.0.2.1"},
+		{parseCIDRs("10.4.0.0/16"), "10.4.0.1:80", http.Header{
+			"X-Forwarded-For":          {"10.4.9.9"},
+			"X-Original-Forwarded-For": {"10.1.2.3, 10.4.5.6"},
+		}, "10.1.2.3"},
+		{nil, "[::1]:65535", http.Header{"X-Forwarded-For": {"[2001:db8::1]:1234"}}, "2001:db8::1"},
+	}
+	for i, test := range tests {
+		trustedProxies = test.proxies
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		req.Header = test.headers
+		if got := clientIP(req); got != test.expected {
+			t.Errorf("test %v: got %v want %v", i, got, test.expected)
+		}
+	}
+}
+
+func TestForwardedForLongChain(t *testing.T) {
+	defer func(proxies []*net.IPNet, hops int) { trustedProxies, maxForwardedHops = proxies, hops }(trustedProxies, maxForwardedHops)
+	trustedProxies = parseCIDRs("10.4.0.0/16")
+	maxForwardedHops = 32
+
+	short := "192.0.2.1" + strings.Repeat(", 10.4.5.6", 31)
+	if got := forwardedFor([]string{short}); !got.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected the client within the cap, got %v", got)
+	}
+
+	// The client is out of reach behind thousands of trusted hops, the walk
+	// stops at the cap without parsing the rest.
+	long := "192.0.2.1" + strings.Repeat(", 10.4.5.6", 100000)
+	if got := forwardedFor([]string{long}); !got.Equal(net.ParseIP("10.4.5.6")) {
+		t.Errorf("expected the last hop within the cap, got %v", got)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { forwardedFor([]string{long}) }); allocs > 4*float64(maxForwardedHops) {
+		t.Errorf("parsing should be bounded by the cap, got %v allocations", allocs)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if ok, _, _ := l.take("10.0.0.1"); ok != want {
+			t.Errorf("take %v: got %v want %v", i, ok, want)
+		}
+	}
+	if ok, _, _ := l.take("10.0.0.2"); !ok {
+		t.Errorf("clients should not share a bucket")
+	}
+
+	now = now.Add(time.Second)
+	ok, remaining, reset := l.take("10.0.0.1")
+	if !ok || remaining != 0 || reset != 2*time.Second {
+		t.Errorf("after refill: got %v, %v, %v want true, 0, 2s", ok, remaining, reset)
+	}
+
+	now = now.Add(time.Minute)
+	l.sweep()
+	if len(l.buckets) != 0 {
+		t.Errorf("sweep should forget refilled buckets, %v left", len(l.buckets))
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	defer func(l *limiter, delay time.Duration) { rateLimiter, *TarpitDelay = l, delay }(rateLimiter, *TarpitDelay)
+	rateLimiter = newLimiter(0.001, 1)
+	*TarpitDelay = 20 * time.Millisecond
+
+	handler := Tarpit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, delayed := range []bool{false, true} {
+		start := time.Now()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if elapsed := time.Since(start); (elapsed >= *TarpitDelay) != delayed {
+			t.Errorf("request %v: took %v, expected delayed %v", i, elapsed, delayed)
+		}
+	}
+}
+
+func TestTarpitForwardedFor(t *testing.T) {
+	defer func(l *limiter, delay time.Duration, proxies []*net.IPNet) {
+		rateLimiter, *TarpitDelay, trustedProxies = l, delay, proxies
+	}(rateLimiter, *TarpitDelay, trustedProxies)
+	rateLimiter = newLimiter(0.001, 2)
+	*TarpitDelay = 0
+
+	handler := Tarpit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(remote, forwarded string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", forwarded)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("without a delay clients over the limit are let through, got %v", rr.Code)
+		}
+		return rr.Header().Get("X-RateLimit-Remaining")
+	}
+
+	// A client rotating the header is still limited by its own address.
+	for i, expected := range []string{"1", "0", "0"} {
+		if got := request("192.0.2.1:1234", "10.1.2."+strconv.Itoa(i)); got != expected {
+			t.Errorf("request %v: got %v remaining want %v", i, got, expected)
+		}
+	}
+
+	// Behind a trusted proxy the forwarded clients have buckets of their own.
+	trustedProxies = parseCIDRs("10.4.0.0/16")
+	for i, expected := range []string{"1", "1", "1"} {
+		if got := request("10.4.0.1:80", "10.1.2."+strconv.Itoa(i)); got != expected {
+			t.Errorf("proxied request %v: got %v remaining want %v", i, got, expected)
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	defer func(l *limiter) { rateLimiter = l }(rateLimiter)
+	rateLimiter = newLimiter(1, 3)
+	now := time.Now()
+	rateLimiter.now = func() time.Time { return now }
+
+	handler := Tarpit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, remaining := range []string{"2", "1"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		if got := rr.Header().Get("X-RateLimit-Limit"); got != "3" {
+			t.Errorf("expected limit 3, got %q", got)
+		}
+		if got := rr.Header().Get("X-RateLimit-Remaining"); got != remaining {
+			t.Errorf("expected remaining %v, got %q", remaining, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if got := rr.Header().Get("X-RateLimit-Reset"); got != "3" {
+		t.Errorf("expected reset in 3 seconds, got %q", got)
+	}
+	for _, name := range []string{"Limit", "Remaining", "Reset"} {
+		if draft, prefixed := rr.Header().Get("RateLimit-"+name), rr.Header().Get("X-RateLimit-"+name); draft != prefixed {
+			t.Errorf("expected RateLimit-%v like the X- field, got %q and %q", name, draft, prefixed)
+		}
+	}
+}
+
+func TestDisablePostal(t *testing.T) {
+	defer func(v bool) { *DisablePostal = v }(*DisablePostal)
+	*DisablePostal = true
+
+	var obj = new()
+	obj.url = "/10.10.10.10"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"10.10.10.10","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestMultiLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.0.0.1,garbage,192.168.0.1"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `[{"ip":"10.0.0.1","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"},` +
+		`{"query":"garbage","error":"invalid IP address"},` +
+		`{"ip":"192.168.0.1","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}]` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func Test403MultiLookupLimit(t *testing.T) {
+	defer func(v int) { *BatchLimit = v }(*BatchLimit)
+	*BatchLimit = 2
+
+	var obj = new()
+	obj.url = "/10.0.0.1,10.0.0.2,10.0.0.3"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusForbidden
+	obj.expectedBody = "Forbidden\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.0.0.1," + strings.Repeat("1", 100)
+	testHTTPFunc(t, obj)
+}
+
+func TestAnycast(t *testing.T) {
+	defer func(v bool) { *MarkAnycast = v }(*MarkAnycast)
+
+	for ip, expected := range map[string]bool{
+		"1.1.1.1":              true,
+		"8.8.4.4":              true,
+		"2606:4700:4700::1111": true,
+		"8.8.9.9":              false,
+		"192.0.2.1":            false,
+	} {
+		*MarkAnycast = true
+		info, _ := LookupIP(net.ParseIP(ip))
+		if info.Anycast != expected || (info.Location.Note != "") != expected {
+			t.Errorf("%v: expected anycast %v, got %v (%q)", ip, expected, info.Anycast, info.Location.Note)
+		}
+
+		*MarkAnycast = false
+		if info, _ := LookupIP(net.ParseIP(ip)); info.Anycast {
+			t.Errorf("%v: marked as anycast while disabled", ip)
+		}
+	}
+}
+
+func TestResultNetwork(t *testing.T) {
+	// The test database has no records.
+	for _, ip := range []string{"2001:db8::1", "10.20.30.40"} {
+		if n := resultNetwork(net.ParseIP(ip)); n != nil {
+			t.Errorf("expected no network for %v without a record, got %v", ip, n)
+		}
+		if n := matchedNetwork(net.ParseIP(ip)); n != nil {
+			t.Errorf("expected no matched network for %v without a record, got %v", ip, n)
+		}
+	}
+
+	defer func(city, asn *maxminddb.Reader) { netCity, netASN = city, asn }(netCity, netASN)
+	dir, err := ioutil.TempDir("", "network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func(name string, records map[string]map[string]interface{}) *maxminddb.Reader {
+		writeMMDB(t, dir+"/"+name, "GeoLite2-City", records)
+		reader, err := maxminddb.Open(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reader
+	}
+	record := map[string]interface{}{"city": map[string]interface{}{"geoname_id": uint32(1)}}
+
+	netASN = nil
+	netCity = open("city.mmdb", map[string]map[string]interface{}{"10.20.0.0/16": record, "2001:db8::/32": record})
+	defer netCity.Close()
+	for ip, expected := range map[string]string{
+		"10.20.30.40": "10.20.0.0/16",
+		"2001:db8::1": "2001:db8::/32",
+		"192.0.2.1":   "<nil>",
+	} {
+		if n := resultNetwork(net.ParseIP(ip)); n.String() != expected {
+			t.Errorf("wrong network for %v: got %v want %v", ip, n, expected)
+		}
+		if n := matchedNetwork(net.ParseIP(ip)); n.String() != expected {
+			t.Errorf("wrong matched network for %v: got %v want %v", ip, n, expected)
+		}
+	}
+
+	// The result only holds where the ASN network overlaps, the matched
+	// network is still the City one.
+	netASN = open("asn.mmdb", map[string]map[string]interface{}{"10.20.30.0/24": record})
+	defer netASN.Close()
+	if n := resultNetwork(net.ParseIP("10.20.30.40")); n.String() != "10.20.30.0/24" {
+		t.Errorf("expected the ASN network as the result, got %v", n)
+	}
+	if n := matchedNetwork(net.ParseIP("10.20.30.40")); n.String() != "10.20.0.0/16" {
+		t.Errorf("expected the City network as matched, got %v", n)
+	}
+	netASN = nil
+
+	// All of IPv4 is in ::/8 here, the reader answers with that network.
+	netCity = open("ipv4-leaf.mmdb", map[string]map[string]interface{}{"::/8": record})
+	defer netCity.Close()
+	if n := resultNetwork(net.ParseIP("10.20.30.40")); n.String() != "0.0.0.0/0" {
+		t.Errorf("expected an IPv4 network, got %v", n)
+	}
+}
+
+func TestSubdivisionConfidence(t *testing.T) {
+	confidence := uint8(80)
+	raw, _ := json.Marshal([]subdivision{
+		{Code: "ENG", Name: "England", ISO31662: iso31662("GB", "ENG"), Confidence: &confidence},
+		{Name: "Westminster", ISO31662: iso31662("GB", "")},
+	})
+	expected := `[{"code":"ENG","name":"England","iso_3166_2":"GB-ENG","confidence":80},{"code":"","name":"Westminster"}]`
+	if string(raw) != expected {
+		t.Errorf("unexpected subdivisions:\ngot  %v\nwant %v", string(raw), expected)
+	}
+
+	if subdivisions := lookupSubdivisions(net.ParseIP("10.0.0.1")); subdivisions != nil {
+		t.Errorf("expected no subdivisions for a private address, got %v", subdivisions)
+	}
+}
+
+func TestSubdivisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subdivisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeMMDB(t, dir+"/GeoLite2-City.mmdb", "GeoLite2-City", map[string]map[string]interface{}{
+		"1.0.0.0/24": {
+			"continent": map[string]interface{}{"code": "EU", "names": map[string]interface{}{"en": "Europe"}},
+			"country":   map[string]interface{}{"iso_code": "GB", "names": map[string]interface{}{"en": "United Kingdom"}},
+			"subdivisions": []interface{}{
+				map[string]interface{}{"iso_code": "ENG", "names": map[string]interface{}{"en": "England"}},
+				map[string]interface{}{"iso_code": "LND", "names": map[string]interface{}{"en": "Greater London"}},
+			},
+		},
+	})
+	city, cityNetworks, err := openDatabase(dir + "/GeoLite2-City.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer city.Close()
+	defer cityNetworks.Close()
+
+	dbLock.Lock()
+	oldCity, oldCityNetworks := dbCity, netCity
+	dbCity, netCity = city, cityNetworks
+	dbLock.Unlock()
+	defer func() {
+		dbLock.Lock()
+		dbCity, netCity = oldCity, oldCityNetworks
+		dbLock.Unlock()
+	}()
+
+	// Every level is returned by default, region stays the first one.
+	for url, expected := range map[string]string{
+		"/1.0.0.1":                `[{"code":"ENG","name":"England","iso_3166_2":"GB-ENG"},{"code":"LND","name":"Greater London","iso_3166_2":"GB-LND"}]`,
+		"/1.0.0.1?subdivisions=1": `[{"code":"ENG","name":"England","iso_3166_2":"GB-ENG"},{"code":"LND","name":"Greater London","iso_3166_2":"GB-LND"}]`,
+		"/1.0.0.1?subdivisions=0": ``,
+	} {
+		rr := httptest.NewRecorder()
+		Lookup(rr, httptest.NewRequest("GET", url, nil))
+		var body struct {
+			Region       string          `json:"region"`
+			Subdivisions json.RawMessage `json:"subdivisions"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%v: %v", url, err)
+		}
+		if body.Region != "England" {
+			t.Errorf("%v: got region %q want England", url, body.Region)
+		}
+		if got := string(body.Subdivisions); got != expected {
+			t.Errorf("%v: got subdivisions %v want %v", url, got, expected)
+		}
+	}
+}
+
+func TestTimestampLookup(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+	rr := httptest.NewRecorder()
+	Lookup(rr, httptest.NewRequest("GET", "/10.0.0.1?timestamp=1", nil))
+
+	var info ipInfo
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	queried, err := time.Parse(time.RFC3339, info.QueriedAt)
+	if err != nil {
+		t.Fatalf("queried_at %q is not RFC3339: %v", info.QueriedAt, err)
+	}
+	if queried.Before(before) || queried.After(time.Now()) {
+		t.Errorf("queried_at %v is not the time of the lookup", queried)
+	}
+}
+
+func TestInRangeLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.1.2.3?in=10.0.0.0/8"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"10.1.2.3","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","in_range":true,"bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.1.2.3?in=192.168.0.0/16"
+	obj.expectedBody = strings.Replace(obj.expectedBody, "true", "false", 1)
+	testHTTPFunc(t, obj)
+}
+
+func Test400InRangeLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.1.2.3?in=10.0.0.0/33"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = "Bad Request\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestParsePath(t *testing.T) {
+	for path, expected := range map[string][2]string{
+		"/":                {"", ""},
+		"/8.8.8.8":         {"8.8.8.8", ""},
+		"/8.8.8.8/json":    {"8.8.8.8", "json"},
+		"//json":           {"", "json"},
+		"//country":        {"", "country"},
+		"/self/csv":        {"self", "csv"},
+		"/json":            {"", "json"},
+		"/me/":             {"me", ""},
+		"/8.8.8.8/geo/foo": {"8.8.8.8", "geo"},
+	} {
+		if address, format := parsePath(path); address != expected[0] || format != expected[1] {
+			t.Errorf("%v: got %q %q want %q %q", path, address, format, expected[0], expected[1])
+		}
+	}
+}
+
+func TestSelfFormatLookup(t *testing.T) {
+	self := `{"ip":"192.0.2.1","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"documentation"}` + "\n"
+
+	var obj = new()
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.headers = []http.Header{{"X-Real-Ip": {"192.0.2.1"}}}
+	// Paths starting with // would otherwise be taken for a host.
+	for _, url := range []string{"http://localhost//json", "/json", "http://localhost//geo"} {
+		obj.url = url
+		obj.expectedBody = self
+		testHTTPFunc(t, obj)
+	}
+
+	obj.url = "/self/csv"
+	obj.expectedHeader = http.Header{"Content-Type": {"text/csv; charset=utf-8"}}
+	obj.expectedBody = csvBatchHeader + "192.0.2.1,192.0.2.1,,,,,,,0,0,,0,,\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestCountryNames(t *testing.T) {
+	raw, _ := json.Marshal(country{codename: codename{Code: "DE", Name: "Germany", Names: map[string]string{"en": "Germany", "de": "Deutschland"}}})
+	if expected := `{"code":"DE","name":"Germany","names":{"de":"Deutschland","en":"Germany"}}`; string(raw) != expected {
+		t.Errorf("unexpected country:\ngot  %v\nwant %v", string(raw), expected)
+	}
+
+	var obj = new()
+	obj.url = "/10.0.0.1?country_names=some"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = "Bad Request\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestProjectionLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.10.10.10?proj=webmercator"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"10.10.10.10","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func Test400ProjectionLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.10.10.10?proj=mollweide"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = `Bad Request` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestWebMercator(t *testing.T) {
+	p := webMercator(45, 90)
+	if p.System != "EPSG:3857" || math.Abs(p.X-10018754.17) > 0.01 || math.Abs(p.Y-5621521.49) > 0.01 {
+		t.Errorf("wrong projection: got %+v", p)
+	}
+	if p := webMercator(90, 0); math.IsInf(p.Y, 0) {
+		t.Errorf("poles should be clamped: got %+v", p)
+	}
+}
+
+func TestCallbackDeprecationWarning(t *testing.T) {
+	var obj = new()
+	obj.url = "/172.16.100.200?callback=cb"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedHeader = http.Header{"Warning": {`299 - "` + deprecations["jsonp"] + `"`}}
+	obj.expectedBody = `/**/ typeof cb === 'function' && cb({"ip":"172.16.100.200","city":"",` +
+		`"region":"","country":{"code":"","name":""},"continent":{"code":"","name":""},` +
+		`"location":{"latitude":0,"longitude":0},"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n" + `);`
+	testHTTPFunc(t, obj)
+}
+
+const csvBatchHeader = "query,ip,city,region,country_code,country_name,continent_code,continent_name," +
+	"latitude,longitude,postal,asn,organization,error\n"
+
+func TestBatchCSV(t *testing.T) {
+	var obj = new()
+	obj.method = "POST"
+	obj.url = "/batch"
+	obj.body = strings.NewReader("10.0.0.1\n\n# comment\n a.b.c.d \n::1\n")
+	obj.headers = []http.Header{{"Accept": {"text/csv"}}}
+	obj.function = Batch
+	obj.expectedStatus = http.StatusOK
+	obj.expectedHeader = http.Header{
+		"Content-Type":        {"text/csv; charset=utf-8"},
+		"Content-Disposition": {`attachment; filename="ipinfo.csv"`},
+	}
+	obj.expectedBody = csvBatchHeader +
+		"10.0.0.1,10.0.0.1,,,,,,,0,0,,0,,\n" +
+		"a.b.c.d,,,,,,,,,,,,,invalid IP address\n" +
+		"::1,::1,,,,,,,0,0,,0,,\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestBatchCSVUpload(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", "ignored")
+	part, _ := mw.CreateFormFile("file", "ips.txt")
+	part.Write([]byte("192.168.1.1\r\n"))
+	mw.Close()
+
+	var obj = new()
+	obj.method = "POST"
+	obj.url = "/batch"
+	obj.body = &body
+	obj.headers = []http.Header{{"Accept": {"text/csv"}, "Content-Type": {mw.FormDataContentType()}}}
+	obj.function = Batch
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = csvBatchHeader + "192.168.1.1,192.168.1.1,,,,,,,0,0,,0,,\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestBatchLimit(t *testing.T) {
+	defer func(limit int) { *BatchLimit = limit }(*BatchLimit)
+	*BatchLimit = 2
+
+	var upload bytes.Buffer
+	mw := multipart.NewWriter(&upload)
+	part, _ := mw.CreateFormFile("file", "ips.txt")
+	part.Write([]byte("10.0.0.1\r\n10.0.0.2\r\n10.0.0.3\r\n"))
+	mw.Close()
+
+	tests := []struct {
+		body        io.Reader
+		contentType string
+		expected    int
+	}{
+		{strings.NewReader("10.0.0.1\n# comment\n10.0.0.2\n"), "text/plain", http.StatusOK},
+		{strings.NewReader("10.0.0.1\n10.0.0.2\n10.0.0.3\n"), "text/plain", http.StatusRequestEntityTooLarge},
+		{&upload, mw.FormDataContentType(), http.StatusRequestEntityTooLarge},
+		// Comments don't count as addresses but still have to be read.
+		{strings.NewReader(strings.Repeat("#", 3*batchEntryBytes) + "\n10.0.0.1\n"), "text/plain", http.StatusRequestEntityTooLarge},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/batch", test.body)
+		req.Header.Set("Content-Type", test.contentType)
+		rr := httptest.NewRecorder()
+		Batch(rr, req)
+		if rr.Code != test.expected {
+			t.Errorf("test %v: got %v want %v", i, rr.Code, test.expected)
+		}
+	}
+}
+
+func Test405Batch(t *testing.T) {
+	var obj = new()
+	obj.url = "/batch"
+	obj.function = Batch
+	obj.expectedStatus = http.StatusMethodNotAllowed
+	obj.expectedHeader = http.Header{"Allow": {"POST"}}
+	obj.expectedBody = `Method Not Allowed` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestBatchJSON(t *testing.T) {
+	var obj = new()
+	obj.method = "POST"
+	obj.url = "/batch"
+	obj.body = strings.NewReader("10.0.0.1\nnope\n")
+	obj.headers = []http.Header{{"Accept": {"text/csv;q=0.9, application/json;q=1.0"}}}
+	obj.function = Batch
+	obj.expectedStatus = http.StatusOK
+	obj.expectedHeader = http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+	obj.expectedBody = `[{"ip":"10.0.0.1","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"},{"query":"nope","error":"invalid IP address"}]` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestBatchAcceptFallback(t *testing.T) {
+	var obj = new()
+	obj.method = "POST"
+	obj.url = "/batch"
+	obj.body = strings.NewReader("")
+	obj.headers = []http.Header{{"Accept": {"application/xml"}}}
+	obj.function = Batch
+	obj.expectedStatus = http.StatusOK
+	obj.expectedHeader = http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+	obj.expectedBody = "[]\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/csv"}
+	for accept, expected := range map[string]string{
+		"":                                     "application/json",
+		"text/csv":                             "text/csv",
+		"text/csv;q=0.9, application/json;q=1": "application/json",
+		"application/json;q=0.5, text/csv":     "text/csv",
+		"text/*, application/json;q=0.1":       "text/csv",
+		"*/*;q=0.2, text/csv;q=0.1":            "application/json",
+		"*/*, application/json;q=0":            "text/csv",
+		"text/csv, application/json":           "application/json",
+		"application/xml":                      "application/json",
+		"garbage, text/csv;q=2, text/csv":      "text/csv",
+	} {
+		if got := negotiate(accept, offers, "application/json"); got != expected {
+			t.Errorf("%q: got %v want %v", accept, got, expected)
+		}
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	for acceptLanguage, expected := range map[string]string{
+		"":                       "",
+		"*":                      "",
+		"de":                     "de",
+		"DE-ch":                  "de",
+		"pt":                     "pt-BR",
+		"zh-Hans-CN":             "zh",
+		"zh-CN":                  "zh-CN",
+		"nl, fr;q=0.8, de;q=0.9": "de",
+		"fr, de":                 "fr",
+		"fr;q=0, de;q=0.1":       "de",
+		"nl":                     "",
+		"de;q=2, ja;level=1, ru": "ru",
+	} {
+		if got := negotiateLanguage(acceptLanguage, []string{"de", "fr", "pt-BR", "ru", "zh", "zh-CN"}, ""); got != expected {
+			t.Errorf("%q: got %q want %q", acceptLanguage, got, expected)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	continent := &codename{Code: "EU", Name: "Europe"}
+	info := ipInfo{Continent: continent}
+	info.places.city = place{names: map[string]string{"en": "Munich", "de": "München"}}
+	info.places.continent = place{names: map[string]string{"en": "Europe", "de": "Europa"}}
+
+	info.localize("de")
+	if info.City != "München" || info.Continent.Name != "Europa" {
+		t.Errorf("expected German names, got %q and %q", info.City, info.Continent.Name)
+	}
+	if continent.Name != "Europe" {
+		t.Errorf("expected the shared continent to be left alone, got %q", continent.Name)
+	}
+
+	info.localize("ja", "en")
+	if info.City != "Munich" || info.Continent.Name != "Europe" {
+		t.Errorf("expected the English names without Japanese ones, got %q and %q", info.City, info.Continent.Name)
+	}
+}
+
+func TestAddNames(t *testing.T) {
+	continent := &codename{Code: "EU", Name: "Europe"}
+	info := ipInfo{Continent: continent, Subdivisions: []subdivision{{Code: "BY", names: map[string]string{"de": "Bayern"}}}}
+	info.places.city = place{names: map[string]string{"de": "München"}}
+	info.places.continent = place{names: map[string]string{"de": "Europa"}}
+
+	info.addNames()
+	raw, _ := json.Marshal(info)
+	expected := `{"ip":"","city":"","city_names":{"de":"München"},"region":"",` +
+		`"subdivisions":[{"code":"BY","name":"","names":{"de":"Bayern"}}],"country":{"code":"","name":""},` +
+		`"continent":{"code":"EU","name":"Europe","names":{"de":"Europa"}},"location":{"latitude":0,"longitude":0},` +
+		`"asn":0,"organization":""}`
+	if string(raw) != expected {
+		t.Errorf("unexpected names:\ngot  %v\nwant %v", string(raw), expected)
+	}
+	if continent.Names != nil {
+		t.Errorf("expected the shared continent to be left alone, got %v", continent.Names)
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	info := ipInfo{IP: "192.0.2.1", TimeZone: "Europe/Berlin"}
+	raw, _ := json.Marshal(info)
+	if !strings.Contains(string(raw), `"location":{"latitude":0,"longitude":0},"timezone":"Europe/Berlin"`) {
+		t.Errorf("expected the time zone after the location, got %v", string(raw))
+	}
+	if got := textFields["timezone"](info); got != "Europe/Berlin" {
+		t.Errorf("expected Europe/Berlin as text, got %q", got)
+	}
+}
+
+func TestAccuracyRadius(t *testing.T) {
+	raw, _ := json.Marshal(location{Latitude: 37.751, Longitude: -97.822, AccuracyRadius: 1000})
+	if expected := `{"latitude":37.751,"longitude":-97.822,"accuracy_radius":1000}`; string(raw) != expected {
+		t.Errorf("unexpected location:\ngot  %v\nwant %v", string(raw), expected)
+	}
+}
+
+func TestLocalTime(t *testing.T) {
+	if _, err := time.LoadLocation("Asia/Tokyo"); err != nil {
+		t.Skip("no time zone database")
+	}
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if got := localTime("Asia/Tokyo", at); got != "2020-01-02T12:04:05+09:00" {
+		t.Errorf("expected the time in Tokyo, got %q", got)
+	}
+	if got := localTime("Nowhere/Special", at); got != "" {
+		t.Errorf("expected no time in an unknown zone, got %q", got)
+	}
+}
+
+func TestCountryIsEU(t *testing.T) {
+	raw, _ := json.Marshal(country{codename: codename{Code: "DE", Name: "Germany"}, IsEU: true})
+	if expected := `{"code":"DE","name":"Germany","is_eu":true}`; string(raw) != expected {
+		t.Errorf("unexpected country:\ngot  %v\nwant %v", string(raw), expected)
+	}
+}
+
+func TestCountryFacts(t *testing.T) {
+	for code, expected := range map[string]countryFact{
+		"US": {"USD", "+1"},
+		"DE": {"EUR", "+49"},
+		"GB": {"GBP", "+44"},
+		"JP": {"JPY", "+81"},
+		"XK": {"EUR", "+383"},
+	} {
+		if got := countryFacts[code]; got != expected {
+			t.Errorf("%v: got %+v want %+v", code, got, expected)
+		}
+	}
+	for code, fact := range countryFacts {
+		if len(code) != 2 || (fact.currency != "" && len(fact.currency) != 3) ||
+			(fact.callingCode != "" && !strings.HasPrefix(fact.callingCode, "+")) {
+			t.Errorf("malformed facts for %v: %+v", code, fact)
+		}
+	}
+}
+
+func TestFlagEmoji(t *testing.T) {
+	for code, expected := range map[string]string{
+		"US":  "\U0001F1FA\U0001F1F8",
+		"DE":  "\U0001F1E9\U0001F1EA",
+		"":    "",
+		"de":  "",
+		"USA": "",
+	} {
+		if got := flagEmoji(code); got != expected {
+			t.Errorf("%q: got %q want %q", code, got, expected)
+		}
+	}
+}
+
+func TestClassifyIP(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"8.8.8.8":         "",
+		"10.1.2.3":        "private",
+		"172.31.255.255":  "private",
+		"172.32.0.1":      "",
+		"100.64.0.1":      "cgnat",
+		"127.0.0.1":       "loopback",
+		"169.254.1.1":     "link-local",
+		"192.0.2.1":       "documentation",
+		"198.18.0.1":      "benchmarking",
+		"224.0.0.251":     "multicast",
+		"255.255.255.255": "broadcast",
+		"240.0.0.1":       "reserved",
+		"0.0.0.0":         "this-network",
+		"::":              "unspecified",
+		"::1":             "loopback",
+		"::ffff:10.0.0.1": "private",
+		"2001:db8::1":     "documentation",
+		"fd00::1":         "private",
+		"fe80::1":         "link-local",
+		"ff02::1":         "multicast",
+		"2001:4860::8888": "",
+	} {
+		if got := classifyIP(net.ParseIP(ip)); got != expected {
+			t.Errorf("%v: got %q want %q", ip, got, expected)
+		}
+	}
+}
+
+func TestNewPrivacy(t *testing.T) {
+	raw, _ := json.Marshal(newPrivacy(&geoip2.AnonymousIP{IsAnonymous: true, IsTorExitNode: true}))
+	if expected := `{"vpn":false,"proxy":false,"tor":true,"hosting":false,"anonymous":true}`; string(raw) != expected {
+		t.Errorf("unexpected privacy:\ngot  %v\nwant %v", string(raw), expected)
+	}
+}
+
+func TestCountryDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "country")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The test City database, relabeled as a Country database.
+	db, err := ioutil.ReadFile("assets/GeoLite2-City.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = bytes.Replace(db, []byte("\x4dGeoLite2-City"), []byte("\x4eGeoIP2-Country"), 1)
+	if err := ioutil.WriteFile(dir+"/GeoLite2-Country.mmdb", db, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ConfigFromFlags(dir + "/")
+	if cfg.CityDB != dir+"/GeoLite2-Country.mmdb" {
+		t.Fatalf("expected the Country database without a City one, got %v", cfg.CityDB)
+	}
+
+	country, countryNetworks, err := openDatabase(cfg.CityDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer country.Close()
+	defer countryNetworks.Close()
+
+	dbLock.Lock()
+	city, cityNetworks := dbCity, netCity
+	dbCity, netCity = country, countryNetworks
+	dbLock.Unlock()
+	defer func() {
+		dbLock.Lock()
+		dbCity, netCity = city, cityNetworks
+		dbLock.Unlock()
+	}()
+
+	info, err := lookupDatabases(net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatalf("expected the Country database to be looked up, got %v", err)
+	}
+	if info.Postal != nil {
+		t.Errorf("expected no postal code from a Country database, got %q", *info.Postal)
+	}
+}
+
+func TestLayers(t *testing.T) {
+	defer func(l []*geoip2.Reader) { dbLayers = l }(dbLayers)
+
+	rec := geoip2.City{}
+	rec.City.Names = map[string]string{"en": "DC-East"}
+	rec.Location.Latitude, rec.Location.Longitude = 38.9, -77.4
+	below := geoip2.City{}
+	below.City.Names = map[string]string{"en": "Ashburn"}
+	below.Country.IsoCode = "US"
+	below.Location.Latitude, below.Location.Longitude, below.Location.TimeZone = 39, -77.5, "America/New_York"
+	mergeCity(&rec, &below)
+	if rec.City.Names["en"] != "DC-East" || rec.Location.Latitude != 38.9 {
+		t.Errorf("expected the fields of the first layer to win, got %+v", rec)
+	}
+	if rec.Country.IsoCode != "US" || rec.Location.TimeZone != "America/New_York" {
+		t.Errorf("expected missing fields to be taken from below, got %+v", rec)
+	}
+
+	// The City database as a layer over a Country database still yields
+	// city level lookups.
+	db, err := ioutil.ReadFile("assets/GeoLite2-City.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	country, err := geoip2.FromBytes(bytes.Replace(db, []byte("\x4dGeoLite2-City"), []byte("\x4eGeoIP2-Country"), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer country.Close()
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	dbLayers = []*geoip2.Reader{nil, dbCity}
+	if _, cityLevel, err := lookupLayers(net.ParseIP("10.0.0.1"), country); err != nil || !cityLevel {
+		t.Errorf("expected a city level lookup, got %v, %v", cityLevel, err)
+	}
+}
+
+func TestLangLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.10.10.10?lang=ja"
+	obj.function = Lookup
+	obj.headers = []http.Header{{"Accept-Language": {"de"}}}
+	obj.expectedStatus = http.StatusOK
+	// The parameter takes precedence over Accept-Language.
+	obj.expectedHeader = http.Header{"Vary": {"Accept"}}
+	obj.expectedBody = `{"ip":"10.10.10.10","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestWebhook(t *testing.T) {
+	defer func(url, countries, asns string) {
+		*WebhookURL, *WebhookCountries, *WebhookASNs = url, countries, asns
+		initializeWebhook()
+	}(*WebhookURL, *WebhookCountries, *WebhookASNs)
+
+	received := make(chan ipInfo, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info ipInfo
+		json.NewDecoder(r.Body).Decode(&info)
+		received <- info
+	}))
+	defer server.Close()
+	stale := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("lookup delivered to the replaced webhook URL")
+	}))
+	defer stale.Close()
+
+	// Re-initializing swaps the configuration of the one running worker.
+	*WebhookURL, *WebhookCountries, *WebhookASNs = stale.URL, "GB", ""
+	initializeWebhook()
+	*WebhookURL, *WebhookCountries, *WebhookASNs = server.URL, "US", "AS15169"
+	initializeWebhook()
+
+	notifyWebhook(ipInfo{IP: "192.0.2.1", Country: country{codename: codename{Code: "GB"}}})
+	notifyWebhook(ipInfo{IP: "192.0.2.2", ASN: 15169})
+
+	select {
+	case info := <-received:
+		if info.IP != "192.0.2.2" {
+			t.Errorf("wrong lookup delivered: got %v want 192.0.2.2", info.IP)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("matching lookup was not delivered")
+	}
+	select {
+	case info := <-received:
+		t.Errorf("lookup delivered twice: got %v", info.IP)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookReload(t *testing.T) {
+	defer func(url, countries string) {
+		*WebhookURL, *WebhookCountries = url, countries
+		initializeWebhook()
+	}(*WebhookURL, *WebhookCountries)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Start from a webhook that was never enabled.
+	webhookLock.Lock()
+	if webhookQueue != nil {
+		close(webhookQueue)
+		webhookQueue = nil
+	}
+	webhookLock.Unlock()
+	*WebhookURL, *WebhookCountries = "", "US"
+	initializeWebhook()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Lookups that do not match leave nothing queued for the
+				// tests after this one.
+				notifyWebhook(ipInfo{IP: "192.0.2.1", Country: country{codename: codename{Code: "DE"}}})
+			}
+		}()
+	}
+
+	// Run with -race, enabling the webhook must not race the lookups.
+	*WebhookURL = server.URL
+	initializeWebhook()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	webhookLock.Lock()
+	queue := webhookQueue
+	webhookQueue = nil
+	webhookLock.Unlock()
+	if queue == nil {
+		t.Fatalf("expected enabling the webhook to start its queue")
+	}
+	close(queue)
+}
+
+func TestClosestAirport(t *testing.T) {
+	defer func(dataset []airport) { airports = dataset }(airports)
+
+	airports = nil
+	if nearest := closestAirport(37.386, -122.0838); nearest != nil {
+		t.Errorf("no dataset should find no airport: got %+v", nearest)
+	}
+
+	airports = []airport{
+		{"JFK", 40.6413, -73.7781},
+		{"SFO", 37.6213, -122.3790},
+		{"LHR", 51.4700, -0.4543},
+	}
+	nearest := closestAirport(37.386, -122.0838)
+	if nearest == nil || nearest.IATA != "SFO" || nearest.Distance != 36.9 {
+		t.Errorf("wrong airport: got %+v want SFO at 36.9km", nearest)
+	}
+}
+
+func TestGreatCircle(t *testing.T) {
+	// London Heathrow to New York JFK is about 5540km.
+	if d := greatCircle(51.4700, -0.4543, 40.6413, -73.7781); math.Abs(d-5540) > 10 {
+		t.Errorf("wrong distance: got %v want ~5540", d)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	defer func(level int) { *GzipLevel = level }(*GzipLevel)
+	handler := Compress(http.HandlerFunc(Lookup))
+
+	for _, level := range []int{0, 1, 9} {
+		*GzipLevel = level
+		req := httptest.NewRequest("GET", "/10.10.10.10", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		body := rr.Body.String()
+		if level > 0 {
+			if rr.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("level %v: response should be gzipped", level)
+			}
+			gz, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, _ := ioutil.ReadAll(gz)
+			body = string(raw)
+		} else if rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("level 0 should disable compression")
+		}
+		if !strings.HasPrefix(body, `{"ip":"10.10.10.10"`) {
+			t.Errorf("level %v: unexpected body '%v'", level, body)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=1.0": true,
+		"br, *":               true,
+		"gzip;q=0":            false,
+		"identity":            false,
+	}
+	for header, expected := range tests {
+		if got := acceptsGzip(header); got != expected {
+			t.Errorf("Accept-Encoding '%v': got %v want %v", header, got, expected)
+		}
+	}
+}
+
+func benchmarkGzipLevel(b *testing.B, level int, payload []byte) {
+	b.ResetTimer()
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, level)
+	b.SetBytes(int64(len(payload)))
+	for n := 0; n < b.N; n++ {
+		buf.Reset()
+		gz.Reset(&buf)
+		gz.Write(payload)
+		gz.Close()
+	}
+	b.ReportMetric(float64(buf.Len())/float64(len(payload)), "ratio")
+}
+
+var gzipLookupPayload = []byte(`{"ip":"8.8.8.8","city":"Mountain View","region":"California",` +
+	`"country":{"code":"US","name":"United States"},"continent":{"code":"NA","name":"North America"},` +
+	`"location":{"latitude":37.386,"longitude":-122.0838},"postal":"94040","asn":15169,"organization":"Google LLC"}`)
+
+// gzipBatchPayload is the JSON answer to a batch of 1000 lookups, from City
+// and ASN databases of varied places and networks.
+func gzipBatchPayload(b *testing.B) []byte {
+	random := rand.New(rand.NewSource(1))
+	var subdivisions, continents []string
+	for code := range isoSubdivisionNames {
+		subdivisions = append(subdivisions, code)
+	}
+	for code := range continentNames {
+		continents = append(continents, code)
+	}
+	sort.Strings(subdivisions)
+	sort.Strings(continents)
+	timeZones := []string{"America/New_York", "America/Chicago", "Europe/Berlin", "Europe/London", "Asia/Tokyo", "Asia/Kolkata", "Australia/Sydney", "America/Sao_Paulo"}
+	names := func(name string) map[string]interface{} { return map[string]interface{}{"en": name} }
+
+	cities := map[string]map[string]interface{}{}
+	asns := map[string]map[string]interface{}{}
+	var ips []net.IP
+	for len(ips) < 1000 {
+		ip := net.IPv4(byte([]int{3, 8, 23, 31, 45, 52, 77, 88, 104, 151, 176, 185, 193, 212}[random.Intn(14)]), byte(random.Intn(256)), byte(random.Intn(256)), 1)
+		network := ip.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		if cities[network] != nil {
+			continue
+		}
+		subdivision := subdivisions[random.Intn(len(subdivisions))]
+		country := subdivision[:2]
+		continent := continents[random.Intn(len(continents))]
+		cities[network] = map[string]interface{}{
+			"city":         map[string]interface{}{"geoname_id": uint32(random.Intn(10000000)), "names": names(isoSubdivisionNames[subdivisions[random.Intn(len(subdivisions))]])},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": subdivision[3:], "names": names(isoSubdivisionNames[subdivision])}},
+			"country":      map[string]interface{}{"iso_code": country, "names": names(isoCountryNames[country])},
+			"continent":    map[string]interface{}{"code": continent, "names": names(continentNames[continent])},
+			"location": map[string]interface{}{
+				"latitude":        math.Round((random.Float64()*140-70)*1e4) / 1e4,
+				"longitude":       math.Round((random.Float64()*360-180)*1e4) / 1e4,
+				"accuracy_radius": uint16([]int{5, 10, 20, 50, 100, 200, 500, 1000}[random.Intn(8)]),
+				"time_zone":       timeZones[random.Intn(len(timeZones))],
+			},
+			"postal": map[string]interface{}{"code": strconv.Itoa(10000 + random.Intn(90000))},
+		}
+		asns[network] = map[string]interface{}{
+			"autonomous_system_number":       uint32(1000 + random.Intn(400000)),
+			"autonomous_system_organization": "AS" + strconv.Itoa(random.Intn(5000)) + " Networks " + isoCountryNames[country],
+		}
+		ips = append(ips, ip)
+	}
+
+	dir, err := ioutil.TempDir("", "gzip")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeMMDB(b, dir+"/GeoLite2-City.mmdb", "GeoLite2-City", cities)
+	writeMMDB(b, dir+"/GeoLite2-ASN.mmdb", "GeoLite2-ASN", asns)
+	city, cityNetworks, err := openDatabase(dir + "/GeoLite2-City.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	asn, asnNetworks, err := openDatabase(dir + "/GeoLite2-ASN.mmdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dbLock.Lock()
+	oldCity, oldCityNetworks, oldASN, oldASNNetworks := dbCity, netCity, dbASN, netASN
+	dbCity, netCity, dbASN, netASN = city, cityNetworks, asn, asnNetworks
+	dbLock.Unlock()
+	var results []ipInfo
+	for _, ip := range ips {
+		info, err := LookupIP(ip)
+		if err != nil {
+			b.Fatal(err)
+		}
+		results = append(results, info)
+	}
+	dbLock.Lock()
+	dbCity, netCity, dbASN, netASN = oldCity, oldCityNetworks, oldASN, oldASNNetworks
+	dbLock.Unlock()
+	lookupCache.purge()
+	for _, closer := range []io.Closer{city, cityNetworks, asn, asnNetworks} {
+		closer.Close()
+	}
+
+	payload, err := json.Marshal(results)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return payload
+}
+
+func BenchmarkGzipLookup1(b *testing.B) { benchmarkGzipLevel(b, 1, gzipLookupPayload) }
+func BenchmarkGzipLookup6(b *testing.B) { benchmarkGzipLevel(b, 6, gzipLookupPayload) }
+func BenchmarkGzipLookup9(b *testing.B) { benchmarkGzipLevel(b, 9, gzipLookupPayload) }
+func BenchmarkGzipBatch1(b *testing.B)  { benchmarkGzipLevel(b, 1, gzipBatchPayload(b)) }
+func BenchmarkGzipBatch6(b *testing.B)  { benchmarkGzipLevel(b, 6, gzipBatchPayload(b)) }
+func BenchmarkGzipBatch9(b *testing.B)  { benchmarkGzipLevel(b, 9, gzipBatchPayload(b)) }
+
+type fakeResolver struct {
+	ptr     map[string][]string
+	forward map[string][]net.IPAddr
+}
+
+func (f fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := f.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := f.forward[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestReverseLookup(t *testing.T) {
+	defer func(r dnsResolver) { resolver = r }(resolver)
+	resolver = fakeResolver{
+		ptr: map[string][]string{
+			"10.0.0.1": {"mail.example.com."},
+			"10.0.0.2": {"spoofed.example.com."},
+			"10.0.0.3": {"dangling.example.com."},
+		},
+		forward: map[string][]net.IPAddr{
+			"mail.example.com.":    {{IP: net.ParseIP("10.0.0.1")}},
+			"spoofed.example.com.": {{IP: net.ParseIP("10.9.9.9")}},
+		},
+	}
+
+	tests := []struct {
+		url      string
+		hostname string
+	}{
+		{"/10.0.0.1?reverse=1", `"hostname":"mail.example.com",`},
+		{"/10.0.0.1?reverse=1&fcrdns=1", `"hostname":"mail.example.com","forward_confirmed":true,`},
+		{"/10.0.0.2?reverse=1&fcrdns=1", `"hostname":"spoofed.example.com","forward_confirmed":false,`},
+		{"/10.0.0.3?reverse=1&fcrdns=1", `"hostname":"dangling.example.com",`},
+		{"/10.0.0.4?reverse=1&fcrdns=1", ``},
+		{"/10.0.0.1?fcrdns=1", ``},
+	}
+	for _, test := range tests {
+		var obj = new()
+		obj.url = test.url
+		obj.function = Lookup
+		obj.expectedStatus = http.StatusOK
+		obj.expectedBody = `{"ip":"` + strings.Split(test.url[1:], "?")[0] + `",` + test.hostname +
+			`"city":"","region":"","country":{"code":"","name":""},` +
+			`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+			`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+		testHTTPFunc(t, obj)
+	}
+}
+
+func TestEUI64Lookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/2001:db8::211:22ff:fe33:4455"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"ip":"2001:db8::211:22ff:fe33:4455","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","mac":"00:11:22:33:44:55","bogon":true,"type":"documentation"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestEUI64MAC(t *testing.T) {
+	tests := map[string]string{
+		"fe80::21a:2bff:fe3c:4d5e": "00:1a:2b:3c:4d:5e",
+		"2001:db8::1":              "",
+		"::ffff:254.1.2.3":         "",
+		"10.0.0.1":                 "",
+	}
+	for ip, expected := range tests {
+		var got string
+		if mac := eui64MAC(net.ParseIP(ip)); mac != nil {
+			got = mac.String()
+		}
+		if got != expected {
+			t.Errorf("%v: got '%v' want '%v'", ip, got, expected)
+		}
+	}
+}
+
+func TestLogOrganization(t *testing.T) {
+	defer func(l zerolog.Logger, enabled bool, o []override) {
+		log.Logger, *LogOrganization, overrides = l, enabled, o
+	}(log.Logger, *LogOrganization, overrides)
+	var buf bytes.Buffer
+	log.Logger = zerolog.New(&buf)
+	*LogOrganization = true
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	overrides = []override{{network, ipInfo{Organization: "Example", ISP: strings.Repeat("x", 100)}}}
+
+	Lookup(httptest.NewRecorder(), httptest.NewRequest("GET", "/192.0.2.1", nil))
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["organization"] != "Example" || line["isp"] != strings.Repeat("x", maxLoggedOrganization) {
+		t.Errorf("expected the organization and truncated ISP, got %v", line)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"Google LLC", 64, "Google LLC"},
+		{"Google LLC", 6, "Google"},
+		{"Société Générale", 5, "Socié"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.s, test.n); got != test.expected {
+			t.Errorf("truncate(%v, %v): got '%v' want '%v'", test.s, test.n, got, test.expected)
+		}
+	}
+}
+
+func TestResolveHostTrailingDot(t *testing.T) {
+	defer func(r dnsResolver) { resolver = r }(resolver)
+	resolver = fakeResolver{
+		forward: map[string][]net.IPAddr{
+			"example.com.": {{IP: net.ParseIP("192.0.2.10")}, {IP: net.ParseIP("2001:db8::10")}},
+		},
+	}
+
+	for _, host := range []string{"example.com", "example.com.", "EXAMPLE.com."} {
+		name, ips, err := resolveHost(context.Background(), host)
+		if err != nil {
+			t.Fatalf("%v: %v", host, err)
+		}
+		if name != "example.com" {
+			t.Errorf("%v: resolved from '%v' want 'example.com'", host, name)
+		}
+		if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.10")) || !ips[1].Equal(net.ParseIP("2001:db8::10")) {
+			t.Errorf("%v: wrong addresses %v", host, ips)
+		}
+	}
+}
+
+func TestHostLookup(t *testing.T) {
+	defer func(r dnsResolver, h bool) { resolver, *HostnameLookups = r, h }(resolver, *HostnameLookups)
+	resolver = fakeResolver{forward: map[string][]net.IPAddr{
+		"example.com.": {{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("2001:db8::1")}},
+	}}
+
+	*HostnameLookups = false
+	rr := httptest.NewRecorder()
+	Lookup(rr, httptest.NewRequest("GET", "/example.com", nil))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected hostnames to be refused unless enabled, got %v", rr.Code)
+	}
+
+	*HostnameLookups = true
+	var dotless string
+	for _, url := range []string{"/example.com", "/example.com.", "/Example.com.", "/lookup?host=example.com."} {
+		rr = httptest.NewRecorder()
+		Lookup(rr, httptest.NewRequest("GET", url, nil))
+		var results []ipInfo
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected a JSON array, got %v: %s", url, rr.Code, rr.Body.String())
+		}
+		if len(results) != 2 || results[0].IP != "10.0.0.1" || results[1].IP != "2001:db8::1" {
+			t.Errorf("%s: expected a lookup per address, got %+v", url, results)
+		}
+		if results[0].ResolvedFrom != "example.com" || results[1].ResolvedFrom != "example.com" {
+			t.Errorf("%s: expected resolved_from example.com, got %+v", url, results)
+		}
+		// The trailing dot resolves identically to the dotless form.
+		if dotless == "" {
+			dotless = rr.Body.String()
+		} else if rr.Body.String() != dotless {
+			t.Errorf("%s: got %s want %s", url, rr.Body.String(), dotless)
+		}
+	}
+
+	for url, expected := range map[string]int{
+		"/nxdomain.example":    http.StatusNotFound,
+		"/lookup?host=-bad-.x": http.StatusBadRequest,
+		"/lookup":              http.StatusBadRequest,
+	} {
+		rr = httptest.NewRecorder()
+		Lookup(rr, httptest.NewRequest("GET", url, nil))
+		if rr.Code != expected {
+			t.Errorf("%s: expected %v, got %v", url, expected, rr.Code)
+		}
+	}
+}
+
+// countingResolver counts the reverse lookups that reach it.
+type countingResolver struct {
+	fakeResolver
+	lookups *int
+}
+
+func (c countingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	*c.lookups++
+	return c.fakeResolver.LookupAddr(ctx, addr)
+}
+
+func TestHostnameCache(t *testing.T) {
+	defer func(r dnsResolver, c *ttlCache) { resolver, hostnames = r, c }(resolver, hostnames)
+	var lookups int
+	resolver = countingResolver{fakeResolver{ptr: map[string][]string{"10.0.0.1": {"Mail.example.com."}}}, &lookups}
+	hostnames = newTTLCache(1, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if got := reverseLookup(context.Background(), net.ParseIP("10.0.0.1")); got != "mail.example.com" {
+			t.Errorf("expected mail.example.com, got %q", got)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected the second lookup from the cache, got %v lookups", lookups)
+	}
+
+	// A missing PTR record is cached too, evicting the oldest entry.
+	reverseLookup(context.Background(), net.ParseIP("10.0.0.2"))
+	reverseLookup(context.Background(), net.ParseIP("10.0.0.2"))
+	reverseLookup(context.Background(), net.ParseIP("10.0.0.1"))
+	if lookups != 3 {
+		t.Errorf("expected the cache to hold one entry, got %v lookups", lookups)
+	}
+
+	if _, ok := hostnames.get("10.0.0.1", time.Now().Add(2*time.Hour)); ok {
+		t.Error("expected the entry to expire")
+	}
+}
+
+func TestSortedLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.10.10.10?sort=1&proj=webmercator"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"asn":0,"bogon":true,"city":"","continent":{"code":"","name":""},"country":{"code":"","name":""},` +
+		`"ip":"10.10.10.10","location":{"latitude":0,"longitude":0},"organization":"","postal":"","region":"","type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestSortedFields(t *testing.T) {
+	postal := ""
+	info := ipInfo{IP: "192.0.2.1", Location: location{Latitude: 37.386, Longitude: -122.0838}, Postal: &postal, ASN: 15169}
+	raw, _ := json.Marshal(sortedFields(info))
+	expected := `{"asn":15169,"city":"","country":{"code":"","name":""},"ip":"192.0.2.1",` +
+		`"location":{"latitude":37.386,"longitude":-122.0838},"organization":"","postal":"","region":""}`
+	if string(raw) != expected {
+		t.Errorf("unexpected sorted output:\ngot  %v\nwant %v", string(raw), expected)
+	}
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveBinaryConn(server)
+
+	// Pipeline an IPv4 request, an IPv6 request and a malformed one.
+	var req bytes.Buffer
+	req.Write([]byte{0, 4, 10, 0, 0, 1})
+	req.Write([]byte{0, 16})
+	req.Write(net.ParseIP("2001:db8::1"))
+	req.Write([]byte{0, 3, 1, 2, 3})
+	go client.Write(req.Bytes())
+
+	expected := []struct {
+		status byte
+		ip     net.IP
+	}{
+		{binaryStatusOK, net.ParseIP("10.0.0.1")},
+		{binaryStatusOK, net.ParseIP("2001:db8::1")},
+		{binaryStatusBadRequest, make(net.IP, 16)},
+	}
+	for i, want := range expected {
+		resp := make([]byte, 2+binaryResponseSize)
+		if _, err := io.ReadFull(client, resp); err != nil {
+			t.Fatalf("response %v: %v", i, err)
+		}
+		if length := binary.BigEndian.Uint16(resp); length != binaryResponseSize {
+			t.Errorf("response %v: wrong length %v", i, length)
+		}
+		if resp[2] != binaryVersion || resp[3] != want.status {
+			t.Errorf("response %v: got version %v status %v want %v %v", i, resp[2], resp[3], binaryVersion, want.status)
+		}
+		if ip := net.IP(resp[4:20]); !ip.Equal(want.ip) {
+			t.Errorf("response %v: got ip %v want %v", i, ip, want.ip)
+		}
+	}
+}
+
+func TestOpenDatabaseInMemory(t *testing.T) {
+	defer func(mode string) { *DBLoadMode = mode }(*DBLoadMode)
+
+	for _, mode := range []string{loadModeMmap, loadModeMemory} {
+		*DBLoadMode = mode
+		db, networks, err := openDatabase("assets/GeoLite2-City.mmdb")
+		if err != nil {
+			t.Fatalf("%v: %v", mode, err)
+		}
+		if _, err := db.City(net.ParseIP("10.0.0.1")); err != nil {
+			t.Errorf("%v: %v", mode, err)
+		}
+		var none struct{}
+		if _, _, err := networks.LookupNetwork(net.ParseIP("10.0.0.1"), &none); err != nil {
+			t.Errorf("%v: %v", mode, err)
+		}
+		db.Close()
+		networks.Close()
+	}
+}
+
+func TestLoadPopulations(t *testing.T) {
+	f, err := ioutil.TempFile("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("5375480\tMountain View\tMountain View\tMaunten-Vju\t37.38605\t-122.08385\tP\tPPL\tUS\t\tCA\t085\t\t\t82376\t32\t31\tAmerica/Los_Angeles\t2019-09-05\n")
+	f.WriteString("2643743\tLondon\tLondon\t\t51.50853\t-0.12574\tP\tPPLC\tGB\t\tENG\tGLA\t\t\t0\t\t25\tEurope/London\t2019-09-18\n")
+	f.WriteString("garbage\n")
+	f.Close()
+
+	m, err := loadPopulations(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[5375480] != 82376 {
+		t.Errorf("unexpected populations: %v", m)
+	}
+}
+
+func TestLocalizedName(t *testing.T) {
+	defer func(v string, m map[uint]string, fill bool) {
+		*EmptyNames, placeNames, *GeoNamesNames = v, m, fill
+	}(*EmptyNames, placeNames, *GeoNamesNames)
+
+	*EmptyNames = ""
+	placeNames = nil
+	*GeoNamesNames = false
+	if got, _ := localizedName(place{map[string]string{"en": "London", "de": "London"}, 2643743, ""}, "city", "en"); got != "London" {
+		t.Errorf("expected London, got %q", got)
+	}
+	if got, _ := localizedName(place{map[string]string{"de": "Mailand"}, 3173435, ""}, "city", "en"); got != "" {
+		t.Errorf("expected no name outside the locale, got %q", got)
+	}
+	if got, _ := localizedName(place{nil, 3173435, ""}, "city", "en"); got != "" {
+		t.Errorf("expected blank name, got %q", got)
+	}
+	if got, _ := localizedName(place{nil, 2921044, "DE"}, "country", "en"); got != "" {
+		t.Errorf("expected no built-in name unless enabled, got %q", got)
+	}
+
+	*EmptyNames = "geonameid"
+	if got, _ := localizedName(place{nil, 3173435, ""}, "city", "en"); got != "geonames:3173435" {
+		t.Errorf("expected geonames:3173435, got %q", got)
+	}
+	if got, _ := localizedName(place{nil, 0, ""}, "city", "en"); got != "" {
+		t.Errorf("expected blank name without a GeoNames ID, got %q", got)
+	}
+
+	*GeoNamesNames = true
+	placeNames = map[uint]string{3173435: "Milan"}
+	for _, test := range []struct {
+		p      place
+		field  string
+		name   string
+		source string
+	}{
+		{place{nil, 3173435, ""}, "city", "Milan", "geonames"},
+		{place{map[string]string{"en": "Milan"}, 3173435, ""}, "city", "Milan", ""},
+		{place{nil, 2921044, "DE"}, "country", "Germany", "builtin"},
+		{place{nil, 2953481, "DE-BY"}, "region", "Bayern", "builtin"},
+		{place{nil, 2953481, "DE-BY"}, "subdivision", "Bayern", "builtin"},
+		{place{nil, 6255148, "EU"}, "continent", "Europe", "builtin"},
+		{place{nil, 1, "ZZ"}, "country", "geonames:1", ""},
+	} {
+		if name, source := localizedName(test.p, test.field, "en"); name != test.name || source != test.source {
+			t.Errorf("%v %v: got %q from %q want %q from %q", test.field, test.p, name, source, test.name, test.source)
+		}
+	}
+}
+
+func TestNameSources(t *testing.T) {
+	defer func(fill bool) { *GeoNamesNames = fill }(*GeoNamesNames)
+	*GeoNamesNames = true
+
+	info := ipInfo{}
+	info.places.city = place{nil, 3173435, ""}
+	info.places.country = place{nil, 3175395, "IT"}
+	info.Continent = &codename{Code: "EU"}
+	info.places.continent = place{map[string]string{"en": "Europe"}, 6255148, "EU"}
+	shared := info
+	info.localize("en")
+	info.setSubdivisions([]subdivision{{Code: "25", Name: "Lombardia", nameSource: "builtin"}})
+	if info.Country.Name != "Italy" || info.Continent.Name != "Europe" {
+		t.Errorf("got %+v", info)
+	}
+	if expected := map[string]string{"country": "builtin", "subdivisions": "builtin"}; !reflect.DeepEqual(info.NameSources, expected) {
+		t.Errorf("got sources %v want %v", info.NameSources, expected)
+	}
+	if shared.NameSources != nil {
+		t.Errorf("the sources of a shared lookup changed to %v", shared.NameSources)
+	}
+}
+
+func TestLoadPlaceNames(t *testing.T) {
+	f, err := ioutil.TempFile("", "cities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("2643743\tLondon\tLondon\t\t51.50853\t-0.12574\tP\tPPLC\tGB\t\tENG\tGLA\t\t\t0\t\t25\tEurope/London\t2019-09-18\n")
+	f.Close()
+
+	m, err := loadPlaceNames(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[2643743] != "London" {
+		t.Errorf("unexpected place names: %v", m)
+	}
+}
+
+func TestServerIP(t *testing.T) {
+	defer setServerIP(currentServerIP())
+	defer func(url string) { *ServerIPURL = url }(*ServerIPURL)
+	serverIP.ip = nil
+
+	*ServerIPURL = ""
+	rr := httptest.NewRecorder()
+	ServerIP(rr, httptest.NewRequest("GET", "/server-ip", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when disabled, got %v", rr.Code)
+	}
+
+	*ServerIPURL = "http://checkip.invalid"
+	rr = httptest.NewRecorder()
+	ServerIP(rr, httptest.NewRequest("GET", "/server-ip", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before resolving, got %v", rr.Code)
+	}
+
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.7\n"))
+	}))
+	defer echo.Close()
+
+	ip, err := fetchServerIP(echo.URL)
+	if err != nil || !ip.Equal(net.ParseIP("192.0.2.7")) {
+		t.Fatalf("expected 192.0.2.7, got %v (%v)", ip, err)
+	}
+	setServerIP(ip)
+
+	rr = httptest.NewRecorder()
+	ServerIP(rr, httptest.NewRequest("GET", "/server-ip", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"ip":"192.0.2.7"`) {
+		t.Errorf("unexpected response %v: %s", rr.Code, rr.Body.String())
+	}
+
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>"))
+	}))
+	defer garbage.Close()
+	if _, err := fetchServerIP(garbage.URL); err == nil {
+		t.Errorf("expected an error for a non-IP answer")
+	}
+}
+
+func TestTorExits(t *testing.T) {
+	defer setTorExits(nil)
+
+	if info, _ := LookupIP(net.ParseIP("192.0.2.7")); info.Tor != nil {
+		t.Errorf("expected no tor without the exit list, got %v", *info.Tor)
+	}
+
+	list := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# exit nodes\n192.0.2.7\n2001:db8::7\n"))
+	}))
+	defer list.Close()
+
+	ips, err := fetchTorExits(list.URL)
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("expected 2 exits, got %v (%v)", ips, err)
+	}
+	setTorExits(ips)
+
+	for ip, tor := range map[string]bool{"192.0.2.7": true, "2001:db8:0::7": true, "192.0.2.8": false} {
+		if info, _ := LookupIP(net.ParseIP(ip)); info.Tor == nil || *info.Tor != tor {
+			t.Errorf("expected tor %v for %s, got %v", tor, ip, info.Tor)
+		}
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	if _, err := fetchTorExits(failing.URL); err == nil {
+		t.Errorf("expected an error for a failed download")
+	}
+}
+
+func TestCloudRanges(t *testing.T) {
+	defer setCloudRanges(nil)
+
+	feeds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/aws":
+			w.Write([]byte(`{"prefixes":[` +
+				`{"ip_prefix":"192.0.2.0/24","region":"us-east-1","service":"EC2"},` +
+				`{"ip_prefix":"192.0.2.0/24","region":"us-east-1","service":"AMAZON"},` +
+				`{"ip_prefix":"198.51.100.0/24","region":"eu-west-1","service":"AMAZON"}],` +
+				`"ipv6_prefixes":[{"ipv6_prefix":"2001:db8::/32","region":"GLOBAL","service":"AMAZON"}]}`))
+		case "/cloudflare":
+			w.Write([]byte("192.0.2.128/25\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer feeds.Close()
+
+	networks := make(map[string]*cloud)
+	for _, feed := range []cloudFeed{
+		{"aws", feeds.URL + "/aws", parseAWSRanges},
+		{"cloudflare", feeds.URL + "/cloudflare", parseCloudflareRanges},
+	} {
+		n, err := fetchCloudFeed(feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cidr, c := range n {
+			networks[cidr] = c
+		}
+	}
+	setCloudRanges(networks)
+
+	for ip, expected := range map[string]*cloud{
+		"192.0.2.7":       {Provider: "aws", Region: "us-east-1", Service: "EC2"},
+		"192.0.2.200":     {Provider: "cloudflare"},
+		"198.51.100.1":    {Provider: "aws", Region: "eu-west-1", Service: "AMAZON"},
+		"2001:db8::1":     {Provider: "aws", Region: "GLOBAL", Service: "AMAZON"},
+		"203.0.113.1":     nil,
+		"::ffff:c000:207": {Provider: "aws", Region: "us-east-1", Service: "EC2"},
+	} {
+		info, _ := LookupIP(net.ParseIP(ip))
+		if !reflect.DeepEqual(info.Cloud, expected) {
+			t.Errorf("expected %+v for %s, got %+v", expected, ip, info.Cloud)
+		}
+	}
+
+	if _, err := fetchCloudFeed(cloudFeed{"gcp", feeds.URL + "/gcp", parseGCPRanges}); err == nil {
+		t.Errorf("expected an error for a failed download")
+	}
+}
+
+func TestRPKI(t *testing.T) {
+	validator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := map[string]string{
+			"/api/v1/validity/AS15169/8.8.8.0/24": "valid",
+			"/api/v1/validity/AS64500/8.8.8.0/24": "invalid",
+		}[r.URL.Path]
+		if state == "" {
+			state = "not-found"
+		}
+		fmt.Fprintf(w, `{"validated_route":{"route":{"origin_asn":"AS0","prefix":""},"validity":{"state":%q}}}`, state)
+	}))
+	defer validator.Close()
+
+	_, prefix, _ := net.ParseCIDR("8.8.8.0/24")
+	for asn, expected := range map[uint]string{15169: "valid", 64500: "invalid", 64501: "not_found"} {
+		if state, err := fetchRPKIState(context.Background(), validator.URL+"/", asn, prefix); err != nil || state != expected {
+			t.Errorf("expected %s for AS%d, got %q (%v)", expected, asn, state, err)
+		}
+	}
+
+	// Without an ASN database there is no prefix to validate.
+	defer func(c *ttlCache) { rpkiStates = c }(rpkiStates)
+	rpkiStates = newTTLCache(1, time.Minute)
+	if state := rpkiState(context.Background(), net.ParseIP("8.8.8.8"), 15169); state != "" {
+		t.Errorf("expected no state without an ASN database, got %q", state)
+	}
+}
+
+func TestPprofHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	PprofHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "goroutine") {
+		t.Errorf("expected the pprof index, got %v", rr.Code)
+	}
+}
+
+func TestReloadOptionalDatabases(t *testing.T) {
+	defer func(db *geoip2.Reader, c Config) { dbISP, config = db, c }(dbISP, config)
+	dir, err := ioutil.TempDir("", "optional")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/GeoIP2-ISP.mmdb"
+	// Replaced by renaming over it, as a mapped file must not change.
+	replace := func(isp string) {
+		writeMMDB(t, path+".new", "GeoIP2-ISP", map[string]map[string]interface{}{"1.0.0.0/24": {"isp": isp}})
+		if err := os.Rename(path+".new", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isp := func() string {
+		dbLock.RLock()
+		defer dbLock.RUnlock()
+		rec, err := dbISP.ISP(net.ParseIP("1.0.0.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.ISP
+	}
+
+	replace("First")
+	config.ISPDB = path
+	dbISP = openOptionalDatabase(path, "ISP", "ISP info")
+	replace("Second")
+	if err := reloadDatabases(); err != nil {
+		t.Fatal(err)
+	}
+	if got := isp(); got != "Second" {
+		t.Errorf("expected the replaced ISP database after a reload, got %q", got)
+	}
+
+	os.Remove(path)
+	if err := reloadDatabases(); err != nil {
+		t.Fatal(err)
+	}
+	if got := isp(); got != "Second" {
+		t.Errorf("expected the current ISP database to be kept, got %q", got)
+	}
+	dbLock.RLock()
+	loadErr := loadErrors[path]
+	dbLock.RUnlock()
+	if loadErr == nil {
+		t.Errorf("expected the failed reopen to be recorded")
+	}
+	setLoadError(path, nil)
+	dbISP.Close()
+}
+
+func TestReloadUnderLoad(t *testing.T) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := LookupIP(net.ParseIP("10.0.0.1")); err != nil {
+					t.Errorf("lookup during reload: %v", err)
+					return
+				}
+				resultNetwork(net.ParseIP("2001:db8::1"))
+				lookupSubdivisions(net.ParseIP("10.0.0.1"))
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := reloadDatabases(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestEndpointName(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/":                           "self",
+		"/me":                         "self",
+		"/8.8.8.8":                    "lookup",
+		"/2001:db8::1/json":           "lookup",
+		"/8.8.8.8,1.1.1.1":            "multi",
+		"/batch":                      "batch",
+		"/server-ip":                  "server-ip",
+		"/asn/AS15169":                "asn",
+		"/203.0.113.0/24":             "lookup",
+		"/wp-login.php":               "other",
+		"/" + strings.Repeat("a", 64): "other",
+	} {
+		if got := endpointName(path); got != expected {
+			t.Errorf("%v: got %v want %v", path, got, expected)
+		}
+	}
+}
+
+func TestConfigFromFlags(t *testing.T) {
+	cfg := ConfigFromFlags("assets/")
+	if cfg.CityDB != "assets/GeoLite2-City.mmdb" || cfg.ASNDB != "assets/GeoLite2-ASN.mmdb" {
+		t.Errorf("unexpected database paths %q and %q", cfg.CityDB, cfg.ASNDB)
+	}
+	if cfg.EnterpriseDB != "" || cfg.GeoNames != "" {
+		t.Errorf("optional files that are not there should be left out, got %q and %q", cfg.EnterpriseDB, cfg.GeoNames)
+	}
+	if cfg.Locale != *Locale || cfg.LogOrganization != *LogOrganization {
+		t.Errorf("options should come from the flags")
+	}
+
+	defer func(city, asn string) { *CityDB, *ASNDB = city, asn }(*CityDB, *ASNDB)
+	*CityDB, *ASNDB = "dbip-city-lite.mmdb", "/var/lib/dbip-asn-lite.mmdb"
+	cfg = ConfigFromFlags("assets/")
+	if cfg.CityDB != "assets/dbip-city-lite.mmdb" || cfg.ASNDB != "/var/lib/dbip-asn-lite.mmdb" {
+		t.Errorf("expected the configured database paths, got %q and %q", cfg.CityDB, cfg.ASNDB)
+	}
+}
+
+func TestVendorDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vendor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	record := map[string]interface{}{
+		"city":     map[string]interface{}{"geoname_id": uint32(2950159), "names": map[string]interface{}{"en": "Berlin"}},
+		"country":  map[string]interface{}{"iso_code": "DE", "names": map[string]interface{}{"en": "Germany"}},
+		"location": map[string]interface{}{"latitude": 52.524, "longitude": 13.411},
+	}
+	writeMMDB(t, dir+"/dbip-city-lite.mmdb", "DBIP-City-Lite", map[string]map[string]interface{}{"1.0.0.0/24": record})
+	db, networks, err := openDatabase(dir + "/dbip-city-lite.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer networks.Close()
+	defer db.Close()
+	if rec, err := db.City(net.ParseIP("1.0.0.1")); err != nil || rec.City.Names["en"] != "Berlin" || rec.Country.IsoCode != "DE" {
+		t.Errorf("expected Berlin from the DB-IP database, got %+v (%v)", rec, err)
+	}
+
+	// IPinfo and IP2Location use their own layout, which is not supported.
+	writeMMDB(t, dir+"/ipinfo.mmdb", "ipinfo standard_location.mmdb", map[string]map[string]interface{}{"1.0.0.0/24": record})
+	if _, _, err := openDatabase(dir + "/ipinfo.mmdb"); err == nil {
+		t.Errorf("expected an error for an IPinfo database")
+	}
+}
+
+// writeMMDB writes an IPv6 MaxMind DB of database type kind, with a record
+// for each network. IPv4 networks are kept in ::/96, as MaxMind does.
+func writeMMDB(t testing.TB, path, kind string, records map[string]map[string]interface{}) {
+	type node struct {
+		child [2]*node
+		data  int
+	}
+	root := &node{data: -1}
+	var data bytes.Buffer
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, bits := network.Mask.Size()
+		ip := network.IP.To16()
+		if bits == 32 {
+			ip, ones = append(make(net.IP, 12), network.IP.To4()...), ones+96
+		}
+		n := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if n.child[bit] == nil {
+				n.child[bit] = &node{data: -1}
+			}
+			n = n.child[bit]
+		}
+		n.data = data.Len()
+		mmdbEncode(&data, record)
+	}
+
+	// Numbered depth first, leaves holding a record are not nodes.
+	var nodes []*node
+	var number func(n *node)
+	number = func(n *node) {
+		if n == nil || n.data >= 0 {
+			return
+		}
+		nodes = append(nodes, n)
+		number(n.child[0])
+		number(n.child[1])
+	}
+	number(root)
+	index := make(map[*node]int)
+	for i, n := range nodes {
+		index[n] = i
+	}
+	value := func(n *node) int {
+		switch {
+		case n == nil:
+			return len(nodes)
+		case n.data >= 0:
+			// Data pointers count from after the 16 byte separator.
+			return len(nodes) + 16 + n.data
+		}
+		return index[n]
+	}
+
+	var file bytes.Buffer
+	for _, n := range nodes {
+		left, right := value(n.child[0]), value(n.child[1])
+		file.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+	}
+	file.Write(make([]byte, 16))
+	file.Write(data.Bytes())
+	file.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbEncode(&file, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               kind,
+		"description":                 map[string]interface{}{"en": "Test database"},
+		"ip_version":                  uint16(6),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	})
+	if err := ioutil.WriteFile(path, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mmdbEncode appends v to w in the MaxMind DB data format.
+func mmdbEncode(w *bytes.Buffer, v interface{}) {
+	control := func(kind, size int) {
+		var extra []byte
+		switch {
+		case size >= 285:
+			extra = []byte{byte((size - 285) >> 8), byte(size - 285)}
+			size = 30
+		case size >= 29:
+			extra = []byte{byte(size - 29)}
+			size = 29
+		}
+		if kind > 7 {
+			w.WriteByte(byte(size))
+			w.WriteByte(byte(kind - 7))
+		} else {
+			w.WriteByte(byte(kind<<5 | size))
+		}
+		w.Write(extra)
+	}
+	unsigned := func(kind int, n uint64) {
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		control(kind, len(b))
+		w.Write(b)
+	}
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		w.WriteString(v)
+	case float64:
+		control(3, 8)
+		binary.Write(w, binary.BigEndian, v)
+	case uint16:
+		unsigned(5, uint64(v))
+	case uint32:
+		unsigned(6, uint64(v))
+	case uint64:
+		unsigned(9, v)
+	case []interface{}:
+		control(11, len(v))
+		for _, e := range v {
+			mmdbEncode(w, e)
+		}
+	case map[string]interface{}:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mmdbEncode(w, k)
+			mmdbEncode(w, v[k])
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := newCache(2, 64)
+	c.add(net.ParseIP("2001:db8::1"), ipInfo{City: "Prefix"})
+	if info, ok := c.get(net.ParseIP("2001:db8::ffff:1")); !ok || info.City != "Prefix" {
+		t.Errorf("expected a hit within the /64, got %v %v", info, ok)
+	}
+	if _, ok := c.get(net.ParseIP("2001:db8:0:1::1")); ok {
+		t.Errorf("expected a miss outside the /64")
+	}
+
+	c.add(net.ParseIP("10.0.0.1"), ipInfo{City: "A"})
+	c.add(net.ParseIP("10.0.0.2"), ipInfo{City: "B"})
+	if _, ok := c.get(net.ParseIP("2001:db8::1")); ok {
+		t.Errorf("expected the least recently used entry to be evicted")
+	}
+	if _, ok := c.get(net.ParseIP("10.0.0.1")); !ok {
+		t.Errorf("expected 10.0.0.1 to be cached")
+	}
+
+	c.purge()
+	if _, ok := c.get(net.ParseIP("10.0.0.1")); ok {
+		t.Errorf("expected no entries after a purge")
+	}
+
+	exact := newCache(2, 128)
+	exact.add(net.ParseIP("2001:db8::1"), ipInfo{})
+	if _, ok := exact.get(net.ParseIP("2001:db8::2")); ok {
+		t.Errorf("expected exact matching by default")
+	}
+}
+
+func TestCachedLookup(t *testing.T) {
+	defer func(c *cache) { lookupCache = c }(lookupCache)
+	lookupCache = newCache(10, 64)
+
+	LookupIP(net.ParseIP("2001:db8::1"))
+	info, _ := LookupIP(net.ParseIP("2001:db8::211:22ff:fe33:4455"))
+	if info.IP != "2001:db8::211:22ff:fe33:4455" || info.MAC != "00:11:22:33:44:55" {
+		t.Errorf("a shared entry should still carry the exact address, got %v %v", info.IP, info.MAC)
+	}
+	if len(lookupCache.entries) != 1 {
+		t.Errorf("expected both addresses to share an entry, got %v", len(lookupCache.entries))
+	}
+}
+
+func TestPoPs(t *testing.T) {
+	defer func(p []pop) { pops = p }(pops)
+
+	f, err := ioutil.TempFile("", "pops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# name,latitude,longitude\nfra1, 50.1109, 8.6821\nsjc1,37.3382,-121.8863\n")
+	f.Close()
+
+	pops, err = loadPoPs(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pops) != 2 {
+		t.Fatalf("expected 2 PoPs, got %v", pops)
+	}
+	if nearest := closestPoP(37.386, -122.0838); nearest == nil || nearest.Name != "sjc1" || nearest.Distance != 18.2 {
+		t.Errorf("expected sjc1 at 18.2km, got %+v", nearest)
+	}
+
+	pops = nil
+	if nearest := closestPoP(37.386, -122.0838); nearest != nil {
+		t.Errorf("expected nothing without a PoP list, got %+v", nearest)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("fra1,500,8\n"), 0644)
+	if _, err := loadPoPs(f.Name()); err == nil {
+		t.Errorf("expected an error for an invalid latitude")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	defer func(o []override) { overrides = o }(overrides)
+
+	f, err := ioutil.TempFile("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# cidr,city,region,country,organization,latitude,longitude\n" +
+		"10.0.0.0/8,,,,Example Corp\n" +
+		"10.20.0.0/16, DC-East, Virginia, us, Office network, 38.9, -77.4\n")
+	f.Close()
+
+	overrides, err = loadOverrides(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := LookupIP(net.ParseIP("10.20.1.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.City != "DC-East" || info.Region != "Virginia" || info.Country.Code != "US" || info.Organization != "Office network" || info.Location.Latitude != 38.9 {
+		t.Errorf("expected the 10.20.0.0/16 override, got %+v", info)
+	}
+	if info.IP != "10.20.1.2" || !info.Bogon || info.Type != "private" {
+		t.Errorf("expected the address fields to be filled in, got %+v", info)
+	}
+
+	if info, _ = LookupIP(net.ParseIP("10.1.1.1")); info.Organization != "Example Corp" || info.City != "" {
+		t.Errorf("expected the 10.0.0.0/8 override, got %+v", info)
+	}
+
+	var obj = new()
+	obj.url = "/10.20.1.2/city"
+	obj.function = Lookup
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = "DC-East\n"
+	testHTTPFunc(t, obj)
+
+	ioutil.WriteFile(f.Name(), []byte("10.20.0.0/33,DC-East\n"), 0644)
+	if _, err := loadOverrides(f.Name()); err == nil {
+		t.Errorf("expected an error for an invalid CIDR")
+	}
+}
+
+func TestASNRanges(t *testing.T) {
+	defer func(r []asnRange) { asnRanges = r }(asnRanges)
+
+	f, err := ioutil.TempFile("", "ip2asn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("8.8.8.0\t8.8.8.255\t15169\tUS\tGOOGLE\n" +
+		"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+		"2001:4860::\t2001:4860:ffff:ffff:ffff:ffff:ffff:ffff\t15169\tUS\tGOOGLE\n")
+	f.Close()
+
+	asnRanges, err = loadASNRanges(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(asnRanges) != 3 {
+		t.Fatalf("expected the unrouted range to be left out, got %v", asnRanges)
+	}
+	if index := indexASNRanges(asnRanges); len(index[15169]) != 2 || len(index[13335]) != 1 {
+		t.Errorf("expected the ranges indexed by AS number, got %v", index)
+	}
+	for ip, asn := range map[string]uint{"8.8.8.8": 15169, "1.0.0.1": 13335, "2001:4860::8888": 15169, "1.0.2.1": 0, "9.9.9.9": 0} {
+		if r, _ := lookupASNRange(net.ParseIP(ip)); r.asn != asn {
+			t.Errorf("expected AS%d for %s, got AS%d", asn, ip, r.asn)
+		}
+	}
+
+	dbLock.Lock()
+	asn := dbASN
+	dbASN = nil
+	dbLock.Unlock()
+	defer func() {
+		dbLock.Lock()
+		dbASN = asn
+		dbLock.Unlock()
+	}()
+	if info, _ := lookupDatabases(net.ParseIP("8.8.8.8")); info.ASN != 15169 || info.Organization != "GOOGLE" {
+		t.Errorf("expected the dump without an ASN database, got %+v", info)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("8.8.8.255\t8.8.8.0\t15169\tUS\tGOOGLE\n"), 0644)
+	if _, err := loadASNRanges(f.Name()); err == nil {
+		t.Errorf("expected an error for an inverted range")
+	}
+}
+
+func TestDatacenterASNs(t *testing.T) {
+	defer func(a map[uint]string) { datacenterASNs = a }(datacenterASNs)
+
+	if !isDatacenterASN(16509) || isDatacenterASN(7922) || isDatacenterASN(0) {
+		t.Errorf("expected only Amazon to be a datacenter in the built-in list")
+	}
+
+	f, err := ioutil.TempFile("", "datacenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# hosting\nAS64500 # Example Hosting\n64501\n\n")
+	f.Close()
+
+	datacenterASNs, err = loadDatacenterASNs(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isDatacenterASN(64500) || !isDatacenterASN(64501) || isDatacenterASN(16509) {
+		t.Errorf("expected the list to replace the built-in one, got %v", datacenterASNs)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("AS-EXAMPLE\n"), 0644)
+	if _, err := loadDatacenterASNs(f.Name()); err == nil {
+		t.Errorf("expected an error for an invalid ASN")
+	}
+}
+
+func TestASNDetail(t *testing.T) {
+	defer func(index map[uint][]asnRange) { asnRangesByASN = index }(asnRangesByASN)
+	asnRangesByASN = indexASNRanges([]asnRange{
+		{net.ParseIP("8.8.4.0").To16(), net.ParseIP("8.8.4.255").To16(), 15169, "US", "GOOGLE"},
+		{net.ParseIP("1.0.0.0").To16(), net.ParseIP("1.0.0.255").To16(), 13335, "US", "CLOUDFLARENET"},
+		{net.ParseIP("8.8.8.0").To16(), net.ParseIP("8.8.9.127").To16(), 15169, "US", "GOOGLE"},
+		{net.ParseIP("2001:4860::").To16(), net.ParseIP("2001:4860:ffff:ffff:ffff:ffff:ffff:ffff").To16(), 15169, "US", "GOOGLE"},
+	})
+
+	var obj = new()
+	obj.url = "/asn/AS15169"
+	obj.function = ASN
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"asn":15169,"organization":"GOOGLE","country":"US",` +
+		`"prefixes":["2001:4860::/32","8.8.4.0/24","8.8.8.0/24","8.8.9.0/25"]}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/asn/64500"
+	obj.expectedStatus = http.StatusNotFound
+	obj.expectedBody = "404 page not found\n"
+	testHTTPFunc(t, obj)
+
+	// Without the dump, the name comes from the index of the ASN database.
+	defer func(names map[uint]string) { asnNames = names }(asnNames)
+	asnNames = map[uint]string{64500: "EXAMPLE"}
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"asn":64500,"organization":"EXAMPLE"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/asn/GOOGLE"
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = "Bad Request\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestRangeNetworks(t *testing.T) {
+	for _, c := range []struct{ start, end, expected string }{
+		{"10.0.0.0", "10.255.255.255", "[10.0.0.0/8]"},
+		{"10.0.0.1", "10.0.0.6", "[10.0.0.1/32 10.0.0.2/31 10.0.0.4/31 10.0.0.6/32]"},
+		{"0.0.0.0", "255.255.255.255", "[0.0.0.0/0]"},
+		{"2001:db8::", "2001:db8::1:ffff", "[2001:db8::/111]"},
+	} {
+		if networks := fmt.Sprint(rangeNetworks(net.ParseIP(c.start), net.ParseIP(c.end))); networks != c.expected {
+			t.Errorf("expected %s for %s-%s, got %s", c.expected, c.start, c.end, networks)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	defer func(o []override) { overrides = o }(overrides)
+	_, fra, _ := net.ParseCIDR("10.1.0.0/16")
+	_, sjc, _ := net.ParseCIDR("10.2.0.0/16")
+	overrides = []override{
+		{fra, ipInfo{Location: location{Latitude: 50.1109, Longitude: 8.6821}}},
+		{sjc, ipInfo{Location: location{Latitude: 37.3382, Longitude: -121.8863}}},
+	}
+
+	var obj = new()
+	obj.url = "/distance/10.1.0.1/10.2.0.1"
+	obj.function = Distance
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"from":{"ip":"10.1.0.1","latitude":50.1109,"longitude":8.6821},` +
+		`"to":{"ip":"10.2.0.1","latitude":37.3382,"longitude":-121.8863},"km":9152.7,"miles":5687.3}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/distance/10.1.0.1/50.1109,8.6821"
+	obj.expectedBody = `{"from":{"ip":"10.1.0.1","latitude":50.1109,"longitude":8.6821},` +
+		`"to":{"latitude":50.1109,"longitude":8.6821},"km":0,"miles":0}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/distance/10.1.0.1/10.3.0.1"
+	obj.expectedStatus = http.StatusUnprocessableEntity
+	obj.expectedBody = "Unprocessable Entity\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/distance/10.1.0.1/91,0"
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = "Bad Request\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/distance/NaN,0/1,1"
+	testHTTPFunc(t, obj)
+}
+
+func TestGeofences(t *testing.T) {
+	defer func(o []override, g map[string][]geofenceRule) { overrides, geofences = o, g }(overrides, geofences)
+	overrides, _ = loadOverridesFrom(t, "10.1.0.0/16,Frankfurt,Hesse,DE,,50.1109,8.6821\n"+
+		"10.2.0.0/16,San Jose,California,US,,37.3382,-121.8863\n")
+
+	f, err := ioutil.TempFile("", "geofences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# name,action,type,values\n" +
+		"office,allow,circle,50.11,8.68,25\n" +
+		"office,deny,country,DE\n" +
+		"bay,allow,polygon,38 -123,38 -121,37 -121,37 -123\n")
+	f.Close()
+
+	geofences, err = loadGeofences(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var obj = new()
+	obj.url = "/geofence/office/10.1.0.1"
+	obj.function = Geofence
+	obj.expectedStatus = http.StatusOK
+	obj.expectedBody = `{"geofence":"office","ip":"10.1.0.1","result":"allow","rule":{"index":1,"action":"allow","type":"circle"}}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/geofence/office/10.2.0.1"
+	obj.expectedBody = `{"geofence":"office","ip":"10.2.0.1","result":"deny"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/geofence/bay/10.2.0.1"
+	obj.expectedBody = `{"geofence":"bay","ip":"10.2.0.1","result":"allow","rule":{"index":1,"action":"allow","type":"polygon"}}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/geofence/nowhere/10.2.0.1"
+	obj.expectedStatus = http.StatusNotFound
+	obj.expectedBody = "404 page not found\n"
+	testHTTPFunc(t, obj)
+
+	if rule := geofences["office"][1]; !rule.matches(ipInfo{Country: country{codename: codename{Code: "DE"}}}) {
+		t.Errorf("expected the country rule to cover DE")
+	}
+	if rule := (geofenceRule{Type: "region", codes: map[string]bool{"US-CA": true}}); !rule.matches(ipInfo{Country: country{codename: codename{Code: "US"}}, regionCode: "CA"}) {
+		t.Errorf("expected the region rule to cover US-CA")
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("office,maybe,country,DE\n"), 0644)
+	if _, err := loadGeofences(f.Name()); err == nil {
+		t.Errorf("expected an error for an invalid action")
+	}
+	ioutil.WriteFile(f.Name(), []byte("office,allow,circle,NaN,8.68,25\n"), 0644)
+	if _, err := loadGeofences(f.Name()); err == nil {
+		t.Errorf("expected an error for a NaN latitude")
+	}
+	ioutil.WriteFile(f.Name(), []byte("bay,allow,polygon,38 -123,38 Inf,37 -121\n"), 0644)
+	if _, err := loadGeofences(f.Name()); err == nil {
+		t.Errorf("expected an error for an infinite longitude")
+	}
+}
+
+// loadOverridesFrom loads an override list with the given lines.
+func loadOverridesFrom(t *testing.T, lines string) ([]override, error) {
+	f, err := ioutil.TempFile("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(lines)
+	f.Close()
+	return loadOverrides(f.Name())
+}
+
+func TestGeohashPlusCode(t *testing.T) {
+	for _, c := range []struct {
+		latitude, longitude float64
+		precision           int
+		geohash             string
+	}{
+		{42.6, -5.6, 5, "ezs42"},
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+	} {
+		if hash := geohash(c.latitude, c.longitude, c.precision); hash != c.geohash {
+			t.Errorf("expected geohash %s for %v,%v, got %s", c.geohash, c.latitude, c.longitude, hash)
+		}
+	}
+
+	for _, c := range []struct {
+		latitude, longitude float64
+		plusCode            string
+	}{
+		{47.365590, 8.524997, "8FVC9G8F+6X"},
+		{57.64911, 10.40744, "9F9GJCX4+JX"},
+		// The north pole is clipped into the last row, 180 wraps to -180.
+		{90, 180, "C2X2X2X2+X2"},
+	} {
+		if code := plusCode(c.latitude, c.longitude); code != c.plusCode {
+			t.Errorf("expected plus code %s for %v,%v, got %s", c.plusCode, c.latitude, c.longitude, code)
+		}
+	}
+}
+
+func TestGeo(t *testing.T) {
+	grid := newCityGrid([]indexedCity{
+		{50.1109, 8.6821, net.ParseIP("10.1.0.0")},
+		{37.3382, -121.8863, net.ParseIP("10.2.0.0")},
+	})
+	if c, d, ok := grid.nearest(37.386, -122.0838); !ok || !c.ip.Equal(net.ParseIP("10.2.0.0")) || math.Round(d*10)/10 != 18.2 {
+		t.Errorf("expected San Jose at 18.2km, got %+v at %v", c, d)
+	}
+	if _, _, ok := newCityGrid(nil).nearest(37.386, -122.0838); ok {
+		t.Errorf("expected nothing without cities")
+	}
+	if _, _, ok := grid.nearest(math.NaN(), 0); ok {
+		t.Errorf("expected nothing near NaN")
+	}
+
+	// The grid finds the same city as checking every one of them.
+	random := rand.New(rand.NewSource(1))
+	var cities []indexedCity
+	for i := 0; i < 2000; i++ {
+		cities = append(cities, indexedCity{random.Float64()*180 - 90, random.Float64()*360 - 180, nil})
+	}
+	grid = newCityGrid(cities)
+	for i := 0; i < 500; i++ {
+		latitude, longitude := random.Float64()*180-90, random.Float64()*360-180
+		want := math.Inf(1)
+		for _, c := range cities {
+			want = math.Min(want, greatCircle(latitude, longitude, c.latitude, c.longitude))
+		}
+		if _, d, _ := grid.nearest(latitude, longitude); math.Abs(d-want) > 1e-6 {
+			t.Errorf("wrong nearest city for %v,%v: got %vkm want %vkm", latitude, longitude, d, want)
+		}
+	}
+
+	// The test database has no cities.
+	var obj = new()
+	obj.url = "/geo/37.386,-122.0838"
+	obj.function = Geo
+	obj.expectedStatus = http.StatusNotFound
+	obj.expectedBody = "404 page not found\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/geo/91,0"
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = "Bad Request\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/geo/NaN,0"
+	testHTTPFunc(t, obj)
+}
+
+func TestUpdateDatabase(t *testing.T) {
+	defer func(u string, c Config) { maxmindDownloadURL, config = u, c }(maxmindDownloadURL, config)
+
+	db, err := ioutil.ReadFile("assets/GeoLite2-City.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "GeoLite2-City_20240101/GeoLite2-City.mmdb", Mode: 0644, Size: int64(len(db)), Typeflag: tar.TypeReg})
+	tw.Write(db)
+	tw.Close()
+	gz.Close()
+	sum := sha256.Sum256(archive.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "1234" || pass != "key" {
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		switch r.URL.Query().Get("suffix") {
+		case "tar.gz.sha256":
+			io.WriteString(w, checksum+"  GeoLite2-City_20240101.tar.gz\n")
+		case "tar.gz":
+			downloads++
+			w.Write(archive.Bytes())
+		}
+	}))
+	defer server.Close()
+	maxmindDownloadURL = server.URL + "/%s?suffix=%s"
+	config.MaxMindAccountID, config.MaxMindLicenseKey = "1234", "key"
+
+	dir, err := ioutil.TempDir("", "updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/GeoLite2-City.mmdb"
+
+	if updated, err := updateDatabase("GeoLite2-City", path); err != nil || !updated {
+		t.Fatalf("expected a download, got %v %v", updated, err)
+	}
+	if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, db) {
+		t.Errorf("the downloaded database does not match the archive")
+	}
+	if updated, err := updateDatabase("GeoLite2-City", path); err != nil || updated || downloads != 1 {
+		t.Errorf("expected no download for an unchanged checksum, got %v %v after %v downloads", updated, err, downloads)
+	}
+
+	checksum = strings.Repeat("0", 64)
+	if _, err := updateDatabase("GeoLite2-City", path); err == nil {
+		t.Errorf("expected an error for a checksum mismatch")
+	}
+	if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, db) {
+		t.Errorf("a failed update should keep the current database")
+	}
+
+	config.MaxMindLicenseKey = "wrong"
+	if _, err := updateDatabase("GeoLite2-City", path); err == nil {
+		t.Errorf("expected an error for a rejected license key")
+	}
+
+	config.MaxMindLicenseKey, config.CityDB, config.ASNDB, config.UpdateInterval = "key", path, "", time.Hour
+	initializeUpdater()
+	if !updaterRefresh.running() {
+		t.Errorf("the updater should run with a license key")
+	}
+	config.MaxMindLicenseKey = ""
+	initializeUpdater()
+	if updaterRefresh.running() {
+		t.Errorf("the updater should stop without a license key")
+	}
+}
+
+func TestRefresher(t *testing.T) {
+	var r refresher
+	var mu sync.Mutex
+	counts := map[string]int{}
+	count := func(name string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			counts[name]++
+		}
+	}
+	get := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts[name]
+	}
+
+	// Restarting replaces the running loop instead of adding one.
+	r.start(time.Millisecond, true, count("first"))
+	time.Sleep(20 * time.Millisecond)
+	r.start(time.Millisecond, false, count("second"))
+	time.Sleep(5 * time.Millisecond)
+	first := get("first")
+	time.Sleep(20 * time.Millisecond)
+	if first == 0 || get("first") != first {
+		t.Errorf("the first loop should have run and then stopped, got %v then %v", first, get("first"))
+	}
+	if get("second") == 0 {
+		t.Errorf("the second loop should be running")
+	}
+
+	r.stop()
+	time.Sleep(5 * time.Millisecond)
+	second := get("second")
+	time.Sleep(20 * time.Millisecond)
+	if get("second") != second || r.running() {
+		t.Errorf("the loop should be stopped, got %v then %v", second, get("second"))
+	}
+
+	r.start(0, true, count("once"))
+	time.Sleep(5 * time.Millisecond)
+	if get("once") != 1 {
+		t.Errorf("without an interval fn should run once, got %v", get("once"))
+	}
+	r.stop()
+}
+
+func TestDatabaseWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/GeoLite2-City.mmdb"
+	ioutil.WriteFile(path, []byte("old"), 0644)
+
+	w := newDatabaseWatcher(path)
+	if w.changed() {
+		t.Errorf("expected no change for an untouched file")
+	}
+
+	ioutil.WriteFile(path, []byte("partial"), 0644)
+	if w.changed() {
+		t.Errorf("expected a file still changing not to be reported")
+	}
+	ioutil.WriteFile(path, []byte("replaced"), 0644)
+	if w.changed() {
+		t.Errorf("expected a file still changing not to be reported")
+	}
+	if !w.changed() {
+		t.Errorf("expected a settled replacement to be reported")
+	}
+	if w.changed() {
+		t.Errorf("expected a replacement to be reported once")
+	}
+
+	os.Remove(path)
+	if w.changed() {
+		t.Errorf("expected a removed file not to be reported")
+	}
+}
+
+func TestReload(t *testing.T) {
+	defer func(l string, level int, c Config) { *Locale, *Loglevel, config = l, level, c }(*Locale, *Loglevel, config)
+
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# reloaded on SIGHUP\nlocale=de\nloglevel 3\n")
+	f.Close()
+
+	if err := reload([]string{"-config", f.Name()}); err != nil {
+		t.Fatal(err)
+	}
+	if *Locale != "de" || config.Locale != "de" || *Loglevel != 3 {
+		t.Errorf("expected the config file to apply, got %v %v %v", *Locale, config.Locale, *Loglevel)
+	}
+
+	if err := reload([]string{"-config", f.Name(), "-locale", "fr"}); err != nil {
+		t.Fatal(err)
+	}
+	if *Locale != "fr" {
+		t.Errorf("expected arguments to take precedence over the config file, got %v", *Locale)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("unknown=1\n"), 0644)
+	if err := reload([]string{"-config", f.Name()}); err == nil {
+		t.Errorf("expected an error for an unknown flag")
+	}
+}
+
+func TestReloadSettings(t *testing.T) {
+	defer func(l string, proxies string, port int, c Config) {
+		*Locale, *TrustedProxies, *Port, config = l, proxies, port, c
+		initializeClientIP()
+	}(*Locale, *TrustedProxies, *Port, config)
+
+	if err := reload([]string{"-trusted-proxies", "10.4.0.0/16", "-port", "9000"}); err != nil {
+		t.Fatal(err)
+	}
+	if !isTrustedProxy(net.ParseIP("10.4.5.6")) {
+		t.Errorf("expected the trusted proxies to apply")
+	}
+	if *Port == 9000 {
+		t.Errorf("the port should only change on a restart")
+	}
+
+	if err := reload([]string{"-trusted-proxies", "10.4.0.0/99", "-locale", "de"}); err == nil {
+		t.Errorf("expected an error for an invalid trusted proxy")
+	}
+	if *Locale == "de" || !isTrustedProxy(net.ParseIP("10.4.5.6")) {
+		t.Errorf("a failed reload should keep the current settings")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	defer func(token string) { *AdminToken = token }(*AdminToken)
+
+	obj := new()
+	obj.url = "/admin/status"
+	obj.function = Admin
+	obj.expectedStatus = http.StatusNotFound
+	obj.expectedBody = "404 page not found\n"
+	testHTTPFunc(t, obj)
+
+	*AdminToken = "secret"
+	obj.headers = []http.Header{{"Authorization": {"secret"}}}
+	obj.expectedStatus = http.StatusUnauthorized
+	obj.expectedBody = "Unauthorized\n"
+	testHTTPFunc(t, obj)
+
+	obj.headers = []http.Header{{"Authorization": {"Bearer secret"}}}
+	obj.url = "/admin/reload"
+	obj.expectedStatus = http.StatusMethodNotAllowed
+	obj.expectedBody = "Method Not Allowed\n"
+	testHTTPFunc(t, obj)
+
+	req, _ := http.NewRequest("POST", "/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	Admin(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var status adminStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Databases) == 0 || status.Databases[0].Name != "city" || status.Databases[0].Path != config.CityDB || status.Databases[0].Error != "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestBatchJSONArray(t *testing.T) {
+	defer func(limit int) { *BatchLimit = limit }(*BatchLimit)
+
+	req, _ := http.NewRequest("POST", "/batch", strings.NewReader(`["10.0.0.1", "a.b.c.d", "::1"]`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	Batch(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var results []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0]["ip"] != "10.0.0.1" || results[1]["error"] != "invalid IP address" || results[2]["ip"] != "::1" {
+		t.Errorf("unexpected results %v", results)
+	}
+
+	*BatchLimit = 2
+	obj := new()
+	obj.method = "POST"
+	obj.url = "/batch"
+	obj.body = strings.NewReader(`["10.0.0.1", "10.0.0.2", "10.0.0.3"]`)
+	obj.headers = []http.Header{{"Content-Type": {"application/json"}}}
+	obj.function = Batch
+	obj.expectedStatus = http.StatusRequestEntityTooLarge
+	obj.expectedBody = "Request Entity Too Large\n"
+	testHTTPFunc(t, obj)
+
+	obj.body = strings.NewReader(`{"ips": ["10.0.0.1"]}`)
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = "Bad Request\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestSelectFields(t *testing.T) {
+	info := ipInfo{IP: "8.8.8.8", ASN: 15169, Country: country{codename: codename{Code: "US", Name: "United States"}}}
+	raw, err := json.Marshal(selectFields(info, []string{"ip", " country.code", "asn", "country.bogus", "bogus", "ip.bogus"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(raw), `{"asn":15169,"country":{"code":"US"},"ip":"8.8.8.8"}`; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestFieldsLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.0.0.1?fields=ip,bogus"
+	obj.function = Lookup
+	obj.expectedBody = "{\"ip\":\"10.0.0.1\"}\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestTextFieldLookup(t *testing.T) {
+	var obj = new()
+	obj.url = "/10.0.0.1/ip"
+	obj.function = Lookup
+	obj.expectedBody = "10.0.0.1\n"
+	obj.expectedHeader = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	testHTTPFunc(t, obj)
+
+	obj.url = "/ip"
+	obj.remoteIP = "10.0.0.2"
+	obj.expectedBody = "10.0.0.2\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.0.0.1/loc"
+	obj.expectedBody = "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestTextFields(t *testing.T) {
+	postal := "94043"
+	info := ipInfo{
+		ASN:          15169,
+		Organization: "Google LLC",
+		Postal:       &postal,
+		Location:     location{Latitude: 37.4056, Longitude: -122.0775},
+	}
+	for field, want := range map[string]string{"org": "AS15169 Google LLC", "loc": "37.4056,-122.0775", "postal": "94043"} {
+		if got := textFields[field](info); got != want {
+			t.Errorf("%v: got %v want %v", field, got, want)
+		}
+	}
+	if got := textFields["org"](ipInfo{}); got != "" {
+		t.Errorf("org: expected nothing for an unknown ASN, got %v", got)
+	}
+}
+
+func TestIPAPILookup(t *testing.T) {
+	var obj = new()
+	obj.function = Lookup
+	obj.url = "/json/10.0.0.1"
+	obj.expectedBody = `{"status":"fail","message":"private range","query":"10.0.0.1"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/json/a.b.c.d"
+	obj.expectedBody = `{"status":"fail","message":"invalid query","query":"a.b.c.d"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/json/192.0.2.1"
+	obj.expectedBody = `{"status":"fail","message":"reserved range","query":"192.0.2.1"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/8.8.8.8?format=ip-api"
+	obj.expectedBody = `{"status":"success","query":"8.8.8.8"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/json/"
+	obj.headers = []http.Header{{"X-Real-Ip": {"8.8.8.8"}}}
+	testHTTPFunc(t, obj)
+}
+
+func TestToIPAPI(t *testing.T) {
+	postal := "94043"
+	info := ipInfo{
+		IP:           "8.8.8.8",
+		City:         "Mountain View",
+		Region:       "California",
+		regionCode:   "CA",
+		Country:      country{codename: codename{Code: "US", Name: "United States"}},
+		Location:     location{Latitude: 37.4056, Longitude: -122.0775},
+		TimeZone:     "America/Los_Angeles",
+		Postal:       &postal,
+		ASN:          15169,
+		Organization: "Google LLC",
+	}
+	raw, _ := json.Marshal(toIPAPI(info))
+	expected := `{"status":"success","country":"United States","countryCode":"US","region":"CA",` +
+		`"regionName":"California","city":"Mountain View","zip":"94043","lat":37.4056,"lon":-122.0775,` +
+		`"timezone":"America/Los_Angeles","isp":"Google LLC","org":"Google LLC","as":"AS15169 Google LLC","query":"8.8.8.8"}`
+	if string(raw) != expected {
+		t.Errorf("got %v want %v", string(raw), expected)
+	}
+}
+
+func TestIPInfoIOLookup(t *testing.T) {
+	defer func(r dnsResolver, f string) { resolver, *DefaultFormat = r, f }(resolver, *DefaultFormat)
+	resolver = fakeResolver{ptr: map[string][]string{"10.0.0.1": {"mail.example.com."}}}
+
+	var obj = new()
+	obj.function = Lookup
+	obj.url = "/10.0.0.1?format=ipinfo"
+	obj.expectedBody = `{"ip":"10.0.0.1","hostname":"mail.example.com","bogon":true}` + "\n"
+	testHTTPFunc(t, obj)
+
+	*DefaultFormat = "ipinfo"
+	obj.url = "/10.0.0.2"
+	obj.expectedBody = `{"ip":"10.0.0.2","bogon":true}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.0.0.2/json"
+	obj.expectedBody = `{"ip":"10.0.0.2","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestToIPAPIWithISP(t *testing.T) {
+	info := ipInfo{IP: "8.8.8.8", ASN: 15169, Organization: "Google Public DNS", ISP: "Google"}
+	out := toIPAPI(info)
+	if out.ISP != "Google" || out.Org != "Google Public DNS" {
+		t.Errorf("expected the ISP and organization apart, got %q and %q", out.ISP, out.Org)
+	}
+}
+
+func TestToIPInfoIO(t *testing.T) {
+	postal := "94043"
+	info := ipInfo{
+		IP:           "8.8.8.8",
+		Hostname:     "dns.google",
+		City:         "Mountain View",
+		Region:       "California",
+		Country:      country{codename: codename{Code: "US", Name: "United States"}},
+		Location:     location{Latitude: 37.4056, Longitude: -122.0775},
+		TimeZone:     "America/Los_Angeles",
+		Postal:       &postal,
+		ASN:          15169,
+		Organization: "Google LLC",
+	}
+	raw, _ := json.Marshal(toIPInfoIO(info))
+	expected := `{"ip":"8.8.8.8","hostname":"dns.google","city":"Mountain View","region":"California",` +
+		`"country":"US","loc":"37.4056,-122.0775","org":"AS15169 Google LLC","postal":"94043",` +
+		`"timezone":"America/Los_Angeles"}`
+	if string(raw) != expected {
+		t.Errorf("got %v want %v", string(raw), expected)
+	}
+}
+
+func TestXMLLookup(t *testing.T) {
+	expected := xmlHeader + `<ipinfo><ip>10.0.0.1</ip><city></city><region></region>` +
+		`<country><code></code><name></name></country><continent><code></code><name></name></continent>` +
+		`<location><latitude>0</latitude><longitude>0</longitude></location><postal></postal>` +
+		`<asn>0</asn><organization></organization><bogon>true</bogon><type>private</type></ipinfo>` + "\n"
+
+	var obj = new()
+	obj.function = Lookup
+	obj.url = "/10.0.0.1?format=xml"
+	obj.expectedHeader = http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	obj.expectedBody = expected
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.0.0.1"
+	obj.headers = []http.Header{{"Accept": {"application/json;q=0.5, application/xml"}}}
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.0.0.1?fields=ip,country.code"
+	obj.expectedBody = xmlHeader + `<ipinfo><country><code></code></country><ip>10.0.0.1</ip></ipinfo>` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+
+func TestWriteXML(t *testing.T) {
+	var buf bytes.Buffer
+	info := ipInfo{
+		IP:           "8.8.8.8 & co",
+		Country:      country{codename: codename{Code: "DE", Names: map[string]string{"en": "Germany", "de": "Deutschland"}}},
+		Subdivisions: []subdivision{{Code: "BY"}, {Code: "HE"}},
+		NameSources:  map[string]string{"city": "geonames", "region": "builtin"},
+	}
+	if err := writeXML(&buf, "ipinfo", info, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := xmlHeader + `<ipinfo><ip>8.8.8.8 &amp; co</ip><city></city><region></region>` +
+		`<subdivisions><code>BY</code><name></name></subdivisions><subdivisions><code>HE</code><name></name></subdivisions>` +
+		`<country><code>DE</code><name></name><names><de>Deutschland</de><en>Germany</en></names></country>` +
+		`<location><latitude>0</latitude><longitude>0</longitude></location>` +
+		`<asn>0</asn><organization></organization>` +
+		`<name_sources><city>geonames</city><region>builtin</region></name_sources></ipinfo>` + "\n"
+	if buf.String() != expected {
+		t.Errorf("got %v want %v", buf.String(), expected)
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	var buf bytes.Buffer
+	confidence := uint8(80)
+	info := ipInfo{
+		IP:           "2001:db8::1",
+		City:         "Mountain View",
+		Region:       "yes",
+		Country:      country{codename: codename{Code: "DE", Name: "Germany", Names: map[string]string{"en": "Germany"}}},
+		Subdivisions: []subdivision{{Code: "BY", Name: "Bayern", Confidence: &confidence}},
+		NameSources:  map[string]string{"city": "geonames", "über": "builtin"},
+	}
+	if err := writeYAML(&buf, info); err != nil {
+		t.Fatal(err)
+	}
+	expected := `ip: "2001:db8::1"
+city: Mountain View
+region: "yes"
+subdivisions:
+- code: BY
+  name: Bayern
+  confidence: 80
+country:
+  code: DE
+  name: Germany
+  names:
+    en: Germany
+location:
+  latitude: 0
+  longitude: 0
+asn: 0
+organization: ""
+name_sources:
+  city: geonames
+  "über": builtin
+`
+	if buf.String() != expected {
+		t.Errorf("got\n%v\nwant\n%v", buf.String(), expected)
+	}
+}
+
+func TestYAMLLookup(t *testing.T) {
+	var obj = new()
+	obj.function = Lookup
+	obj.url = "/10.0.0.1?format=yaml&fields=ip,asn"
+	obj.expectedHeader = http.Header{"Content-Type": {"application/yaml; charset=utf-8"}}
+	obj.expectedBody = "asn: 0\nip: \"10.0.0.1\"\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestPack(t *testing.T) {
+	confidence := uint8(200)
+	v := struct {
+		codename
+		Small      int               `json:"small"`
+		Negative   int               `json:"negative"`
+		Confidence *uint8            `json:"confidence,omitempty"`
+		Missing    *uint8            `json:"missing,omitempty"`
+		Float      float64           `json:"float"`
+		Names      map[string]string `json:"names"`
+		List       []string          `json:"list"`
+		Null       []string          `json:"null"`
+		Flag       bool              `json:"flag"`
+		Number     json.Number       `json:"number"`
+		unexported string
+	}{codename{Code: "DE", Name: "Germany"}, 5, -200, &confidence, nil, 1.5, map[string]string{"b": "2", "a": "1"}, []string{"x"}, nil, true, "70000", ""}
+
+	// Keys: code name small negative confidence float names list null flag number
+	msgpackWant := "8b" +
+		"a4636f6465" + "a24445" + "a46e616d65" + "a74765726d616e79" +
+		"a5736d616c6c" + "05" +
+		"a86e65676174697665" + "d1ff38" +
+		"aa636f6e666964656e6365" + "ccc8" +
+		"a5666c6f6174" + "cb3ff8000000000000" +
+		"a56e616d6573" + "82" + "a161" + "a131" + "a162" + "a132" +
+		"a46c697374" + "91" + "a178" +
+		"a46e756c6c" + "c0" +
+		"a4666c6167" + "c3" +
+		"a66e756d626572" + "ce00011170"
+	if got := hex.EncodeToString(encodePacked("msgpack", v)); got != msgpackWant {
+		t.Errorf("msgpack: got %v want %v", got, msgpackWant)
+	}
+
+	cborWant := "ab" +
+		"64636f6465" + "624445" + "646e616d65" + "674765726d616e79" +
+		"65736d616c6c" + "05" +
+		"686e65676174697665" + "38c7" +
+		"6a636f6e666964656e6365" + "18c8" +
+		"65666c6f6174" + "fb3ff8000000000000" +
+		"656e616d6573" + "a2" + "6161" + "6131" + "6162" + "6132" +
+		"646c697374" + "81" + "6178" +
+		"646e756c6c" + "f6" +
+		"64666c6167" + "f5" +
+		"666e756d626572" + "1a00011170"
+	if got := hex.EncodeToString(encodePacked("cbor", v)); got != cborWant {
+		t.Errorf("cbor: got %v want %v", got, cborWant)
+	}
+}
+
+func TestPackedLookup(t *testing.T) {
+	var obj = new()
+	obj.function = Lookup
+	obj.url = "/10.0.0.1?fields=asn"
+	obj.headers = []http.Header{{"Accept": {"application/cbor"}}}
+	obj.expectedHeader = http.Header{"Content-Type": {"application/cbor"}}
+	obj.expectedBody = "\xa1\x63asn\x00"
+	testHTTPFunc(t, obj)
+
+	obj.url = "/10.0.0.1?format=msgpack&fields=asn"
+	obj.headers = nil
+	obj.expectedHeader = http.Header{"Content-Type": {"application/msgpack"}}
+	obj.expectedBody = "\x81\xa3asn\x00"
+	testHTTPFunc(t, obj)
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	info, _ := LookupIP(net.ParseIP("10.0.0.1"))
+	for n := 0; n < b.N; n++ {
+		json.Marshal(info)
+	}
+}
+
+func BenchmarkEncodeMsgpack(b *testing.B) {
+	info, _ := LookupIP(net.ParseIP("10.0.0.1"))
+	for n := 0; n < b.N; n++ {
+		encodePacked("msgpack", info)
+	}
+}
+
+func TestBatchCSVFromJSON(t *testing.T) {
+	var obj = new()
+	obj.method = "POST"
+	obj.url = "/batch"
+	obj.body = strings.NewReader(`["10.0.0.1", "a.b.c.d"]`)
+	obj.headers = []http.Header{{"Accept": {"text/csv"}, "Content-Type": {"application/json"}}}
+	obj.function = Batch
+	obj.expectedHeader = http.Header{"Content-Type": {"text/csv; charset=utf-8"}}
+	obj.expectedBody = csvBatchHeader +
+		"10.0.0.1,10.0.0.1,,,,,,,0,0,,0,,\n" +
+		"a.b.c.d,,,,,,,,,,,,,invalid IP address\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestBatchNDJSON(t *testing.T) {
+	expected := `{"ip":"10.0.0.1","city":"","region":"","country":{"code":"","name":""},` +
+		`"continent":{"code":"","name":""},"location":{"latitude":0,"longitude":0},` +
+		`"postal":"","asn":0,"organization":"","bogon":true,"type":"private"}` + "\n" +
+		`{"query":"a.b.c.d","error":"invalid IP address"}` + "\n"
+
+	for _, proto := range []int{1, 2} {
+		req, _ := http.NewRequest("POST", "/batch", strings.NewReader("10.0.0.1\n\"a.b.c.d\"\n"))
+		req.ProtoMajor = proto
+		req.Header.Set("Accept", "application/x-ndjson")
+		rr := httptest.NewRecorder()
+		Batch(rr, req)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("HTTP/%v: unexpected response %v %v", proto, rr.Code, rr.Header())
+		}
+		if rr.Body.String() != expected {
+			t.Errorf("HTTP/%v: got\n%v\nwant\n%v", proto, rr.Body.String(), expected)
+		}
+	}
+
+	// Streamed lists are held to the limit too, ending with an error line.
+	defer func(limit int) { *BatchLimit = limit }(*BatchLimit)
+	*BatchLimit = 1
+	req, _ := http.NewRequest("POST", "/batch", strings.NewReader("10.0.0.1\n\"a.b.c.d\"\n"))
+	req.ProtoMajor = 2
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	Batch(rr, req)
+	limited := strings.SplitAfter(expected, "\n")[0] + `{"error":"too many addresses"}` + "\n"
+	if rr.Body.String() != limited {
+		t.Errorf("over the limit: got\n%v\nwant\n%v", rr.Body.String(), limited)
+	}
+}
+
+func TestScanQueries(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("1.1.1.1\n# skipped\n\n2.2.2.2\n3.3.3.3\n"))
+	for _, expected := range [][]string{{"1.1.1.1", "2.2.2.2"}, {"3.3.3.3"}, nil} {
+		queries, err := scanQueries(scanner, 2)
+		if err != nil || strings.Join(queries, ",") != strings.Join(expected, ",") {
+			t.Errorf("got %v %v want %v", queries, err, expected)
+		}
+	}
+}
+
+func TestToGeoJSON(t *testing.T) {
+	info := ipInfo{IP: "8.8.8.8", Location: location{Latitude: 37.4056, Longitude: -122.0775}}
+	raw, _ := json.Marshal(toGeoJSON(info, info))
+	expected := `{"type":"Feature","geometry":{"type":"Point","coordinates":[-122.0775,37.4056]},` +
+		`"properties":{"asn":0,"city":"","country":{"code":"","name":""},"ip":"8.8.8.8","organization":"","region":""}}`
+	if string(raw) != expected {
+		t.Errorf("got %v want %v", string(raw), expected)
+	}
+
+	info.Location = location{Note: "anycast"}
+	raw, _ = json.Marshal(toGeoJSON(info, selectFields(info, []string{"ip", "location"})))
+	expected = `{"type":"Feature","geometry":null,"properties":{"ip":"8.8.8.8","location":{"note":"anycast"}}}`
+	if string(raw) != expected {
+		t.Errorf("got %v want %v", string(raw), expected)
+	}
+}
+
+func TestGeoJSONLookup(t *testing.T) {
+	var obj = new()
+	obj.function = Lookup
+	obj.url = "/10.0.0.1?format=geojson&fields=ip"
+	obj.expectedHeader = http.Header{"Content-Type": {"application/geo+json"}}
+	obj.expectedBody = `{"type":"Feature","geometry":null,"properties":{"ip":"10.0.0.1"}}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	defer func(f string) { *DefaultFormat = f }(*DefaultFormat)
+
+	chrome := "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8"
+	for _, test := range []struct{ def, accept, format string }{
+		{"", "", "json"},
+		{"", "*/*", "json"},
+		{"", chrome, "json"},
+		{"", "application/xml", "xml"},
+		{"", "text/plain", "text"},
+		{"", "application/json;q=0.5, application/x-yaml", "yaml"},
+		{"", "image/png", "json"},
+		{"xml", "*/*", "xml"},
+		{"xml", "application/json", "json"},
+		{"ipinfo", "application/json", "ipinfo"},
+		{"ipinfo", "", "ipinfo"},
+		{"ipinfo", "application/cbor", "cbor"},
+	} {
+		*DefaultFormat = test.def
+		if got := negotiateFormat(test.accept); got != test.format {
+			t.Errorf("default %q, Accept %q: got %v want %v", test.def, test.accept, got, test.format)
+		}
+	}
+}
+
+// grpcTestCall posts msg to the gRPC method and returns the reply message and
+// the grpc-status trailer.
+func grpcTestCall(t *testing.T, method string, msg []byte) ([]byte, string) {
+	req := httptest.NewRequest("POST", "/ipinfo.v1.IPInfo/"+method, bytes.NewReader(grpcFrame(msg)))
+	req.Header.Set("Content-Type", "application/grpc")
+	rr := httptest.NewRecorder()
+	GRPCHandler().ServeHTTP(rr, req)
+
+	res := rr.Result()
+	body, _ := ioutil.ReadAll(res.Body)
+	if len(body) == 0 {
+		return nil, res.Trailer.Get("Grpc-Status")
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		t.Fatalf("%s: malformed frame %x", method, body)
+	}
+	return body[5:], res.Trailer.Get("Grpc-Status")
+}
+
+func TestGRPC(t *testing.T) {
+	var req protoBuffer
+	req.string(1, "10.0.0.1")
+	reply, status := grpcTestCall(t, "Lookup", req.b)
+	if status != "0" {
+		t.Fatalf("Lookup: got status %v want 0", status)
+	}
+	fields := map[int]string{}
+	var bogon uint64
+	protoFields(reply, func(field int, value uint64, data []byte) {
+		fields[field] = string(data)
+		if field == 15 {
+			bogon = value
+		}
+	})
+	if fields[1] != "10.0.0.1" || fields[16] != "private" || bogon != 1 {
+		t.Errorf("Lookup: got %q bogon %v", fields, bogon)
+	}
+
+	req = protoBuffer{}
+	req.string(1, "not an ip")
+	if _, status := grpcTestCall(t, "Lookup", req.b); status != "3" {
+		t.Errorf("Lookup of an invalid address: got status %v want 3", status)
+	}
+	if _, status := grpcTestCall(t, "Unknown", nil); status != "12" {
+		t.Errorf("unknown method: got status %v want 12", status)
+	}
+
+	req = protoBuffer{}
+	req.string(1, "10.0.0.1")
+	req.string(1, "nope")
+	reply, status = grpcTestCall(t, "BatchLookup", req.b)
+	if status != "0" {
+		t.Fatalf("BatchLookup: got status %v want 0", status)
+	}
+	var results []map[int]string
+	protoFields(reply, func(field int, value uint64, data []byte) {
+		result := map[int]string{}
+		protoFields(data, func(field int, value uint64, data []byte) {
+			result[field] = string(data)
+		})
+		results = append(results, result)
+	})
+	if len(results) != 2 || results[0][1] != "10.0.0.1" || results[0][2] == "" || results[1][1] != "nope" || results[1][3] != "invalid IP address" {
+		t.Errorf("BatchLookup: got %q", results)
+	}
+
+	// Both carry the network the address was found in.
+	defer func(city, asn *maxminddb.Reader) { netCity, netASN = city, asn }(netCity, netASN)
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeMMDB(t, dir+"/GeoLite2-City.mmdb", "GeoLite2-City", map[string]map[string]interface{}{
+		"10.0.0.0/8": {"city": map[string]interface{}{"geoname_id": uint32(1)}},
+	})
+	if netCity, err = maxminddb.Open(dir + "/GeoLite2-City.mmdb"); err != nil {
+		t.Fatal(err)
+	}
+	defer netCity.Close()
+	netASN = nil
+	var single protoBuffer
+	single.string(1, "10.0.0.1")
+	reply, _ = grpcTestCall(t, "Lookup", single.b)
+	fields = map[int]string{}
+	protoFields(reply, func(field int, value uint64, data []byte) { fields[field] = string(data) })
+	if fields[17] != "10.0.0.0/8" || fields[18] != "10.0.0.0/8" {
+		t.Errorf("Lookup: got networks %q and %q want 10.0.0.0/8", fields[17], fields[18])
+	}
+	reply, _ = grpcTestCall(t, "BatchLookup", single.b)
+	protoFields(reply, func(field int, value uint64, data []byte) {
+		protoFields(data, func(field int, value uint64, data []byte) {
+			if field != 2 {
+				return
+			}
+			fields = map[int]string{}
+			protoFields(data, func(field int, value uint64, data []byte) { fields[field] = string(data) })
+		})
+	})
+	if fields[17] != "10.0.0.0/8" || fields[18] != "10.0.0.0/8" {
+		t.Errorf("BatchLookup: got networks %q and %q want 10.0.0.0/8", fields[17], fields[18])
+	}
+
+	defer func(limit int) { *BatchLimit = limit }(*BatchLimit)
+	*BatchLimit = 1
+	if _, status := grpcTestCall(t, "BatchLookup", req.b); status != "8" {
+		t.Errorf("BatchLookup over the limit: got status %v want 8", status)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	var obj = new()
+	obj.function = GraphQL
+	obj.url = "/graphql?query=" + url.QueryEscape(`{ lookup(ip: "10.0.0.1") { type ip bogon location { __typename } } }`)
+	obj.expectedBody = `{"data":{"lookup":{"type":"private","ip":"10.0.0.1","bogon":true,"location":{"__typename":"Location"}}}}` + "\n"
+	testHTTPFunc(t, obj)
+
+	obj = new()
+	obj.function = GraphQL
+	obj.method = "POST"
+	obj.url = "/graphql"
+	obj.body = strings.NewReader(`{"query":"query Two($ips: [String!]!, $skip: Boolean = true) { a: batch(ips: $ips) { ip as_string @skip(if: $skip) } b: lookup(ip: \"nope\") { ip } }","variables":{"ips":["10.0.0.1","bad"]}}`)
+	obj.expectedBody = `{"data":{"a":[{"ip":"10.0.0.1"},null],"b":null},"errors":[{"message":"invalid IP address","path":["a",1]},{"message":"invalid IP address","path":["b"]}]}` + "\n"
+	testHTTPFunc(t, obj)
+
+	for _, query := range []string{
+		`{ lookup(ip: "10.0.0.1") { nope } }`,
+		`{ lookup(ip: "10.0.0.1") { country } }`,
+		`{ lookup(ip: "10.0.0.1") { ip { code } } }`,
+		`{ lookup(ip: "10.0.0.1", port: 1) { ip } }`,
+		`{ lookup(ip: "10.0.0.1") { ...f } }`,
+		`mutation { lookup { ip } }`,
+		`query($ip: String!) { lookup(ip: $ip) { ip } }`,
+		`{ lookup(ip: "10.0.0.1") { ip }`,
+	} {
+		req := httptest.NewRequest("GET", "/graphql?query="+url.QueryEscape(query), nil)
+		rr := httptest.NewRecorder()
+		GraphQL(rr, req)
+		if rr.Code != http.StatusBadRequest || !strings.HasPrefix(rr.Body.String(), `{"errors":[{"message":`) {
+			t.Errorf("%s: got %v %v", query, rr.Code, rr.Body.String())
+		}
+	}
+
+	defer func(limit int) { *BatchLimit = limit }(*BatchLimit)
+	*BatchLimit = 2
+	obj = new()
+	obj.function = GraphQL
+	obj.url = "/graphql?query=" + url.QueryEscape(`{ a: batch(ips: ["10.0.0.1", "10.0.0.2"]) { ip } b: lookup(ip: "10.0.0.3") { ip } }`)
+	obj.expectedBody = `{"data":{"a":[{"ip":"10.0.0.1"},{"ip":"10.0.0.2"}],"b":null},"errors":[{"message":"too many addresses","path":["b"]}]}` + "\n"
+	testHTTPFunc(t, obj)
+}
+
+func TestGraphQLDepth(t *testing.T) {
+	if _, err := parseGraphQL(strings.Repeat("{a", graphqlMaxDepth)+strings.Repeat("}", graphqlMaxDepth), ""); err != nil {
+		t.Errorf("expected %v levels to parse, got %v", graphqlMaxDepth, err)
+	}
+
+	for _, query := range []string{
+		strings.Repeat("{a", 100000) + strings.Repeat("}", 100000),
+		`{ lookup(ip: ` + strings.Repeat("[", 100000) + `) { ip } }`,
+		`query($ip: ` + strings.Repeat("[", 100000) + `String) { lookup(ip: $ip) { ip } }`,
+	} {
+		if _, err := parseGraphQL(query, ""); err != errGraphQLDepth {
+			t.Errorf("%.20s...: got %v want %v", query, err, errGraphQLDepth)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(strings.Repeat("{a", 1000)))
+	req.Header.Set("Content-Type", "application/graphql")
+	rr := httptest.NewRecorder()
+	GraphQL(rr, req)
+	if expected := `{"errors":[{"message":"query is nested deeper than 32 levels"}]}` + "\n"; rr.Code != http.StatusBadRequest || rr.Body.String() != expected {
+		t.Errorf("got %v %v want %v", rr.Code, rr.Body.String(), expected)
+	}
+}
+
+// writeMaskedFrame writes a client frame, which must be masked.
+func writeMaskedFrame(w io.Writer, fin bool, opcode byte, payload []byte) {
+	header := []byte{opcode, 0x80 | byte(len(payload)), 1, 2, 3, 4}
+	if fin {
+		header[0] |= 0x80
+	}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ header[2+i%4]
+	}
+	w.Write(append(header, masked...))
+}
+
+func TestWebSocket(t *testing.T) {
+	var obj = new()
+	obj.function = WebSocket
+	obj.url = "/ws"
+	obj.expectedStatus = http.StatusUpgradeRequired
+	obj.expectedHeader = http.Header{"Upgrade": {"websocket"}, "Sec-Websocket-Version": {"13"}}
+	obj.expectedBody = "Upgrade Required\n"
+	testHTTPFunc(t, obj)
+
+	server := httptest.NewServer(http.HandlerFunc(WebSocket))
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	rd := bufio.NewReader(conn)
+	res, err := http.ReadResponse(rd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: got %v %v", res.Status, res.Header)
+	}
+
+	readFrame := func() (byte, string) {
+		var header [2]byte
+		if _, err := io.ReadFull(rd, header[:]); err != nil {
+			t.Fatal(err)
+		}
+		size := int(header[1] & 0x7f)
+		if size == 126 {
+			var ext [2]byte
+			io.ReadFull(rd, ext[:])
+			size = int(binary.BigEndian.Uint16(ext[:]))
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(rd, payload); err != nil {
+			t.Fatal(err)
+		}
+		return header[0] & 0x0f, string(payload)
+	}
+
+	// A ping in between the frames of a message is answered right away.
+	writeMaskedFrame(conn, false, websocketText, []byte("10.0."))
+	writeMaskedFrame(conn, true, websocketPing, []byte("hi"))
+	writeMaskedFrame(conn, true, websocketContinuation, []byte("0.1"))
+	if opcode, payload := readFrame(); opcode != websocketPong || payload != "hi" {
+		t.Errorf("ping: got %v %q", opcode, payload)
+	}
+	if opcode, payload := readFrame(); opcode != websocketText || !strings.HasPrefix(payload, `{"ip":"10.0.0.1",`) {
+		t.Errorf("lookup: got %v %q", opcode, payload)
+	}
+
+	writeMaskedFrame(conn, true, websocketText, []byte("nope"))
+	if _, payload := readFrame(); payload != `{"query":"nope","error":"invalid IP address"}` {
+		t.Errorf("invalid address: got %q", payload)
+	}
+
+	writeMaskedFrame(conn, true, websocketClose, []byte{0x03, 0xe8})
+	if opcode, payload := readFrame(); opcode != websocketClose || payload != "\x03\xe8" {
+		t.Errorf("close: got %v %q", opcode, payload)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	defer func(token string) { *AdminToken = token }(*AdminToken)
+	*AdminToken = "secret"
+
+	obj := new()
+	obj.url = "/events"
+	obj.function = Events
+	obj.expectedStatus = http.StatusUnauthorized
+	obj.expectedBody = "Unauthorized\n"
+	testHTTPFunc(t, obj)
+
+	server := httptest.NewServer(http.HandlerFunc(Events))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("wrong Content-Type: %v", res.Header.Get("Content-Type"))
+	}
+
+	lines := bufio.NewScanner(res.Body)
+	if !lines.Scan() || lines.Text() != ": connected" || !lines.Scan() {
+		t.Fatalf("got %q before subscribing", lines.Text())
+	}
+
+	obj = new()
+	obj.url = "/10.0.0.1?fields=ip"
+	obj.function = Lookup
+	obj.expectedBody = `{"ip":"10.0.0.1"}` + "\n"
+	testHTTPFunc(t, obj)
+
+	var name, data string
+	for lines.Scan() && lines.Text() != "" {
+		if strings.HasPrefix(lines.Text(), "event: ") {
+			name = strings.TrimPrefix(lines.Text(), "event: ")
+		}
+		if strings.HasPrefix(lines.Text(), "data: ") {
+			data = strings.TrimPrefix(lines.Text(), "data: ")
+		}
+	}
+	var event lookupEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatal(err)
+	}
+	if name != "lookup" || event.IP != "10.0.0.1" || event.Status != http.StatusOK || event.Time == "" {
+		t.Errorf("got event %q %+v", name, event)
+	}
+}
+
+// dnsQuery builds a query for name with the given type.
+func dnsQuery(name string, qtype uint16) []byte {
+	msg := []byte{0xbe, 0xef, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, dnsName(name)...)
+	return append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+func TestDNSAnswers(t *testing.T) {
+	defer func(o []override) { overrides = o }(overrides)
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	overrides = []override{{network, ipInfo{Country: country{codename: codename{Code: "DE"}}, ASN: 64500, Organization: "Example"}}}
+
+	for _, test := range []struct {
+		name    string
+		qtype   uint16
+		rcode   byte
+		answers uint16
+		rdata   string
+	}{
+		{"192.0.2.1.geo.internal", dnsTypeTXT, dnsNoError, 1, "\x0cip=192.0.2.1\x0acountry=DE\x09asn=64500\x14organization=Example\x12type=documentation"},
+		{"192.0.2.1.GEO.internal", dnsTypeA, dnsNoError, 1, "\x7f\x00\x01\x14"},
+		{"2001-db8--1.geo.internal", dnsTypeTXT, dnsNoError, 1, "\x0eip=2001:db8::1\x12type=documentation"},
+		{"2001-db8--1.geo.internal", dnsTypeA, dnsNoError, 0, ""},
+		{"geo.internal", dnsTypeSOA, dnsNoError, 1, ""},
+		{"nope.geo.internal", dnsTypeTXT, dnsNXDomain, 0, ""},
+		{"1.2.3.4.5.geo.internal", dnsTypeTXT, dnsNXDomain, 0, ""},
+		{"8.8.8.8.example.com", dnsTypeTXT, dnsRefused, 0, ""},
+	} {
+		reply := answerDNS(dnsQuery(test.name, test.qtype), dnsMaxUDP)
+		if len(reply) < 12 || reply[0] != 0xbe || reply[1] != 0xef || reply[2]&0x84 != 0x84 {
+			t.Errorf("%s: malformed reply %x", test.name, reply)
+			continue
+		}
+		if reply[3]&0x0f != test.rcode || binary.BigEndian.Uint16(reply[6:]) != test.answers {
+			t.Errorf("%s: got rcode %v and %v answers, want %v and %v", test.name, reply[3]&0x0f, binary.BigEndian.Uint16(reply[6:]), test.rcode, test.answers)
+		}
+		if test.rdata != "" && !strings.HasSuffix(string(reply), test.rdata) {
+			t.Errorf("%s: got %q want it to end in %q", test.name, reply, test.rdata)
+		}
+	}
+
+	// Answers that don't fit are truncated, for the client to retry over TCP.
+	reply := answerDNS(dnsQuery("192.0.2.1.geo.internal", dnsTypeTXT), 40)
+	if reply[2]&0x02 == 0 || binary.BigEndian.Uint16(reply[6:]) != 0 {
+		t.Errorf("truncation: got %x", reply)
+	}
+	if answerDNS([]byte{1, 2, 3}, dnsMaxUDP) != nil {
+		t.Error("a short message was answered")
+	}
+}
+
+func TestDNSRateLimit(t *testing.T) {
+	defer func(l *limiter) { rateLimiter = l }(rateLimiter)
+	rateLimiter = newLimiter(0.001, 1)
+
+	query := dnsQuery("10.0.0.1.geo.internal", dnsTypeTXT)
+	if reply := serveDNS(query, dnsMaxUDP, "192.0.2.1"); reply[3]&0x0f != dnsNoError || binary.BigEndian.Uint16(reply[6:]) != 1 {
+		t.Errorf("first query: got %x", reply)
+	}
+	reply := serveDNS(query, dnsMaxUDP, "192.0.2.1")
+	if len(reply) != 12 || reply[0] != 0xbe || reply[1] != 0xef || reply[2]&0x80 == 0 || reply[3]&0x0f != dnsRefused {
+		t.Errorf("second query: got %x, want a bare REFUSED header", reply)
+	}
+	if reply := serveDNS(query, dnsMaxUDP, "192.0.2.2"); reply[3]&0x0f != dnsNoError {
+		t.Errorf("other source: got %x", reply)
+	}
+
+	// Without a rate limit the DNS listener keeps one of its own.
+	defer func(l *limiter) { dnsLimiter = l }(dnsLimiter)
+	rateLimiter, dnsLimiter = nil, newLimiter(0.001, 1)
+	serveDNS(query, dnsMaxUDP, "192.0.2.3")
+	if reply := serveDNS(query, dnsMaxUDP, "192.0.2.3"); len(reply) != 12 || reply[3]&0x0f != dnsRefused {
+		t.Errorf("without -rate-limit: got %x, want a bare REFUSED header", reply)
+	}
+}
+
+func TestDNSQuery(t *testing.T) {
+	query := dnsQuery("10.0.0.1.geo.internal", dnsTypeTXT)
+
+	var obj = new()
+	obj.function = DNSQuery
+	obj.url = "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query)
+	obj.expectedHeader = http.Header{"Content-Type": {"application/dns-message"}, "Cache-Control": {"max-age=300"}}
+	obj.expectedBody = string(answerDNS(query, dohMaxMessage))
+	testHTTPFunc(t, obj)
+
+	obj.method = "POST"
+	obj.url = "/dns-query"
+	obj.body = bytes.NewReader(query)
+	obj.headers = []http.Header{{"Content-Type": {"application/dns-message"}}}
+	testHTTPFunc(t, obj)
+
+	obj = new()
+	obj.function = DNSQuery
+	obj.method = "POST"
+	obj.url = "/dns-query"
+	obj.body = bytes.NewReader(query)
+	obj.expectedStatus = http.StatusUnsupportedMediaType
+	obj.expectedBody = "Unsupported Media Type\n"
+	testHTTPFunc(t, obj)
+
+	obj = new()
+	obj.function = DNSQuery
+	obj.url = "/dns-query?dns=not*base64"
+	obj.expectedStatus = http.StatusBadRequest
+	obj.expectedBody = "Bad Request\n"
+	testHTTPFunc(t, obj)
+}
+
+// whoisQuery sends query to a WHOIS connection and returns the answer.
+func whoisQuery(query string) string {
+	client, server := net.Pipe()
+	go serveWhoisConn(server)
+	client.Write([]byte(query))
+	answer, _ := ioutil.ReadAll(client)
+	return string(answer)
+}
+
+func TestWhois(t *testing.T) {
+	defer func(o []override) { overrides = o }(overrides)
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	overrides = []override{{network, ipInfo{City: "Berlin", Country: country{codename: codename{Code: "DE"}}, ASN: 64500, Organization: "Example"}}}
+
+	answer := whoisQuery("192.0.2.1 nope\r\n")
+	for _, line := range []string{
+		"% ipinfo whois, answered from the local databases\r\n\r\n",
+		"ip:             192.0.2.1\r\n",
+		"city:           Berlin\r\n",
+		"country:        DE\r\n",
+		"origin:         AS64500\r\n",
+		"organization:   Example\r\n",
+		"\r\n% error: invalid IP address: nope\r\n",
+	} {
+		if !strings.Contains(answer, line) {
+			t.Errorf("answer %q lacks %q", answer, line)
+		}
+	}
+
+	defer func(limit int) { *BatchLimit = limit }(*BatchLimit)
+	*BatchLimit = 1
+	if answer := whoisQuery("192.0.2.1 192.0.2.2\n"); !strings.HasSuffix(answer, "% error: too many addresses\r\n") {
+		t.Errorf("over the limit: got %q", answer)
+	}
+}
+
+func TestLookupCounters(t *testing.T) {
+	defer func(n int) { *MetricsTopASNs = n }(*MetricsTopASNs)
+	*MetricsTopASNs = 2
+
+	// 15169 and 13335 stand out from a long tail of ASNs seen a few times,
+	// which only ever count as other.
+	c := newASNCounter(nil)
+	var previous map[string]uint64
+	for i := 0; i < 3000; i++ {
+		asn := uint(64512 + i%500)
+		switch i % 10 {
+		case 0, 1, 2, 3:
+			asn = 15169
+		case 4, 5, 6:
+			asn = 13335
+		}
+		c.add(asn)
+
+		asns, counts, other := c.snapshot()
+		series := map[string]uint64{"other": other}
+		for j, asn := range asns {
+			series[strconv.FormatUint(uint64(asn), 10)] = counts[j]
+		}
+		for name, n := range previous {
+			if series[name] < n {
+				t.Fatalf("lookup %v: %v went down from %v to %v", i, name, n, series[name])
+			}
+		}
+		previous = series
+	}
+
+	asns, counts, other := c.snapshot()
+	if !reflect.DeepEqual(asns, []uint{13335, 15169}) || counts[0]+counts[1]+other != 3000 {
+		t.Errorf("got %v %v and other %v", asns, counts, other)
+	}
+	if len(c.candidates) > 20 || len(c.byASN) != len(c.candidates) {
+		t.Errorf("got %v candidates, want them capped at 20", len(c.candidates))
+	}
+
+	countLookup(ipInfo{ASN: 64500})
+	rr := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, metric := range []string{`ipinfo_lookups_total{country="unknown"}`, `ipinfo_lookups_by_asn_total{asn="other"}`} {
+		if !strings.Contains(rr.Body.String(), metric) {
+			t.Errorf("metrics lack %s", metric)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package ipinfo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// asnRanges is the iptoasn.com dump, consulted for the ASN and organization
+// without an ASN database, nil when none is configured.
+var asnRanges []asnRange
+
+// asnRangesByASN holds the ranges of asnRanges by AS number, built along
+// with it when the dump is loaded.
+var asnRangesByASN map[uint][]asnRange
+
+// asnRange is one line of the dump, the addresses are in their 16 byte form.
+// The ranges are not aligned to networks, so they are kept sorted by start
+// and searched rather than held in a trie.
+type asnRange struct {
+	start, end   net.IP
+	asn          uint
+	country      string
+	organization string
+}
+
+// loadASNRanges reads an iptoasn.com dump (ip2asn-combined.tsv, or the v4 or
+// v6 one), gzipped or not, one "range_start\trange_end\tAS_number\t
+// country_code\tAS_description" per line. Unrouted ranges are left out.
+func loadASNRanges(path string) ([]asnRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var list []asnRange
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("line %d: expected 5 fields, got %d", line, len(fields))
+		}
+		start, end := net.ParseIP(fields[0]).To16(), net.ParseIP(fields[1]).To16()
+		if start == nil || end == nil || bytes.Compare(start, end) > 0 {
+			return nil, fmt.Errorf("line %d: invalid range %s-%s", line, fields[0], fields[1])
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid AS number %q", line, fields[2])
+		}
+		if asn == 0 {
+			continue
+		}
+		list = append(list, asnRange{start, end, uint(asn), fields[3], fields[4]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return bytes.Compare(list[i].start, list[j].start) < 0 })
+	return list, nil
+}
+
+// indexASNRanges groups the ranges of the dump by AS number, in order.
+func indexASNRanges(list []asnRange) map[uint][]asnRange {
+	if list == nil {
+		return nil
+	}
+	index := make(map[uint][]asnRange)
+	for _, r := range list {
+		index[r.asn] = append(index[r.asn], r)
+	}
+	return index
+}
+
+// lookupASNRange returns the range holding ip, if any.
+func lookupASNRange(ip net.IP) (asnRange, bool) {
+	ip = ip.To16()
+	// The first range starting after ip, the one before it may hold ip.
+	i := sort.Search(len(asnRanges), func(i int) bool { return bytes.Compare(asnRanges[i].start, ip) > 0 })
+	if i == 0 || bytes.Compare(asnRanges[i-1].end, ip) < 0 {
+		return asnRange{}, false
+	}
+	return asnRanges[i-1], true
+}
@@ -0,0 +1,84 @@
+package ipinfo
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/rs/zerolog/log"
+)
+
+// dbLayers are the databases consulted before the City database, in the
+// order configured, nil for those that could not be opened.
+var dbLayers []*geoip2.Reader
+
+// openLayers opens the layer databases.
+func openLayers(paths []string) []*geoip2.Reader {
+	var layers []*geoip2.Reader
+	for _, path := range paths {
+		layers = append(layers, openOptionalDatabase(path, "layer "+path, "the fields it has"))
+	}
+	return layers
+}
+
+// mergeCity fills in the fields of dst that are empty from src, so the first
+// database having a field is the one it is taken from.
+func mergeCity(dst, src *geoip2.City) {
+	if dst.City.GeoNameID == 0 && len(dst.City.Names) == 0 {
+		dst.City = src.City
+	}
+	if dst.Continent.Code == "" {
+		dst.Continent = src.Continent
+	}
+	if dst.Country.IsoCode == "" {
+		dst.Country = src.Country
+	}
+	if dst.Location.Latitude == 0 && dst.Location.Longitude == 0 {
+		dst.Location.Latitude, dst.Location.Longitude = src.Location.Latitude, src.Location.Longitude
+		dst.Location.AccuracyRadius = src.Location.AccuracyRadius
+	}
+	if dst.Location.MetroCode == 0 {
+		dst.Location.MetroCode = src.Location.MetroCode
+	}
+	if dst.Location.TimeZone == "" {
+		dst.Location.TimeZone = src.Location.TimeZone
+	}
+	if dst.Postal.Code == "" {
+		dst.Postal = src.Postal
+	}
+	if len(dst.Subdivisions) == 0 {
+		dst.Subdivisions = src.Subdivisions
+	}
+	if dst.RegisteredCountry.IsoCode == "" {
+		dst.RegisteredCountry = src.RegisteredCountry
+	}
+	if dst.RepresentedCountry.IsoCode == "" {
+		dst.RepresentedCountry = src.RepresentedCountry
+	}
+}
+
+// lookupLayers merges the lookups of ip in the layers and then db. cityLevel
+// is whether any of them is more than a Country database. The caller holds
+// dbLock.
+func lookupLayers(ip net.IP, db *geoip2.Reader) (rec *geoip2.City, cityLevel bool, err error) {
+	rec = &geoip2.City{}
+	for _, layer := range dbLayers {
+		if layer == nil {
+			continue
+		}
+		r, err := layer.City(ip)
+		if err != nil {
+			log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in layer database")
+			continue
+		}
+		mergeCity(rec, r)
+		cityLevel = cityLevel || !strings.Contains(layer.Metadata().DatabaseType, "Country")
+	}
+
+	r, err := db.City(ip)
+	if err != nil {
+		return rec, cityLevel, err
+	}
+	mergeCity(rec, r)
+	return rec, cityLevel || !strings.Contains(db.Metadata().DatabaseType, "Country"), nil
+}
@@ -0,0 +1,135 @@
+package ipinfo
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter tracks requests per client, nil when rate limiting is disabled
+var rateLimiter *limiter
+
+// limiter is a token bucket per client key. Each bucket holds up to burst
+// tokens and refills at rate tokens per second.
+type limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// take spends a token from the bucket of key. It reports whether one was
+// available, how many whole tokens remain, and how long until the bucket
+// is full again.
+func (l *limiter) take(key string) (ok bool, remaining int, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	}
+
+	reset = time.Duration((l.burst - b.tokens) / l.rate * float64(time.Second))
+	return ok, int(b.tokens), reset
+}
+
+// sweep forgets buckets that have refilled, as they carry no state.
+func (l *limiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limiterSweep forgets idle clients of the current rateLimiter
+var limiterSweep refresher
+
+// initializeLimiter starts rate limiting when RateLimit is set.
+func initializeLimiter() {
+	if *RateLimit <= 0 {
+		limiterSweep.stop()
+		rateLimiter = nil
+		return
+	}
+
+	l := newLimiter(*RateLimit, *RateBurst)
+	rateLimiter = l
+	limiterSweep.start(time.Minute, false, l.sweep)
+}
+
+// Tarpit delays requests from clients that have exceeded the rate limit by
+// TarpitDelay, slowing scrapers down without rejecting legitimate bursts.
+// Every response carries the client's bucket state in rate limit headers.
+func Tarpit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimiter != nil {
+			ok, remaining, reset := rateLimiter.take(limiterKey(r))
+			rateLimitHeaders(w.Header(), rateLimiter, remaining, reset)
+			if !ok && *TarpitDelay > 0 {
+				tarpitted.Inc()
+				timer := time.NewTimer(*TarpitDelay)
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitHeaders sets the RateLimit-Limit, -Remaining and -Reset fields of
+// the IETF RateLimit header fields draft, and the same values under the
+// X-RateLimit- names most clients know. The limit is the bucket size and the
+// reset is in seconds from now, rounded up.
+func rateLimitHeaders(h http.Header, l *limiter, remaining int, reset time.Duration) {
+	limit := strconv.Itoa(int(l.burst))
+	left := strconv.Itoa(remaining)
+	until := strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10)
+	for _, prefix := range []string{"", "X-"} {
+		h.Set(prefix+"RateLimit-Limit", limit)
+		h.Set(prefix+"RateLimit-Remaining", left)
+		h.Set(prefix+"RateLimit-Reset", until)
+	}
+}
@@ -0,0 +1,28 @@
+package ipinfo
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// Filesystem magic numbers from statfs(2).
+var networkFilesystems = map[uint32]bool{
+	0x6969:     true, // NFS
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x517b:     true, // SMB
+	0x564c:     true, // NCP
+	0x65735546: true, // FUSE (sshfs, s3fs, ...)
+}
+
+// isNetworkFilesystem reports whether path lives on a network filesystem.
+// When path does not exist yet, its directory is checked instead.
+func isNetworkFilesystem(path string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		if err := syscall.Statfs(filepath.Dir(path), &fs); err != nil {
+			return false
+		}
+	}
+	return networkFilesystems[uint32(fs.Type)]
+}
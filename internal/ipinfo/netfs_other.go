@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package ipinfo
+
+// isNetworkFilesystem cannot tell network filesystems apart on this
+// platform, so mmap is always attempted first.
+func isNetworkFilesystem(path string) bool {
+	return false
+}
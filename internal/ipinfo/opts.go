@@ -1,14 +1,149 @@
 package ipinfo
 
 import (
+	"time"
+
 	"github.com/namsral/flag"
 )
 
 var (
+	// ConfigFile holds flags, one per line, re-read on Reload
+	ConfigFile = flag.String(flag.DefaultConfigFlagname, "", "file of flags, one name=value per line, re-read on SIGHUP")
 	// Locale assists in determining the language
 	Locale = flag.String("locale", "en", "locale")
 	// Port to bind the http server on
 	Port = flag.Int("port", 8000, "port to bind http server")
+	// MaxMindAccountID authenticates database downloads from MaxMind
+	MaxMindAccountID = flag.String("maxmind-account-id", "", "MaxMind account ID for database downloads")
+	// MaxMindLicenseKey enables database downloads and refreshes from MaxMind
+	MaxMindLicenseKey = flag.String("maxmind-license-key", "", "MaxMind license key, downloads and refreshes the databases when set")
+	// UpdateInterval is how often the databases are refreshed from MaxMind
+	UpdateInterval = flag.Duration("update-interval", 24*time.Hour, "how often to check MaxMind for new database builds")
+	// WatchInterval is how often the databases are checked for replacements
+	WatchInterval = flag.Duration("watch-interval", 0, "how often to check the databases for replacements to reload (0 disables)")
+	// CityDB is the City database, relative to the working directory unless absolute
+	CityDB = flag.String("city-db", "GeoLite2-City.mmdb", "City database (or a DB-IP City or Country mmdb), relative to the working directory")
+	// ASNDB is the ASN database, relative to the working directory unless absolute
+	ASNDB = flag.String("asn-db", "GeoLite2-ASN.mmdb", "ASN database, relative to the working directory")
+	// IPToASN is an iptoasn.com dump used for ASN data without an ASN database
+	IPToASN = flag.String("iptoasn", "", "iptoasn.com TSV dump (optionally gzipped) for ASN data when the ASN database is missing, relative to the working directory")
+	// DBLoadMode is how databases are opened, memory avoids mmap on network filesystems
+	DBLoadMode = flag.String("db-load-mode", "mmap", "how to open databases: mmap, or memory to read them in whole (for NFS)")
+	// BinaryPort serves the binary lookup protocol (0 disables)
+	BinaryPort = flag.Int("binary-port", 0, "port to serve the binary lookup protocol on (0 disables)")
+	// GRPCPort serves the gRPC lookup service over TLS (0 disables)
+	GRPCPort = flag.Int("grpc-port", 0, "port to serve the gRPC lookup service on, requires -grpc-cert and -grpc-key (0 disables)")
+	// GRPCCert and GRPCKey are the TLS certificate and key of the gRPC listener
+	GRPCCert = flag.String("grpc-cert", "", "PEM certificate file of the gRPC listener")
+	GRPCKey  = flag.String("grpc-key", "", "PEM private key file of the gRPC listener")
+	// WhoisPort answers WHOIS queries (0 disables)
+	WhoisPort = flag.Int("whois-port", 0, "port to answer WHOIS queries on, usually 43 (0 disables)")
+	// DNSPort answers geo queries over DNS, UDP and TCP (0 disables)
+	DNSPort = flag.Int("dns-port", 0, "port to answer geo TXT and A queries over DNS on (0 disables)")
+	// DNSZone is the zone whose names are addresses to look up
+	DNSZone = flag.String("dns-zone", "geo.internal", "zone answered on -dns-port, queried as 8.8.8.8.<zone> or 2001-db8--1.<zone>")
+	// DNSRateLimit is the queries per second allowed per source on DNSPort without a RateLimit
+	DNSRateLimit = flag.Float64("dns-rate-limit", 20, "queries per second allowed per source address on -dns-port when -rate-limit is 0 (0 disables)")
+	// DNSTTL is the TTL of the DNS answers
+	DNSTTL = flag.Duration("dns-ttl", 5*time.Minute, "TTL of the geo DNS answers")
+	// MetricsTopASNs is how many ASNs get their own lookup counter (0 disables)
+	MetricsTopASNs = flag.Int("metrics-top-asns", 20, "number of most looked up ASNs counted in ipinfo_lookups_by_asn_total (0 disables it)")
 	// Loglevel (0=debug, 1=info, 2=warn, 3=error)
 	Loglevel = flag.Int("loglevel", 1, "log level (0=debug, 1=info, 2=warn, 3=error)")
+	// ClientIPHeaders resolve "self" behind reverse proxies, in order of precedence
+	ClientIPHeaders = flag.String("client-ip-headers", "X-Real-Ip,X-Original-Forwarded-For,X-Forwarded-For", "comma-separated request headers holding the client IP, in order of precedence")
+	// TrustedProxies are skipped when walking forwarding chains
+	TrustedProxies = flag.String("trusted-proxies", "", "comma-separated CIDRs of reverse proxies whose client IP headers are trusted")
+	// MaxForwardedHops caps the forwarding chain entries parsed per request
+	MaxForwardedHops = flag.Int("max-forwarded-hops", 32, "maximum forwarding chain entries parsed when resolving the client IP (0 is unlimited)")
+	// DNSTimeout bounds each reverse and forward DNS lookup
+	DNSTimeout = flag.Duration("dns-timeout", time.Second, "timeout for each reverse or forward DNS lookup")
+	// HostnameLookups resolves hostnames in the path and geolocates their addresses
+	HostnameLookups = flag.Bool("hostname-lookups", false, "resolve hostnames like /example.com or /lookup?host=example.com and look up each address")
+	// DNSServer is the DNS server to resolve with instead of the system resolver
+	DNSServer = flag.String("dns-server", "", "DNS server (host or host:port) for reverse and hostname lookups, empty uses the system resolver")
+	// ReverseDNS adds the hostname to every lookup
+	ReverseDNS = flag.Bool("reverse-dns", false, "include the reverse DNS hostname in every lookup, as with reverse=1")
+	// HostnameCacheSize is the number of reverse lookups kept in memory (0 disables)
+	HostnameCacheSize = flag.Int("hostname-cache-size", 0, "number of reverse DNS lookups to cache in memory (0 disables)")
+	// HostnameCacheTTL is how long reverse lookups are cached
+	HostnameCacheTTL = flag.Duration("hostname-cache-ttl", time.Hour, "how long to cache each reverse DNS lookup")
+	// CacheSize is the number of lookups kept in memory (0 disables)
+	CacheSize = flag.Int("cache-size", 0, "number of lookups to cache in memory (0 disables)")
+	// CacheIPv6Prefix is the IPv6 prefix length lookups are cached on
+	CacheIPv6Prefix = flag.Int("cache-ipv6-prefix", 128, "prefix length IPv6 lookups are cached on, 64 shares an entry across a /64 (128 is exact)")
+	// Populations is an optional GeoNames cities dump in the working directory
+	Populations = flag.String("populations", "cities15000.txt", "GeoNames cities dump in the working directory used for populations, if present")
+	// GeoNamesNames fills in names missing from the database from the GeoNames dump and built-in names
+	GeoNamesNames = flag.Bool("geonames-names", false, "fill in English names missing from the database, of cities from the populations GeoNames dump at a memory cost, of countries, subdivisions and continents from built-in names")
+	// PoPs is a CSV list of points of presence for pop=1
+	PoPs = flag.String("pops", "", "CSV file of points of presence (name,latitude,longitude) for pop=1")
+	// Layers are mmdb files consulted before the City database
+	Layers = flag.String("layers", "", "comma-separated mmdb files consulted before the City database, the first having a field wins")
+	// Geofences is a CSV list of named geofences for /geofence/
+	Geofences = flag.String("geofences", "", "CSV file of geofence rules (name,allow|deny,country|region|circle|polygon,values...) for /geofence/")
+	// DatacenterASNs replaces the built-in list of hosting, cloud and VPN ASNs
+	DatacenterASNs = flag.String("datacenter-asns", "", "file of hosting, cloud and VPN ASNs, one per line, replacing the built-in list for is_datacenter")
+	// Overrides is a CSV list of networks answered before the databases
+	Overrides = flag.String("overrides", "", "CSV file of networks answered before the databases (cidr,city,region,country,organization,latitude,longitude)")
+	// EmptyNames is what to report for places without a name in any locale
+	EmptyNames = flag.String("empty-names", "", "places without a name in any locale: empty leaves the name blank, geonameid reports geonames:<id>")
+	// DisablePostal omits the postal code from every response
+	DisablePostal = flag.Bool("disable-postal", false, "omit the postal code from all responses")
+	// MarkAnycast flags well-known anycast addresses in lookups
+	MarkAnycast = flag.Bool("mark-anycast", false, "mark well-known anycast addresses, whose coordinates are only representative")
+	// InvalidContinent decides what happens to unexpected continent codes
+	InvalidContinent = flag.String("invalid-continent", "", "invalid continent codes: empty passes through, 'omit' drops the block, anything else is used as the code")
+	// LogOrganization adds the resolved organization and ISP to the access log
+	LogOrganization = flag.Bool("log-organization", false, "include the resolved organization and ISP in the access log")
+	// DevIP is looked up instead of private self-resolved addresses (development only)
+	DevIP = flag.String("devip", "", "development only: public IP to look up when self resolves to a private address")
+	// ServerIPURL is an echo service answering with the server's public IP
+	ServerIPURL = flag.String("server-ip-url", "", "URL answering with the server's public IP, served at /server-ip (empty disables)")
+	// ServerIPInterval is how often the server's public IP is checked
+	ServerIPInterval = flag.Duration("server-ip-interval", time.Hour, "how often to check the server's public IP")
+	// TorExitURL is the list of Tor exit node addresses, one per line
+	TorExitURL = flag.String("tor-exit-url", "", "URL of the Tor exit node list, like https://check.torproject.org/torbulkexitlist, adds tor to lookups (empty disables)")
+	// RPKIURL is a validator with Routinator's HTTP API for rpki=1
+	RPKIURL = flag.String("rpki-url", "", "base URL of a validator with Routinator's HTTP API, like http://routinator:8323, for rpki=1 (empty disables)")
+	// RPKICacheTTL is how long route origin validation answers are kept
+	RPKICacheTTL = flag.Duration("rpki-cache-ttl", 15*time.Minute, "how long to keep route origin validation answers")
+	// CloudRanges adds the cloud provider of addresses in their published ranges
+	CloudRanges = flag.Bool("cloud-ranges", false, "download the AWS, Google Cloud, Oracle Cloud and Cloudflare ranges, adds cloud to lookups")
+	// CloudAzureURL is the Azure ServiceTags_Public file, which moves weekly
+	CloudAzureURL = flag.String("cloud-azure-url", "", "URL of the Azure ServiceTags_Public JSON file to add to the cloud ranges (empty skips Azure)")
+	// CloudInterval is how often the cloud ranges are downloaded
+	CloudInterval = flag.Duration("cloud-interval", 24*time.Hour, "how often to download the cloud ranges")
+	// TorExitInterval is how often the Tor exit node list is downloaded
+	TorExitInterval = flag.Duration("tor-exit-interval", 30*time.Minute, "how often to download the Tor exit node list")
+	// GzipLevel trades CPU for bandwidth on compressed responses (0 disables)
+	GzipLevel = flag.Int("gzip-level", 1, "gzip compression level from 1 (fastest) to 9 (smallest), 0 disables")
+	// RateLimit is the sustained requests per second allowed per client IP (0 disables)
+	RateLimit = flag.Float64("rate-limit", 0, "requests per second allowed per client IP before tarpitting (0 disables)")
+	// RateBurst is the number of requests a client may burst above RateLimit
+	RateBurst = flag.Int("rate-burst", 20, "requests a client may burst before the rate limit applies")
+	// TarpitDelay is added to requests from clients over the rate limit
+	TarpitDelay = flag.Duration("tarpit-delay", 50*time.Millisecond, "delay added to requests from clients over the rate limit")
+	// WebhookURL receives lookups matching WebhookCountries or WebhookASNs
+	WebhookURL = flag.String("webhook-url", "", "URL to POST lookups matching the webhook countries or ASNs to")
+	// WebhookCountries are ISO country codes that trigger the webhook
+	WebhookCountries = flag.String("webhook-countries", "", "comma-separated ISO country codes that trigger the webhook")
+	// WebhookASNs are AS numbers that trigger the webhook
+	WebhookASNs = flag.String("webhook-asns", "", "comma-separated ASNs that trigger the webhook")
+	// WebhookQueue is the number of deliveries held before new ones are dropped
+	WebhookQueue = flag.Int("webhook-queue", 100, "webhook deliveries to queue before dropping")
+	// WebhookTimeout bounds each webhook delivery
+	WebhookTimeout = flag.Duration("webhook-timeout", 5*time.Second, "timeout for each webhook delivery")
+	// DefaultFormat is the output format of lookups that do not ask for one
+	DefaultFormat = flag.String("default-format", "", "output format of lookups that do not ask for one, like ipinfo for the ipinfo.io schema (empty is the native JSON)")
+	// AdminToken is the bearer token for the /admin endpoints and /events
+	AdminToken = flag.String("admin-token", "", "bearer token for /admin/status, /admin/reload and /events (empty disables them)")
+	// Pprof serves the runtime profiles for debugging
+	Pprof = flag.Bool("pprof", false, "serve net/http/pprof profiles under /debug/pprof/")
+	// PprofAddr is the separate listener for the profiles
+	PprofAddr = flag.String("pprof-addr", "localhost:6060", "address to serve the profiles on, empty serves them on the main port")
+	// BatchLimit caps the addresses looked up in a single request
+	BatchLimit = flag.Int("batch-limit", 100, "maximum addresses in a single lookup or buffered batch")
+	// BatchWorkers caps the number of concurrent batch lookups
+	BatchWorkers = flag.Int("batch-workers", 4, "maximum concurrent lookups across all batch requests")
 )
@@ -0,0 +1,106 @@
+package ipinfo
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// overrides answer lookups of the operator's own address space before the
+// databases, the most specific network first, nil without an override list.
+// Guarded by dbLock.
+var overrides []override
+
+type override struct {
+	network *net.IPNet
+	info    ipInfo
+}
+
+// loadOverrides reads an override list, one
+// "cidr,city,region,country,organization,latitude,longitude" per line. All
+// but the CIDR may be left empty, and the trailing fields out. Lines
+// starting with # are skipped.
+func loadOverrides(path string) ([]override, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]override, 0, len(records))
+	for i, record := range records {
+		if len(record) > 7 {
+			return nil, fmt.Errorf("line %d: too many fields", i+1)
+		}
+		field := func(n int) string {
+			if n < len(record) {
+				return strings.TrimSpace(record[n])
+			}
+			return ""
+		}
+
+		_, network, err := net.ParseCIDR(field(0))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid CIDR %q", i+1, field(0))
+		}
+		code := strings.ToUpper(field(3))
+		fact := countryFacts[code]
+		info := ipInfo{
+			City:   field(1),
+			Region: field(2),
+			Country: country{
+				codename:    codename{Code: code},
+				Flag:        flagEmoji(code),
+				Currency:    fact.currency,
+				CallingCode: fact.callingCode,
+			},
+			Organization: field(4),
+		}
+		if field(5) != "" || field(6) != "" {
+			latitude, err := strconv.ParseFloat(field(5), 64)
+			if err != nil || latitude < -90 || latitude > 90 {
+				return nil, fmt.Errorf("line %d: invalid latitude %q", i+1, field(5))
+			}
+			longitude, err := strconv.ParseFloat(field(6), 64)
+			if err != nil || longitude < -180 || longitude > 180 {
+				return nil, fmt.Errorf("line %d: invalid longitude %q", i+1, field(6))
+			}
+			info.Location = location{Latitude: latitude, Longitude: longitude}
+		}
+		list = append(list, override{network, info})
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, _ := list[i].network.Mask.Size()
+		b, _ := list[j].network.Mask.Size()
+		return a > b
+	})
+	return list, nil
+}
+
+// lookupOverride returns the override of the most specific network holding
+// ip, if any.
+func lookupOverride(ip net.IP) (ipInfo, bool) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	for _, o := range overrides {
+		if o.network.Contains(ip) {
+			return o.info, true
+		}
+	}
+	return ipInfo{}, false
+}
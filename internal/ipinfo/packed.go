@@ -0,0 +1,341 @@
+package ipinfo
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// packer writes the items of a binary encoding like MessagePack or CBOR,
+// which both map the JSON data model one to one.
+type packer interface {
+	mapHeader(n int)
+	arrayHeader(n int)
+	str(s string)
+	uint(u uint64)
+	int(i int64)
+	float(f float64)
+	bool(b bool)
+	null()
+}
+
+// pack encodes v like encoding/json would, honoring the json field tags, so
+// the binary formats carry the same fields without paying for JSON text.
+func pack(p packer, v interface{}) {
+	packValue(p, reflect.ValueOf(v))
+}
+
+// encodePacked encodes v as "msgpack" or "cbor".
+func encodePacked(format string, v interface{}) []byte {
+	if format == "cbor" {
+		c := cbor{b: make([]byte, 0, 512)}
+		pack(&c, v)
+		return c.b
+	}
+	m := msgpack{b: make([]byte, 0, 512)}
+	pack(&m, v)
+	return m.b
+}
+
+var numberType = reflect.TypeOf(json.Number(""))
+
+func packValue(p packer, v reflect.Value) {
+	if !v.IsValid() {
+		p.null()
+		return
+	}
+	if v.Type() == numberType {
+		packNumber(p, json.Number(v.String()))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			p.null()
+			return
+		}
+		packValue(p, v.Elem())
+	case reflect.Struct:
+		fields := packFields(v.Type())
+		n := 0
+		for _, f := range fields {
+			if !f.omitEmpty || !isEmptyValue(v.FieldByIndex(f.index)) {
+				n++
+			}
+		}
+		p.mapHeader(n)
+		for _, f := range fields {
+			field := v.FieldByIndex(f.index)
+			if f.omitEmpty && isEmptyValue(field) {
+				continue
+			}
+			p.str(f.name)
+			packValue(p, field)
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			p.null()
+			return
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		p.mapHeader(len(keys))
+		for _, key := range keys {
+			p.str(key)
+			packValue(p, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())))
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			p.null()
+			return
+		}
+		p.arrayHeader(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			packValue(p, v.Index(i))
+		}
+	case reflect.String:
+		p.str(v.String())
+	case reflect.Bool:
+		p.bool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		p.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		p.uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		p.float(v.Float())
+	default:
+		p.null()
+	}
+}
+
+// packNumber encodes a number decoded from JSON, integers staying integers.
+func packNumber(p packer, n json.Number) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		p.int(i)
+	} else if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		p.uint(u)
+	} else {
+		f, _ := n.Float64()
+		p.float(f)
+	}
+}
+
+type packField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// fieldCache holds the packFields of each struct type.
+var fieldCache sync.Map
+
+// packFields lists the fields encoding/json marshals for a struct type, with
+// the fields of untagged embedded structs inlined.
+func packFields(t reflect.Type) []packField {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]packField)
+	}
+
+	var fields []packField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range packFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, packField{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: strings.Contains(tag, ",omitempty"),
+		})
+	}
+
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// isEmptyValue is the omitempty test of encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// msgpack writes MessagePack, https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpack struct{ b []byte }
+
+// sized writes the code for the smallest of 8, 16 and 32 bit lengths that
+// fits n, and n. A zero code skips that size.
+func (m *msgpack) sized(codes [3]byte, n uint64) {
+	switch {
+	case n <= math.MaxUint8 && codes[0] != 0:
+		m.b = append(m.b, codes[0], byte(n))
+	case n <= math.MaxUint16:
+		m.b = append(m.b, codes[1], byte(n>>8), byte(n))
+	default:
+		m.b = append(m.b, codes[2], byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func (m *msgpack) mapHeader(n int) {
+	if n < 16 {
+		m.b = append(m.b, 0x80|byte(n))
+		return
+	}
+	m.sized([3]byte{0, 0xde, 0xdf}, uint64(n))
+}
+
+func (m *msgpack) arrayHeader(n int) {
+	if n < 16 {
+		m.b = append(m.b, 0x90|byte(n))
+		return
+	}
+	m.sized([3]byte{0, 0xdc, 0xdd}, uint64(n))
+}
+
+func (m *msgpack) str(s string) {
+	if len(s) < 32 {
+		m.b = append(m.b, 0xa0|byte(len(s)))
+	} else {
+		m.sized([3]byte{0xd9, 0xda, 0xdb}, uint64(len(s)))
+	}
+	m.b = append(m.b, s...)
+}
+
+func (m *msgpack) uint(u uint64) {
+	switch {
+	case u < 128:
+		m.b = append(m.b, byte(u))
+	case u <= math.MaxUint32:
+		m.sized([3]byte{0xcc, 0xcd, 0xce}, u)
+	default:
+		m.b = append(m.b, 0xcf)
+		m.b = appendUint64(m.b, u)
+	}
+}
+
+func (m *msgpack) int(i int64) {
+	switch {
+	case i >= 0:
+		m.uint(uint64(i))
+	case i >= -32:
+		m.b = append(m.b, byte(i))
+	case i >= math.MinInt8:
+		m.b = append(m.b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		m.b = append(m.b, 0xd1, byte(i>>8), byte(i))
+	case i >= math.MinInt32:
+		m.b = append(m.b, 0xd2, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	default:
+		m.b = append(m.b, 0xd3)
+		m.b = appendUint64(m.b, uint64(i))
+	}
+}
+
+func (m *msgpack) float(f float64) {
+	m.b = append(m.b, 0xcb)
+	m.b = appendUint64(m.b, math.Float64bits(f))
+}
+
+func (m *msgpack) bool(b bool) {
+	if b {
+		m.b = append(m.b, 0xc3)
+	} else {
+		m.b = append(m.b, 0xc2)
+	}
+}
+
+func (m *msgpack) null() { m.b = append(m.b, 0xc0) }
+
+// cbor writes CBOR, RFC 8949.
+type cbor struct{ b []byte }
+
+func (c *cbor) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		c.b = append(c.b, major|byte(n))
+	case n <= math.MaxUint8:
+		c.b = append(c.b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		c.b = append(c.b, major|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		c.b = append(c.b, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		c.b = append(c.b, major|27)
+		c.b = appendUint64(c.b, n)
+	}
+}
+
+func (c *cbor) mapHeader(n int)   { c.head(5, uint64(n)) }
+func (c *cbor) arrayHeader(n int) { c.head(4, uint64(n)) }
+func (c *cbor) uint(u uint64)     { c.head(0, u) }
+
+func (c *cbor) str(s string) {
+	c.head(3, uint64(len(s)))
+	c.b = append(c.b, s...)
+}
+
+func (c *cbor) int(i int64) {
+	if i >= 0 {
+		c.head(0, uint64(i))
+	} else {
+		c.head(1, uint64(-1-i))
+	}
+}
+
+func (c *cbor) float(f float64) {
+	c.b = append(c.b, 0xfb)
+	c.b = appendUint64(c.b, math.Float64bits(f))
+}
+
+func (c *cbor) bool(b bool) {
+	if b {
+		c.b = append(c.b, 0xf5)
+	} else {
+		c.b = append(c.b, 0xf4)
+	}
+}
+
+func (c *cbor) null() { c.b = append(c.b, 0xf6) }
+
+func appendUint64(b []byte, u uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], u)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,73 @@
+package ipinfo
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pops are the operator's points of presence, nil without a PoP list
+var pops []pop
+
+type pop struct {
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+type nearestPoP struct {
+	Name     string  `json:"name"`
+	Distance float64 `json:"distance"`
+}
+
+// loadPoPs reads a PoP list, one "name,latitude,longitude" per line. Lines
+// starting with # are skipped.
+func loadPoPs(path string) ([]pop, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]pop, 0, len(records))
+	for i, record := range records {
+		latitude, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil || latitude < -90 || latitude > 90 {
+			return nil, fmt.Errorf("line %d: invalid latitude %q", i+1, record[1])
+		}
+		longitude, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil || longitude < -180 || longitude > 180 {
+			return nil, fmt.Errorf("line %d: invalid longitude %q", i+1, record[2])
+		}
+		list = append(list, pop{Name: strings.TrimSpace(record[0]), Latitude: latitude, Longitude: longitude})
+	}
+	return list, nil
+}
+
+// closestPoP finds the PoP nearest to the coordinates, with the distance in
+// kilometers. It returns nil without a PoP list.
+func closestPoP(latitude, longitude float64) *nearestPoP {
+	var nearest *nearestPoP
+	for _, p := range pops {
+		d := greatCircle(latitude, longitude, p.Latitude, p.Longitude)
+		if nearest == nil || d < nearest.Distance {
+			nearest = &nearestPoP{Name: p.Name, Distance: d}
+		}
+	}
+	if nearest != nil {
+		nearest.Distance = math.Round(nearest.Distance*10) / 10
+	}
+	return nearest
+}
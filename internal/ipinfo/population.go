@@ -0,0 +1,102 @@
+package ipinfo
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// populations maps GeoNames IDs to their population, nil without a dataset
+var populations map[uint]uint64
+
+// placeNames maps GeoNames IDs to their English name, nil unless
+// GeoNamesNames is set
+var placeNames map[uint]string
+
+// Sources of the names filled in by fallbackName.
+const (
+	nameSourceGeoNames = "geonames"
+	nameSourceBuiltin  = "builtin"
+)
+
+// fallbackName is the English name of a place the database has no name for,
+// from the GeoNames dump by its ID, or else from the built-in names of the
+// countries, subdivisions and continents by their code. It returns the name
+// and its source, or nothing.
+func fallbackName(p place, field string) (string, string) {
+	if name, ok := placeNames[p.geoNameID]; ok {
+		return name, nameSourceGeoNames
+	}
+	var names map[string]string
+	switch field {
+	case "country":
+		names = isoCountryNames
+	case "region", "subdivision":
+		names = isoSubdivisionNames
+	case "continent":
+		names = continentNames
+	}
+	if name, ok := names[p.code]; ok {
+		return name, nameSourceBuiltin
+	}
+	return "", ""
+}
+
+// Column positions in the GeoNames tab-separated dumps (cities15000.txt and
+// friends), see https://download.geonames.org/export/dump/readme.txt
+const (
+	geonamesID         = 0
+	geonamesName       = 1
+	geonamesPopulation = 14
+)
+
+// scanGeoNames calls fn with the ID and columns of every place in a GeoNames
+// dump, skipping malformed lines.
+func scanGeoNames(path string, fn func(id uint, fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Lines carry every alternate name of the place and can be long.
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) <= geonamesPopulation {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[geonamesID], 10, 32)
+		if err != nil {
+			continue
+		}
+		fn(uint(id), fields)
+	}
+	return scanner.Err()
+}
+
+// loadPopulations reads a GeoNames dump. Places without a population are
+// skipped to keep the map small.
+func loadPopulations(path string) (map[uint]uint64, error) {
+	m := make(map[uint]uint64)
+	err := scanGeoNames(path, func(id uint, fields []string) {
+		population, err := strconv.ParseUint(fields[geonamesPopulation], 10, 64)
+		if err == nil && population != 0 {
+			m[id] = population
+		}
+	})
+	return m, err
+}
+
+// loadPlaceNames reads the English names of the places in a GeoNames dump.
+func loadPlaceNames(path string) (map[uint]string, error) {
+	m := make(map[uint]string)
+	err := scanGeoNames(path, func(id uint, fields []string) {
+		if name := fields[geonamesName]; name != "" {
+			m[id] = name
+		}
+	})
+	return m, err
+}
@@ -0,0 +1,19 @@
+package ipinfo
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// PprofHandler serves the runtime profiles under /debug/pprof/. Importing
+// net/http/pprof also registers them on http.DefaultServeMux, which is why
+// the main listener has a mux of its own.
+func PprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
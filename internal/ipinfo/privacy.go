@@ -0,0 +1,24 @@
+package ipinfo
+
+import "github.com/oschwald/geoip2-golang"
+
+// privacy tells whether an address hides its user, from the Anonymous IP
+// database. Anonymous is set for any of the reasons, and for anonymizers the
+// database knows of without saying which kind.
+type privacy struct {
+	VPN       bool `json:"vpn"`
+	Proxy     bool `json:"proxy"`
+	Tor       bool `json:"tor"`
+	Hosting   bool `json:"hosting"`
+	Anonymous bool `json:"anonymous"`
+}
+
+func newPrivacy(rec *geoip2.AnonymousIP) *privacy {
+	return &privacy{
+		VPN:       rec.IsAnonymousVPN,
+		Proxy:     rec.IsPublicProxy,
+		Tor:       rec.IsTorExitNode,
+		Hosting:   rec.IsHostingProvider,
+		Anonymous: rec.IsAnonymous,
+	}
+}
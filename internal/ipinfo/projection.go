@@ -0,0 +1,40 @@
+package ipinfo
+
+import (
+	"math"
+	"strings"
+)
+
+// Radius of the WGS84 ellipsoid used by Web Mercator, in meters.
+const earthRadius = 6378137.0
+
+// Web Mercator is undefined at the poles, so latitudes are clamped.
+const maxMercatorLatitude = 85.05112878
+
+type projected struct {
+	System string  `json:"system"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+}
+
+// projections maps the accepted ?proj= values to a conversion from WGS84.
+var projections = map[string]func(latitude, longitude float64) projected{
+	"webmercator": webMercator,
+	"epsg:3857":   webMercator,
+}
+
+// projection returns the conversion for the requested projection name.
+func projection(name string) (func(latitude, longitude float64) projected, bool) {
+	project, ok := projections[strings.ToLower(name)]
+	return project, ok
+}
+
+// webMercator projects WGS84 coordinates to EPSG:3857, in meters.
+func webMercator(latitude, longitude float64) projected {
+	latitude = math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, latitude))
+	return projected{
+		System: "EPSG:3857",
+		X:      earthRadius * longitude * math.Pi / 180,
+		Y:      earthRadius * math.Log(math.Tan(math.Pi/4+latitude*math.Pi/360)),
+	}
+}
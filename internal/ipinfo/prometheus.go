@@ -1,10 +1,19 @@
 package ipinfo
 
 import (
+	"container/heap"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 var (
@@ -14,11 +23,252 @@ var (
 			Help:    "Jobs duration distribution",
 			Buckets: []float64{.100, .200, .300, .400, .500, 1.000},
 		},
-		[]string{"status"},
+		[]string{"endpoint", "status"},
 	)
+	webhookDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_deliveries_total",
+			Help: "Webhook deliveries by result (success, failure, dropped)",
+		},
+		[]string{"result"},
+	)
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "lookup_cache_requests_total",
+			Help: "Lookup cache requests by result (hit, miss)",
+		},
+		[]string{"result"},
+	)
+	tarpitted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tarpitted_requests_total",
+			Help: "Requests delayed for exceeding the rate limit",
+		},
+	)
+	lookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ipinfo_lookups_total",
+			Help: "Lookups by country ISO code, unknown without one",
+		},
+		[]string{"country"},
+	)
+	asnLookups = newASNCounter(prometheus.NewDesc(
+		"ipinfo_lookups_by_asn_total",
+		"Lookups of the most looked up ASNs since they were chosen, the rest as other",
+		[]string{"asn"}, nil,
+	))
 )
 
 func init() {
 	prometheus.MustRegister(duration)
-	http.Handle("/metrics", promhttp.Handler())
+	prometheus.MustRegister(cacheRequests)
+	prometheus.MustRegister(tarpitted)
+	prometheus.MustRegister(webhookDeliveries)
+	prometheus.MustRegister(lookups)
+	prometheus.MustRegister(asnLookups)
+}
+
+// countLookup adds a lookup to the per-country and per-ASN counters.
+func countLookup(info ipInfo) {
+	code := info.Country.Code
+	if code == "" {
+		code = "unknown"
+	}
+	lookups.WithLabelValues(code).Inc()
+	if info.ASN != 0 {
+		asnLookups.add(info.ASN)
+	}
+}
+
+// asnCounter counts lookups of up to MetricsTopASNs of the most looked up
+// ASNs, and of all the others as other. Candidates are found with the
+// Space-Saving algorithm, which keeps approximate counts for ten times as
+// many ASNs however many are seen: a new ASN takes the place of the least
+// counted one and inherits its count. Once there have been as many lookups,
+// a candidate known to have more than 1/(2*MetricsTopASNs) of them is
+// counted on its own from then on, while there is room. ASNs are never
+// dropped again, so that every series only goes up as counters must.
+type asnCounter struct {
+	desc *prometheus.Desc
+
+	mu sync.Mutex
+	// Exact counts of the chosen ASNs since they were chosen.
+	counts map[uint]uint64
+	other  uint64
+	total  uint64
+	// The candidates, in a heap with the least counted first.
+	candidates asnHeap
+	byASN      map[uint]*asnCandidate
+}
+
+type asnCandidate struct {
+	asn   uint
+	count uint64
+	// The count inherited from the candidate it replaced, by which count
+	// may be too high.
+	inherited uint64
+	index     int
+}
+
+// asnHeap is a container/heap of candidates by count.
+type asnHeap []*asnCandidate
+
+func (h asnHeap) Len() int           { return len(h) }
+func (h asnHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h asnHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *asnHeap) Push(x interface{}) {
+	c := x.(*asnCandidate)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *asnHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+func newASNCounter(desc *prometheus.Desc) *asnCounter {
+	return &asnCounter{desc: desc, counts: map[uint]uint64{}, byASN: map[uint]*asnCandidate{}}
+}
+
+func (c *asnCounter) add(asn uint) {
+	if *MetricsTopASNs <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total++
+	if _, ok := c.counts[asn]; ok {
+		c.counts[asn]++
+		return
+	}
+	c.other++
+
+	capacity := 10 * *MetricsTopASNs
+	candidate, ok := c.byASN[asn]
+	switch {
+	case ok:
+		candidate.count++
+		heap.Fix(&c.candidates, candidate.index)
+	case len(c.candidates) < capacity:
+		candidate = &asnCandidate{asn: asn, count: 1}
+		c.byASN[asn] = candidate
+		heap.Push(&c.candidates, candidate)
+	default:
+		candidate = c.candidates[0]
+		delete(c.byASN, candidate.asn)
+		candidate.asn = asn
+		candidate.inherited = candidate.count
+		candidate.count++
+		c.byASN[asn] = candidate
+		heap.Fix(&c.candidates, 0)
+	}
+
+	known := candidate.count - candidate.inherited
+	if len(c.counts) < *MetricsTopASNs && c.total >= uint64(capacity) && known*uint64(2**MetricsTopASNs) > c.total {
+		heap.Remove(&c.candidates, candidate.index)
+		delete(c.byASN, asn)
+		c.counts[asn] = 0
+	}
+}
+
+// snapshot returns the chosen ASNs in order with their counts, and the count
+// of all the others.
+func (c *asnCounter) snapshot() ([]uint, []uint64, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	asns := make([]uint, 0, len(c.counts))
+	for asn := range c.counts {
+		asns = append(asns, asn)
+	}
+	sort.Slice(asns, func(i, j int) bool { return asns[i] < asns[j] })
+
+	counts := make([]uint64, len(asns))
+	for i, asn := range asns {
+		counts[i] = c.counts[asn]
+	}
+	return asns, counts, c.other
+}
+
+func (c *asnCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *asnCounter) Collect(ch chan<- prometheus.Metric) {
+	if *MetricsTopASNs <= 0 {
+		return
+	}
+	asns, counts, other := c.snapshot()
+	for i, asn := range asns {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(counts[i]), strconv.FormatUint(uint64(asn), 10))
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(other), "other")
+}
+
+// MetricsHandler serves the Prometheus metrics.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// endpointName labels the route of a request path for the duration metric.
+// Only a fixed set of names is used to keep the cardinality bounded, paths
+// that are not a known route end up as "other".
+func endpointName(path string) string {
+	path, _ = ipAPIPath(path)
+	segment, _ := parsePath(path)
+	switch {
+	case segment == "batch", segment == "server-ip", segment == "admin", segment == "asn", segment == "distance", segment == "geofence", segment == "geo", segment == "graphql", segment == "ws", segment == "events", segment == "dns-query":
+		return segment
+	case *HostnameLookups && (segment == "lookup" || isHostname(segment)):
+		return "host"
+	case segment == "" || segment == "self" || segment == "me":
+		return "self"
+	case strings.Contains(segment, ","):
+		return "multi"
+	case net.ParseIP(segment) != nil:
+		return "lookup"
+	case strings.Contains(segment, "/"):
+		if _, _, err := net.ParseCIDR(segment); err == nil {
+			return "lookup"
+		}
+	}
+	return "other"
+}
+
+// observeRequest records how long r has taken since start in the duration
+// metric, and returns its access log line for the handler to add fields to
+// and send.
+func observeRequest(r *http.Request, start time.Time, status int) *zerolog.Event {
+	return accessLog(r, observeDuration(r, time.Since(start), status), status)
+}
+
+// observeDuration records the time a request took, in milliseconds like it
+// returns it, in the duration metric.
+func observeDuration(r *http.Request, elapsed time.Duration, status int) float64 {
+	dur := milliseconds(elapsed)
+	duration.WithLabelValues(endpointName(r.URL.Path), strconv.Itoa(status)).Observe(dur)
+	return dur
+}
+
+// accessLog starts the access log line of a request that took dur
+// milliseconds.
+func accessLog(r *http.Request, dur float64, status int) *zerolog.Event {
+	return log.Info().
+		Float64("duration", dur).
+		Str("method", r.Method).
+		Str("remote", defangIP(r.RemoteAddr)).
+		Str("url", r.URL.EscapedPath()).
+		Int("status", status)
+}
+
+// milliseconds is d in the unit durations are logged and observed in.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1000000
 }
@@ -0,0 +1,65 @@
+package ipinfo
+
+import (
+	"sync"
+	"time"
+)
+
+// refresher runs one background loop at a time, so that re-initializing a
+// feature replaces its loop rather than leaving the old one running.
+type refresher struct {
+	sync.Mutex
+	done chan struct{}
+}
+
+// start stops the running loop, if any, and then calls fn every interval
+// from a new goroutine, the first time right away when now is set. With an
+// interval of 0 or less fn is only called that first time.
+func (r *refresher) start(interval time.Duration, now bool, fn func()) {
+	r.Lock()
+	defer r.Unlock()
+	r.halt()
+
+	done := make(chan struct{})
+	r.done = done
+	go func() {
+		if now {
+			fn()
+		}
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// stop stops the running loop, if any.
+func (r *refresher) stop() {
+	r.Lock()
+	defer r.Unlock()
+	r.halt()
+}
+
+// running reports whether a loop was started and not stopped since.
+func (r *refresher) running() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.done != nil
+}
+
+// halt is stop, for callers holding the lock.
+func (r *refresher) halt() {
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+}
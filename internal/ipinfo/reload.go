@@ -0,0 +1,137 @@
+package ipinfo
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/namsral/flag"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadableFlags are the settings Reload applies to a running server, the
+// others only take effect on a restart.
+var reloadableFlags = map[string]bool{
+	"locale":             true,
+	"loglevel":           true,
+	"client-ip-headers":  true,
+	"trusted-proxies":    true,
+	"max-forwarded-hops": true,
+	"overrides":          true,
+	"webhook-url":        true,
+	"webhook-countries":  true,
+	"webhook-asns":       true,
+	"webhook-timeout":    true,
+}
+
+// Reload re-reads the reloadable settings from the command line, the
+// environment and the config file, then reopens the override list and the
+// databases. Changes to any other setting are logged as not applied.
+func Reload() error {
+	return reload(os.Args[1:])
+}
+
+func reload(arguments []string) error {
+	values, err := parseFlags(arguments)
+	if err != nil {
+		return err
+	}
+
+	// Everything that can fail is checked before any setting is replaced.
+	if _, err := parseTrustedProxies(values["trusted-proxies"].value); err != nil {
+		return err
+	}
+	if _, err := parseWebhookASNs(values["webhook-asns"].value); err != nil {
+		return err
+	}
+	var list []override
+	if path := values["overrides"].value; path != "" {
+		if list, err = loadOverrides(path); err != nil {
+			return err
+		}
+	}
+
+	var ignored []string
+	dbLock.Lock()
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == flag.DefaultConfigFlagname || !changed(f, values[f.Name].value) {
+			return
+		}
+		if !reloadableFlags[f.Name] {
+			ignored = append(ignored, f.Name)
+			return
+		}
+		err = f.Value.Set(values[f.Name].value)
+	})
+	if *Locale == "" {
+		*Locale = "en"
+	}
+	config.Locale = *Locale
+	if err == nil {
+		config.Overrides, overrides = *Overrides, list
+	}
+	dbLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if len(ignored) > 0 {
+		sort.Strings(ignored)
+		log.Warn().Strs("flags", ignored).Msg("Changed settings only take effect on a restart")
+	}
+	initializeClientIP()
+	initializeWebhook()
+	return reloadDatabases()
+}
+
+// changed reports whether value, as the flag would parse it, differs from
+// the value the flag holds.
+func changed(f *flag.Flag, value string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return value != f.Value.String()
+	}
+	switch current := getter.Get().(type) {
+	case bool:
+		v, err := strconv.ParseBool(value)
+		return err != nil || v != current
+	case int:
+		v, err := strconv.ParseInt(value, 0, strconv.IntSize)
+		return err != nil || int(v) != current
+	case float64:
+		v, err := strconv.ParseFloat(value, 64)
+		return err != nil || v != current
+	case time.Duration:
+		v, err := time.ParseDuration(value)
+		return err != nil || v != current
+	}
+	return value != f.Value.String()
+}
+
+// flagValue holds a flag as text, so flags can be parsed again without
+// touching the values in use.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.isBool }
+
+// parseFlags parses the arguments, the environment and the config file the
+// way flag.Parse does at startup, into copies of every flag.
+func parseFlags(arguments []string) (map[string]*flagValue, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+
+	values := make(map[string]*flagValue)
+	flag.VisitAll(func(f *flag.Flag) {
+		_, isBool := f.Value.(interface{ IsBoolFlag() bool })
+		values[f.Name] = &flagValue{value: f.DefValue, isBool: isBool}
+		fs.Var(values[f.Name], f.Name, f.Usage)
+	})
+	return values, fs.Parse(arguments)
+}
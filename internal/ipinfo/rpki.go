@@ -0,0 +1,108 @@
+package ipinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rpkiStates holds recent validity answers keyed by origin and prefix, nil
+// without RPKIURL
+var rpkiStates *ttlCache
+
+var rpkiClient = &http.Client{Timeout: 5 * time.Second}
+
+// initializeRPKI starts caching validity answers when RPKIURL is set.
+func initializeRPKI() {
+	rpkiStates = nil
+	if *RPKIURL != "" {
+		rpkiStates = newTTLCache(10000, *RPKICacheTTL)
+	}
+}
+
+// rpkiState returns the origin validation state of the ASN database network
+// holding ip when announced by asn: valid, invalid or not_found. It is empty
+// without RPKIURL, an ASN or an ASN database, and when the validator can not
+// be asked.
+func rpkiState(ctx context.Context, ip net.IP, asn uint) string {
+	if rpkiStates == nil || asn == 0 {
+		return ""
+	}
+	prefix := asnNetwork(ip)
+	if prefix == nil {
+		return ""
+	}
+
+	key := strconv.FormatUint(uint64(asn), 10) + " " + prefix.String()
+	if state, ok := rpkiStates.get(key, time.Now()); ok {
+		return state
+	}
+	state, err := fetchRPKIState(ctx, *RPKIURL, asn, prefix)
+	if err != nil {
+		log.Warn().Err(err).Str("prefix", prefix.String()).Uint("asn", asn).Msg("Unable to validate the route origin")
+		return ""
+	}
+	rpkiStates.add(key, state, time.Now())
+	return state
+}
+
+// fetchRPKIState asks a validator with Routinator's HTTP API for the
+// validity of the route.
+func fetchRPKIState(ctx context.Context, base string, asn uint, prefix *net.IPNet) (string, error) {
+	url := fmt.Sprintf("%s/api/v1/validity/AS%d/%s", strings.TrimSuffix(base, "/"), asn, prefix)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := rpkiClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var answer struct {
+		ValidatedRoute struct {
+			Validity struct {
+				State string `json:"state"`
+			} `json:"validity"`
+		} `json:"validated_route"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", err
+	}
+	switch state := answer.ValidatedRoute.Validity.State; state {
+	case "valid", "invalid":
+		return state, nil
+	case "not-found", "not_found":
+		return "not_found", nil
+	default:
+		return "", fmt.Errorf("unexpected state %q", state)
+	}
+}
+
+// asnNetwork is the network holding ip in the ASN database, which follows
+// the announced prefixes, nil without one.
+func asnNetwork(ip net.IP) *net.IPNet {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if netASN == nil {
+		return nil
+	}
+	var none struct{}
+	network, ok, err := netASN.LookupNetwork(ip, &none)
+	if err != nil || !ok {
+		return nil
+	}
+	return network
+}
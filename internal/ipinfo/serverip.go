@@ -0,0 +1,118 @@
+package ipinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// serverIP caches the server's own public IP, nil until it is first resolved
+var serverIP struct {
+	sync.RWMutex
+	ip net.IP
+}
+
+var serverIPClient = &http.Client{Timeout: 10 * time.Second}
+
+// serverIPRefresh checks the server's public IP every ServerIPInterval
+var serverIPRefresh refresher
+
+// initializeServerIP periodically asks ServerIPURL for the server's egress
+// address when it is set.
+func initializeServerIP() {
+	if *ServerIPURL == "" {
+		serverIPRefresh.stop()
+		return
+	}
+
+	url := *ServerIPURL
+	serverIPRefresh.start(*ServerIPInterval, true, func() {
+		if ip, err := fetchServerIP(url); err != nil {
+			log.Warn().Err(err).Str("url", url).Msg("Unable to resolve the server's public IP")
+		} else {
+			setServerIP(ip)
+		}
+	})
+}
+
+// fetchServerIP expects url to answer with nothing but the caller's address,
+// like checkip.amazonaws.com or ifconfig.me/ip do.
+func fetchServerIP(url string) (net.IP, error) {
+	resp, err := serverIPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: strings.TrimSpace(string(body))}
+	}
+	return ip, nil
+}
+
+func setServerIP(ip net.IP) {
+	serverIP.Lock()
+	defer serverIP.Unlock()
+	if ip != nil && !ip.Equal(serverIP.ip) {
+		log.Info().Str("ip", ip.String()).Msg("Resolved the server's public IP")
+	}
+	serverIP.ip = ip
+}
+
+func currentServerIP() net.IP {
+	serverIP.RLock()
+	defer serverIP.RUnlock()
+	return serverIP.ip
+}
+
+// ServerIP answers with the lookup of the server's own public IP, or 503
+// until it has been resolved. Without a ServerIPURL there is nothing to
+// resolve it with, and it answers 404.
+func ServerIP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+
+	defer func() {
+		observeRequest(r, start, retval).Msg("")
+	}()
+
+	if *ServerIPURL == "" {
+		http.NotFound(w, r)
+		retval = http.StatusNotFound
+		return
+	}
+
+	ip := currentServerIP()
+	if ip == nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		retval = http.StatusServiceUnavailable
+		return
+	}
+
+	info, err := LookupIP(ip)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		retval = http.StatusInternalServerError
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(info)
+	retval = http.StatusOK
+}
@@ -0,0 +1,81 @@
+package ipinfo
+
+import (
+	"net"
+
+	"github.com/rs/zerolog/log"
+)
+
+// subdivision is one level of the region hierarchy, from the largest down.
+// Confidence is only known with the Enterprise database.
+type subdivision struct {
+	Code       string            `json:"code"`
+	Name       string            `json:"name"`
+	ISO31662   string            `json:"iso_3166_2,omitempty"`
+	Confidence *uint8            `json:"confidence,omitempty"`
+	Names      map[string]string `json:"names,omitempty"`
+
+	// Names in every locale, for all_names=1.
+	names map[string]string
+	// Where Name was filled in from, empty when the database has it.
+	nameSource string
+}
+
+// iso31662 composes the ISO 3166-2 code of a subdivision, like US-CA.
+func iso31662(country, subdivision string) string {
+	if country == "" || subdivision == "" {
+		return ""
+	}
+	return country + "-" + subdivision
+}
+
+// lookupSubdivisions returns every subdivision of ip, from the Enterprise
+// database when one is loaded and the City database otherwise. Names are in
+// the first of the locales they have one in, or the configured locale when
+// none are given.
+func lookupSubdivisions(ip net.IP, locales ...string) []subdivision {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	if len(locales) == 0 {
+		locales = []string{*Locale}
+	}
+	name := func(sd *subdivision, geoNameID uint) {
+		sd.Name, sd.nameSource = localizedName(place{sd.names, geoNameID, sd.ISO31662}, "subdivision", locales...)
+	}
+
+	var subdivisions []subdivision
+	if dbEnterprise != nil {
+		rec, err := dbEnterprise.Enterprise(ip)
+		if err != nil {
+			log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in Enterprise database")
+			return nil
+		}
+		for _, sd := range rec.Subdivisions {
+			confidence := sd.Confidence
+			subdivisions = append(subdivisions, subdivision{
+				Code:       sd.IsoCode,
+				ISO31662:   iso31662(rec.Country.IsoCode, sd.IsoCode),
+				Confidence: &confidence,
+				names:      sd.Names,
+			})
+			name(&subdivisions[len(subdivisions)-1], sd.GeoNameID)
+		}
+		return subdivisions
+	}
+
+	rec, _, err := lookupCity(ip)
+	if err != nil {
+		log.Warn().Err(err).Str("ip", ip.String()).Msg("Warning: Unable to lookup in City database")
+		return nil
+	}
+	for _, sd := range rec.Subdivisions {
+		subdivisions = append(subdivisions, subdivision{
+			Code:     sd.IsoCode,
+			ISO31662: iso31662(rec.Country.IsoCode, sd.IsoCode),
+			names:    sd.Names,
+		})
+		name(&subdivisions[len(subdivisions)-1], sd.GeoNameID)
+	}
+	return subdivisions
+}
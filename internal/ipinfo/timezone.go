@@ -0,0 +1,30 @@
+package ipinfo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// zones caches the loaded time zones by name, a nil location marking one
+// that could not be loaded.
+var zones sync.Map
+
+// localTime formats t in the IANA time zone as RFC 3339. An unknown zone, or
+// a missing time zone database, gives an empty string.
+func localTime(zone string, t time.Time) string {
+	v, ok := zones.Load(zone)
+	if !ok {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			log.Warn().Err(err).Str("timezone", zone).Msg("Unable to load time zone")
+		}
+		v, _ = zones.LoadOrStore(zone, loc)
+	}
+	loc := v.(*time.Location)
+	if loc == nil {
+		return ""
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
@@ -0,0 +1,92 @@
+package ipinfo
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// torExits holds the Tor exit node addresses, nil until the list is first
+// downloaded
+var torExits struct {
+	sync.RWMutex
+	ips map[string]bool
+}
+
+var torExitClient = &http.Client{Timeout: time.Minute}
+
+// torExitRefresh downloads the exit list every TorExitInterval
+var torExitRefresh refresher
+
+// initializeTorExits periodically downloads the exit list from TorExitURL
+// when it is set. A failed download keeps the list from before.
+func initializeTorExits() {
+	setTorExits(nil)
+	if *TorExitURL == "" {
+		torExitRefresh.stop()
+		return
+	}
+
+	url := *TorExitURL
+	torExitRefresh.start(*TorExitInterval, true, func() {
+		if ips, err := fetchTorExits(url); err != nil {
+			log.Warn().Err(err).Str("url", url).Msg("Unable to download the Tor exit list")
+		} else {
+			setTorExits(ips)
+			log.Info().Int("exits", len(ips)).Msg("Downloaded the Tor exit list")
+		}
+	})
+}
+
+// fetchTorExits expects url to answer with one address per line, like the
+// Tor Project's bulk exit list does.
+func fetchTorExits(url string) (map[string]bool, error) {
+	resp, err := torExitClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	ips := make(map[string]bool)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if ip := net.ParseIP(line); ip != nil {
+			ips[ip.String()] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+func setTorExits(ips map[string]bool) {
+	torExits.Lock()
+	defer torExits.Unlock()
+	torExits.ips = ips
+}
+
+// isTorExit reports whether ip is a Tor exit node, nil until the list has
+// been downloaded.
+func isTorExit(ip net.IP) *bool {
+	torExits.RLock()
+	defer torExits.RUnlock()
+	if torExits.ips == nil {
+		return nil
+	}
+	tor := torExits.ips[ip.String()]
+	return &tor
+}
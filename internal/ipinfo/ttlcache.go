@@ -0,0 +1,74 @@
+package ipinfo
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ttlCache is a fixed-size LRU of strings, each kept for ttl. Its methods do
+// nothing on a nil cache.
+type ttlCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type ttlEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+func newTTLCache(size int, ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *ttlCache) get(key string, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*ttlEntry)
+	if now.After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *ttlCache) add(key, value string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*ttlEntry)
+		entry.value, entry.expires = value, now.Add(c.ttl)
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&ttlEntry{key, value, now.Add(c.ttl)})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*ttlEntry).key)
+	}
+}
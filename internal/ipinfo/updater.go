@@ -0,0 +1,196 @@
+package ipinfo
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/rs/zerolog/log"
+)
+
+// maxmindDownloadURL is the MaxMind download service, taking the edition and
+// the file suffix.
+var maxmindDownloadURL = "https://download.maxmind.com/geoip/databases/%s/download?suffix=%s"
+
+var updaterClient = &http.Client{Timeout: 5 * time.Minute}
+
+// updaterRefresh checks for new database builds every UpdateInterval
+var updaterRefresh refresher
+
+// initializeUpdater downloads the City and ASN databases from MaxMind, when
+// a license key is configured, before they are opened. Then it keeps them up
+// to date every UpdateInterval, reloading them when a new build lands. An
+// updater started by an earlier call is stopped first.
+func initializeUpdater() {
+	updaterRefresh.stop()
+	if config.MaxMindLicenseKey == "" {
+		return
+	}
+
+	city := "GeoLite2-City"
+	if filepath.Base(config.CityDB) == "GeoLite2-Country.mmdb" {
+		city = "GeoLite2-Country"
+	}
+	editions := map[string]string{city: config.CityDB}
+	if config.ASNDB != "" {
+		editions["GeoLite2-ASN"] = config.ASNDB
+	}
+
+	update := func() (updated bool) {
+		for edition, path := range editions {
+			ok, err := updateDatabase(edition, path)
+			if err != nil {
+				log.Warn().Err(err).Str("edition", edition).Msg("Unable to update database")
+				continue
+			}
+			if ok {
+				log.Info().Str("edition", edition).Str("path", path).Msg("Downloaded new database build")
+				updated = true
+			}
+		}
+		return updated
+	}
+	update()
+
+	updaterRefresh.start(config.UpdateInterval, false, func() {
+		if !update() {
+			return
+		}
+		if err := reloadDatabases(); err != nil {
+			log.Error().Err(err).Msg("Unable to reload updated databases, keeping the current ones")
+		}
+	})
+}
+
+// updateDatabase downloads the latest build of an edition to path, unless
+// the checksum MaxMind publishes matches the one of the build already there,
+// which is kept next to it in path.sha256. The archive is verified against
+// the checksum and the database must open before it replaces the old one.
+func updateDatabase(edition, path string) (bool, error) {
+	want, err := fetchChecksum(edition)
+	if err != nil {
+		return false, err
+	}
+	if have, err := ioutil.ReadFile(path + ".sha256"); err == nil && strings.TrimSpace(string(have)) == want {
+		if _, err := os.Stat(path); err == nil {
+			return false, nil
+		}
+	}
+
+	resp, err := maxmindGet(edition, "tar.gz")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	tmp := path + ".download"
+	defer os.Remove(tmp)
+
+	hash := sha256.New()
+	if err := extractDatabase(io.TeeReader(resp.Body, hash), tmp); err != nil {
+		return false, err
+	}
+	// Hash whatever follows the database in the archive too.
+	if _, err := io.Copy(hash, resp.Body); err != nil {
+		return false, err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return false, fmt.Errorf("checksum mismatch: got %s, want %s", got, want)
+	}
+
+	db, err := geoip2.Open(tmp)
+	if err != nil {
+		return false, err
+	}
+	db.Close()
+
+	if err := os.Rename(tmp, path); err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(path+".sha256", []byte(want+"\n"), 0644)
+}
+
+// fetchChecksum returns the SHA-256 of the latest archive of an edition.
+func fetchChecksum(edition string) (string, error) {
+	resp, err := maxmindGet(edition, "tar.gz.sha256")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// The file is formatted like sha256sum output: "<checksum>  <file>".
+	line, err := bufio.NewReader(io.LimitReader(resp.Body, 1024)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("malformed checksum %q", line)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+func maxmindGet(edition, suffix string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(maxmindDownloadURL, edition, suffix), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(config.MaxMindAccountID, config.MaxMindLicenseKey)
+
+	resp, err := updaterClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// extractDatabase writes the .mmdb file of a MaxMind tar.gz archive to path.
+func extractDatabase(archive io.Reader, path string) error {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("no database in the archive")
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasSuffix(header.Name, ".mmdb") {
+			continue
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		// Drain the rest of the archive so it is all hashed.
+		_, err = io.Copy(ioutil.Discard, gz)
+		return err
+	}
+}
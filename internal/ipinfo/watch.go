@@ -0,0 +1,90 @@
+package ipinfo
+
+import (
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fileStamp identifies a version of a file, a different size or modification
+// time means it was replaced.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// databaseWatcher notices the database files being replaced. A change is
+// only reported once the files have stopped changing for one poll, so a
+// database still being copied in is not opened half written.
+type databaseWatcher struct {
+	paths   []string
+	stamps  map[string]fileStamp
+	pending bool
+}
+
+func newDatabaseWatcher(paths ...string) *databaseWatcher {
+	w := &databaseWatcher{paths: paths}
+	w.stamps = w.stat()
+	return w
+}
+
+func (w *databaseWatcher) stat() map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(w.paths))
+	for _, path := range w.paths {
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		}
+	}
+	return stamps
+}
+
+// changed polls the files, it reports true once per settled replacement.
+func (w *databaseWatcher) changed() bool {
+	stamps := w.stat()
+	settled := len(stamps) == len(w.stamps)
+	for path, stamp := range stamps {
+		if w.stamps[path] != stamp {
+			settled = false
+		}
+	}
+	w.stamps = stamps
+	if !settled {
+		w.pending = true
+		return false
+	}
+	if w.pending {
+		w.pending = false
+		return true
+	}
+	return false
+}
+
+// databaseWatch polls the databases every WatchInterval
+var databaseWatch refresher
+
+// initializeWatcher polls the City and ASN databases every WatchInterval and
+// reloads them when they are replaced, without a restart.
+func initializeWatcher() {
+	if config.WatchInterval <= 0 {
+		databaseWatch.stop()
+		return
+	}
+
+	paths := []string{config.CityDB}
+	if config.ASNDB != "" {
+		paths = append(paths, config.ASNDB)
+	}
+	watcher := newDatabaseWatcher(paths...)
+
+	databaseWatch.start(config.WatchInterval, false, func() {
+		if !watcher.changed() {
+			return
+		}
+		if err := reloadDatabases(); err != nil {
+			log.Error().Err(err).Msg("Unable to reload replaced databases, keeping the current ones")
+			return
+		}
+		log.Info().Strs("paths", paths).Msg("Reloaded replaced databases")
+	})
+}
@@ -0,0 +1,132 @@
+package ipinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The webhook configuration, swapped by initializeWebhook under webhookLock
+// while the one delivery worker keeps running. An empty URL disables it.
+// webhookQueue holds matched lookups waiting for delivery, nil until the
+// webhook is first enabled. Its size is fixed then.
+var (
+	webhookLock      sync.RWMutex
+	webhookQueue     chan ipInfo
+	webhookURL       string
+	webhookCountries map[string]bool
+	webhookASNs      map[uint]bool
+	webhookClient    = &http.Client{}
+)
+
+// initializeWebhook applies the webhook options, starting the delivery
+// worker the first time WebhookURL is set.
+func initializeWebhook() {
+	countries := make(map[string]bool)
+	for _, code := range strings.Split(*WebhookCountries, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			countries[strings.ToUpper(code)] = true
+		}
+	}
+
+	asns, err := parseWebhookASNs(*WebhookASNs)
+	if err != nil {
+		log.Fatal().Err(err).Str("asns", *WebhookASNs).Msg("Unable to parse webhook ASN, cannot continue")
+	}
+
+	if *WebhookURL != "" && len(countries) == 0 && len(asns) == 0 {
+		log.Warn().Msg("Webhook URL set without countries or ASNs to match, it will never fire")
+	}
+
+	webhookLock.Lock()
+	defer webhookLock.Unlock()
+	webhookURL, webhookCountries, webhookASNs = *WebhookURL, countries, asns
+	webhookClient = &http.Client{Timeout: *WebhookTimeout}
+	if *WebhookURL != "" && webhookQueue == nil {
+		webhookQueue = make(chan ipInfo, *WebhookQueue)
+		go deliverWebhooks(webhookQueue)
+	}
+}
+
+// parseWebhookASNs parses a comma-separated list of ASNs, with or without
+// the AS prefix.
+func parseWebhookASNs(list string) (map[uint]bool, error) {
+	asns := make(map[uint]bool)
+	for _, asn := range strings.Split(list, ",") {
+		if asn = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(asn)), "AS"); asn == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(asn, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		asns[uint(n)] = true
+	}
+	return asns, nil
+}
+
+// webhookMatch returns the queue to deliver info through, nil when the
+// webhook is disabled or info does not match it.
+func webhookMatch(info ipInfo) chan<- ipInfo {
+	webhookLock.RLock()
+	defer webhookLock.RUnlock()
+	if webhookURL == "" || !(webhookCountries[info.Country.Code] || webhookASNs[info.ASN]) {
+		return nil
+	}
+	return webhookQueue
+}
+
+// notifyWebhook queues a matching lookup for delivery without blocking. The
+// lookup is dropped when the queue is full.
+func notifyWebhook(info ipInfo) {
+	queue := webhookMatch(info)
+	if queue == nil {
+		return
+	}
+
+	select {
+	case queue <- info:
+	default:
+		webhookDeliveries.WithLabelValues("dropped").Inc()
+	}
+}
+
+// deliverWebhooks posts each queued lookup to the current webhook URL, off
+// the request path. Lookups queued before it was disabled are dropped.
+func deliverWebhooks(queue <-chan ipInfo) {
+	for info := range queue {
+		webhookLock.RLock()
+		url, client := webhookURL, webhookClient
+		webhookLock.RUnlock()
+		if url == "" {
+			webhookDeliveries.WithLabelValues("dropped").Inc()
+			continue
+		}
+
+		payload, err := json.Marshal(info)
+		if err != nil {
+			webhookDeliveries.WithLabelValues("failure").Inc()
+			continue
+		}
+
+		resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Warn().Err(err).Str("ip", info.IP).Msg("Warning: Unable to deliver webhook")
+			webhookDeliveries.WithLabelValues("failure").Inc()
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			log.Warn().Int("status", resp.StatusCode).Str("ip", info.IP).Msg("Warning: Webhook rejected delivery")
+			webhookDeliveries.WithLabelValues("failure").Inc()
+			continue
+		}
+		webhookDeliveries.WithLabelValues("success").Inc()
+	}
+}
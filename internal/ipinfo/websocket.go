@@ -0,0 +1,303 @@
+package ipinfo
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// websocketGUID is appended to the client's key to accept a handshake.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Messages longer than this are refused, an address fits many times over.
+const websocketMaxMessage = 4096
+
+// Connections idle for longer than this are closed.
+const websocketIdleTimeout = 5 * time.Minute
+
+// Frame opcodes and close status codes of RFC 6455.
+const (
+	websocketContinuation = 0x0
+	websocketText         = 0x1
+	websocketBinary       = 0x2
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xa
+
+	websocketNormal      = 1000
+	websocketProtocol    = 1002
+	websocketUnsupported = 1003
+	websocketInvalidData = 1007
+	websocketTooBig      = 1009
+)
+
+// websocketError closes the connection with a status code.
+type websocketError struct {
+	code   int
+	reason string
+}
+
+func (e websocketError) Error() string {
+	return e.reason
+}
+
+// WebSocket upgrades the request to a WebSocket on which every text message
+// is an address, answered in order with the JSON lookup, or with the query
+// and the error when it cannot be looked up. Names are in the locale of the
+// lang parameter, like in lookups. Every message counts against the rate
+// limit, keyed like in Tarpit.
+func WebSocket(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	retval := http.StatusTeapot
+	lookups := 0
+	var upgraded time.Time
+
+	defer func() {
+		// The duration metric is only the handshake, connections stay open.
+		handshake := time.Since(start)
+		if !upgraded.IsZero() {
+			handshake = upgraded.Sub(start)
+		}
+		observeDuration(r, handshake, retval)
+		accessLog(r, milliseconds(time.Since(start)), retval).Int("lookups", lookups).Msg("")
+	}()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		retval = http.StatusMethodNotAllowed
+		return
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		retval = http.StatusUpgradeRequired
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		retval = http.StatusBadRequest
+		return
+	}
+
+	var locales []string
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		if locale := matchLanguage(lang, nameLocales); locale != "" {
+			locales = append(locales, locale)
+		}
+		locales = append(locales, "en")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		retval = http.StatusInternalServerError
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Warn().Err(err).Msg("Warning: Unable to take over the WebSocket connection")
+		retval = http.StatusInternalServerError
+		return
+	}
+	defer conn.Close()
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		retval = http.StatusInternalServerError
+		return
+	}
+	retval = http.StatusSwitchingProtocols
+	upgraded = time.Now()
+
+	lookups = serveWebSocket(conn, rw, limiterKey(r), locales)
+}
+
+// serveWebSocket answers the messages on conn until either side closes it,
+// and returns the number of lookups made.
+func serveWebSocket(conn net.Conn, rw *bufio.ReadWriter, client string, locales []string) int {
+	lookups := 0
+	for {
+		conn.SetDeadline(time.Now().Add(websocketIdleTimeout))
+
+		msg, err := readWebSocketMessage(rw)
+		if err != nil {
+			code, reason := websocketNormal, ""
+			if we, ok := err.(websocketError); ok {
+				code, reason = we.code, we.reason
+			} else if err != errWebSocketClosed {
+				// The connection is gone, there is no one to tell.
+				return lookups
+			}
+			closing := make([]byte, 2, 2+len(reason))
+			binary.BigEndian.PutUint16(closing, uint16(code))
+			writeWebSocketFrame(rw, websocketClose, append(closing, reason...))
+			rw.Flush()
+			return lookups
+		}
+
+		if rateLimiter != nil {
+			if ok, _, _ := rateLimiter.take(client); !ok && *TarpitDelay > 0 {
+				tarpitted.Inc()
+				time.Sleep(*TarpitDelay)
+			}
+		}
+
+		result := lookupQuery(string(msg))
+		if result.err == nil && len(locales) > 0 {
+			result.info.localize(locales...)
+		}
+		lookups++
+		reply, _ := json.Marshal(result.entry())
+		writeWebSocketFrame(rw, websocketText, reply)
+		if err := rw.Flush(); err != nil {
+			return lookups
+		}
+	}
+}
+
+// errWebSocketClosed is returned once the client sent a close frame.
+var errWebSocketClosed = errors.New("websocket closed by the client")
+
+// readWebSocketMessage reads frames until the last one of a text message,
+// answering pings on the way. Violations of the protocol are returned as a
+// websocketError to close the connection with.
+func readWebSocketMessage(rw *bufio.ReadWriter) ([]byte, error) {
+	var msg []byte
+	var started bool
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(rw, header[:]); err != nil {
+			return msg, err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		if header[0]&0x70 != 0 {
+			return msg, websocketError{websocketProtocol, "reserved bits set"}
+		}
+		if header[1]&0x80 == 0 {
+			return msg, websocketError{websocketProtocol, "client frames must be masked"}
+		}
+
+		size := uint64(header[1] & 0x7f)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(rw, ext[:]); err != nil {
+				return msg, err
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(rw, ext[:]); err != nil {
+				return msg, err
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+
+		control := opcode&0x8 != 0
+		switch {
+		case control && (!fin || size > 125):
+			return msg, websocketError{websocketProtocol, "invalid control frame"}
+		case !control && size > uint64(websocketMaxMessage-len(msg)):
+			return msg, websocketError{websocketTooBig, "message too big"}
+		case opcode == websocketContinuation && !started:
+			return msg, websocketError{websocketProtocol, "unexpected continuation frame"}
+		case !control && opcode != websocketContinuation && started:
+			return msg, websocketError{websocketProtocol, "expected continuation frame"}
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(rw, mask[:]); err != nil {
+			return msg, err
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(rw, payload); err != nil {
+			return msg, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case websocketClose:
+			return nil, errWebSocketClosed
+		case websocketPing:
+			if err := writeWebSocketFrame(rw, websocketPong, payload); err != nil {
+				return nil, err
+			}
+			if err := rw.Flush(); err != nil {
+				return nil, err
+			}
+			continue
+		case websocketPong:
+			continue
+		case websocketBinary:
+			return nil, websocketError{websocketUnsupported, "only text messages are supported"}
+		case websocketText, websocketContinuation:
+			started = true
+		default:
+			return nil, websocketError{websocketProtocol, "unknown opcode"}
+		}
+
+		msg = append(msg, payload...)
+		if !fin {
+			continue
+		}
+		if !utf8.Valid(msg) {
+			return nil, websocketError{websocketInvalidData, "invalid UTF-8"}
+		}
+		return msg, nil
+	}
+}
+
+// writeWebSocketFrame writes payload as a single unmasked frame.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= math.MaxUint16:
+		header[1] = 126
+		header = append(header, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// headerHasToken reports whether the comma-separated header lists token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
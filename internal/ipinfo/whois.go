@@ -0,0 +1,132 @@
+package ipinfo
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Clients have this long to send their query and read the answer.
+const whoisTimeout = 10 * time.Second
+
+// Queries longer than this are refused, a line holds many addresses.
+const whoisMaxQuery = 1024
+
+// ServeWhois answers WHOIS queries (RFC 3912) on addr: a line of addresses
+// separated by spaces, each answered with a block of key/value lines, after
+// which the connection is closed. It only returns when the listener fails.
+func ServeWhois(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Info().Msg("WHOIS listening on " + addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go serveWhoisConn(conn)
+	}
+}
+
+// serveWhoisConn answers the one query of a connection. Like a request, it
+// counts against the rate limit of the client.
+func serveWhoisConn(conn net.Conn) {
+	start := time.Now()
+	defer conn.Close()
+	conn.SetDeadline(start.Add(whoisTimeout))
+
+	remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+
+	line, err := bufio.NewReaderSize(conn, whoisMaxQuery).ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			fmt.Fprint(w, "% error: query too long\r\n")
+		}
+		return
+	}
+
+	if rateLimiter != nil {
+		if ok, _, _ := rateLimiter.take(remote); !ok && *TarpitDelay > 0 {
+			tarpitted.Inc()
+			time.Sleep(*TarpitDelay)
+		}
+	}
+
+	queries := strings.Fields(string(line))
+	fmt.Fprint(w, "% ipinfo whois, answered from the local databases\r\n")
+	switch {
+	case len(queries) == 0:
+		fmt.Fprint(w, "\r\n% error: no address given\r\n")
+		return
+	case len(queries) > *BatchLimit:
+		fmt.Fprintf(w, "\r\n%% error: %s\r\n", errBatchLimit)
+		return
+	}
+	for _, result := range lookupBatch(queries) {
+		w.WriteString("\r\n")
+		if result.err != nil {
+			fmt.Fprintf(w, "%% error: %s: %s\r\n", result.err, result.query)
+			continue
+		}
+		w.WriteString(formatWhois(result.info, net.ParseIP(result.query)))
+	}
+
+	dur := milliseconds(time.Since(start))
+	log.Info().
+		Float64("duration", dur).
+		Int("entries", len(queries)).
+		Str("protocol", "whois").
+		Str("remote", defangIP(remote)).
+		Msg("")
+}
+
+// formatWhois lists the lookup of ip as aligned key/value lines, leaving out
+// what is unknown.
+func formatWhois(info ipInfo, ip net.IP) string {
+	var b strings.Builder
+	add := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%-16s%s\r\n", key+":", value)
+		}
+	}
+
+	add("ip", info.IP)
+	if n := matchedNetwork(ip); n != nil {
+		add("network", n.String())
+	}
+	if n := resultNetwork(ip); n != nil {
+		add("result-network", n.String())
+	}
+	add("type", info.Type)
+	add("city", info.City)
+	add("region", info.Region)
+	if info.Postal != nil {
+		add("postal", *info.Postal)
+	}
+	add("country", info.Country.Code)
+	add("country-name", info.Country.Name)
+	if info.Continent != nil {
+		add("continent", info.Continent.Code)
+	}
+	if info.Location.known() {
+		add("location", strconv.FormatFloat(info.Location.Latitude, 'f', -1, 64)+","+strconv.FormatFloat(info.Location.Longitude, 'f', -1, 64))
+	}
+	add("timezone", info.TimeZone)
+	add("origin", asString(info.ASN))
+	add("organization", info.Organization)
+	return b.String()
+}